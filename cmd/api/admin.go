@@ -0,0 +1,402 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/bal3000/greenlight/internal/data"
+	"github.com/bal3000/greenlight/internal/validator"
+	"github.com/julienschmidt/httprouter"
+)
+
+// The searchUsersHandler finds users by the start of their email address, for
+// typeahead in admin tooling.
+func (app *application) searchUsersHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email          string
+		Limit          int
+		IncludeService bool
+	}
+
+	v := validator.New()
+	qs := r.URL.Query()
+
+	input.Email = app.readString(qs, "email", "")
+	input.Limit = app.readInt(qs, "limit", 10, v)
+	input.IncludeService = app.readBool(qs, "include_service", false, v)
+	loc := app.readTimezone(qs, "timezone", v)
+
+	v.Check(input.Email != "", "email", "must be provided")
+	v.Check(len(input.Email) <= 254, "email", "must not be more than 254 bytes long")
+	v.Check(validator.Between(input.Limit, 1, 50), "limit", "must be between 1 and 50")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	users, err := app.models.Users.SearchByEmail(input.Email, input.Limit, input.IncludeService)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.inTimezone(loc, users...)
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"users": users}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The checkEmailExistsHandler reports whether an email address is already registered,
+// without returning the user. It's only open to admins, since anyone else could use it
+// to find out who has an account.
+func (app *application) checkEmailExistsHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+	qs := r.URL.Query()
+
+	email := app.readString(qs, "email", "")
+
+	if data.ValidateEmail(v, email); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	exists, err := app.models.Users.EmailExists(email)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"exists": exists}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The listRecentUsersHandler returns the newest signups, for the moderation queue.
+func (app *application) listRecentUsersHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+	qs := r.URL.Query()
+
+	limit := app.readInt(qs, "limit", 20, v)
+	includeService := app.readBool(qs, "include_service", false, v)
+	loc := app.readTimezone(qs, "timezone", v)
+	v.Check(validator.Between(limit, 1, data.MaxRecentUsers), "limit", fmt.Sprintf("must be between 1 and %d", data.MaxRecentUsers))
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	users, err := app.models.Users.GetRecent(limit, includeService)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.inTimezone(loc, users...)
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"users": users}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The mergeUsersHandler merges the user given in the request body into the user in the
+// URL, deleting the former.
+func (app *application) mergeUsersHandler(w http.ResponseWriter, r *http.Request) {
+	targetID, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	var input struct {
+		SourceID int64 `json:"source_id"`
+	}
+
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	v.Check(input.SourceID > 0, "source_id", "must be a positive integer")
+	v.Check(input.SourceID != targetID, "source_id", "must be a different user")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Users.Merge(input.SourceID, targetID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "users successfully merged"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The updateUserStatusHandler moves a user to a new status, for example to suspend an
+// abusive account or reinstate a suspended one. Suspending or deleting a user revokes
+// all of their tokens.
+func (app *application) updateUserStatusHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	var input struct {
+		Status data.Status `json:"status"`
+	}
+
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	user, err := app.models.Users.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateStatusTransition(v, user.Status, input.Status); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	from := user.Status
+
+	revoked, err := app.models.Users.SetStatus(user, input.Status)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.logger.PrintInfo("changed user status", map[string]string{
+		"admin_id": strconv.FormatInt(app.contextGetUser(r).ID, 10),
+		"user_id":  strconv.FormatInt(user.ID, 10),
+		"from":     string(from),
+		"to":       string(user.Status),
+		"revoked":  strconv.FormatInt(revoked, 10),
+	})
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The showPasswordCostsHandler returns the number of users with each bcrypt cost.
+func (app *application) showPasswordCostsHandler(w http.ResponseWriter, r *http.Request) {
+	histogram, err := app.models.Users.HashCostHistogram()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"password_costs": histogram}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The retryFailedEmailHandler re-sends a scheduled email which has permanently failed,
+// for example once an SMTP outage is over.
+func (app *application) retryFailedEmailHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.retryFailedEmail(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.logError(r, err)
+			app.errorResponse(w, r, http.StatusBadGateway, "the email could not be sent, and is still marked as failed")
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "email successfully sent"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The listUsersWithPermissionHandler lists the users who have the permission in the
+// URL, a page at a time.
+func (app *application) listUsersWithPermissionHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		data.Filters
+	}
+
+	v := validator.New()
+	qs := r.URL.Query()
+
+	code := httprouter.ParamsFromContext(r.Context()).ByName("code")
+
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Filters.Sort = app.readString(qs, "sort", "id")
+	input.Filters.SortSafelist = []string{"id", "email", "name", "created_at", "-id", "-email", "-name", "-created_at"}
+	loc := app.readTimezone(qs, "timezone", v)
+
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	users, metadata, err := app.models.Users.GetAllWithPermission(code, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.inTimezone(loc, users...)
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"users": users, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The createServiceAccountHandler creates a service account with the given
+// permissions. Service accounts are activated straight away, and authenticate with
+// their email address and password like any other user.
+func (app *application) createServiceAccountHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Name        string   `json:"name"`
+		Email       string   `json:"email"`
+		Password    string   `json:"password"`
+		Permissions []string `json:"permissions"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	user := &data.User{
+		Name:  input.Name,
+		Email: input.Email,
+	}
+
+	v := validator.New()
+
+	err = user.Password.Set(app.models.Hasher, input.Password)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrPasswordAlreadyHashed):
+			v.AddError("password", "must not be a password hash")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	data.ValidateUser(v, user, app.models.Hasher)
+	v.Check(validator.SliceLength(input.Permissions, 1, 20), "permissions", "must contain between 1 and 20 permissions")
+	v.Check(validator.Unique(input.Permissions), "permissions", "must not contain duplicate values")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Users.CreateServiceAccount(user, input.Permissions...)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateEmail):
+			v.AddError("email", "a user with this email address already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The revokeTokensHandler deletes every token issued before the given time, across all
+// users, forcing everyone to sign in again. It's for incident response, so the request
+// is logged along with the admin who made it.
+func (app *application) revokeTokensHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		IssuedBefore time.Time `json:"issued_before"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	v.Check(!input.IssuedBefore.IsZero(), "issued_before", "must be provided")
+	v.Check(!input.IssuedBefore.After(time.Now()), "issued_before", "must not be in the future")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	revoked, err := app.models.Tokens.DeleteByIssuedBefore(input.IssuedBefore)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.logger.PrintInfo("revoked tokens", map[string]string{
+		"admin_id":      strconv.FormatInt(app.contextGetUser(r).ID, 10),
+		"issued_before": input.IssuedBefore.Format(time.RFC3339),
+		"revoked":       strconv.FormatInt(revoked, 10),
+	})
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"revoked": revoked}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// loginFailures counts failed logins for each email address over a fixed window, so
+// that an ops alert can be sent when an account looks like it's under attack.
+type loginFailures struct {
+	mu        sync.Mutex
+	threshold int
+	window    time.Duration
+	counts    map[string]*loginFailureCount
+}
+
+type loginFailureCount struct {
+	count int
+	start time.Time
+}
+
+func newLoginFailures(threshold int, window time.Duration) *loginFailures {
+	return &loginFailures{
+		threshold: threshold,
+		window:    window,
+		counts:    make(map[string]*loginFailureCount),
+	}
+}
+
+// record counts a failed login for the email address. It returns the number of
+// failures in the current window when that number reaches the threshold, and 0 the
+// rest of the time, so that only one alert is sent per address per window.
+func (l *loginFailures) record(email string, now time.Time) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	c, ok := l.counts[email]
+	if !ok || now.Sub(c.start) >= l.window {
+		c = &loginFailureCount{start: now}
+		l.counts[email] = c
+	}
+
+	c.count++
+
+	if c.count == l.threshold {
+		return c.count
+	}
+
+	return 0
+}
+
+// purge forgets the addresses whose window has ended.
+func (l *loginFailures) purge(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for email, c := range l.counts {
+		if now.Sub(c.start) >= l.window {
+			delete(l.counts, email)
+		}
+	}
+}
+
+// alertLoginFailure records a failed login for a user, and sends the login_failures
+// alert to the ops webhook (if one is configured) once the user reaches the threshold.
+func (app *application) alertLoginFailure(email string) {
+	if app.alerts == nil {
+		return
+	}
+
+	attempts := app.loginFailures.record(email, time.Now())
+	if attempts == 0 {
+		return
+	}
+
+	app.background(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+
+		err := app.alerts.Notify(ctx, "", "login_failures.tmpl", map[string]interface{}{
+			"attempts": attempts,
+			"email":    email,
+			"window":   fmt.Sprintf("%d minutes", int(app.loginFailures.window.Minutes())),
+		})
+		if err != nil {
+			app.logger.PrintError(err, nil)
+		}
+	})
+}
+
+// purgeLoginFailures regularly forgets the failed logins which are too old to count
+// towards an alert, so that the counts don't grow without limit.
+func (app *application) purgeLoginFailures() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-app.shutdown:
+			return
+		case <-ticker.C:
+			app.loginFailures.purge(time.Now())
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLoginFailuresRecord(t *testing.T) {
+	l := newLoginFailures(3, 15*time.Minute)
+	start := time.Now()
+
+	// Only the failure which reaches the threshold reports the count.
+	for i, want := range []int{0, 0, 3, 0, 0} {
+		if got := l.record("alice@example.com", start.Add(time.Duration(i)*time.Minute)); got != want {
+			t.Errorf("failure %d: got %d; want %d", i+1, got, want)
+		}
+	}
+
+	// Other addresses are counted separately.
+	if got := l.record("bob@example.com", start); got != 0 {
+		t.Errorf("bob's first failure: got %d; want 0", got)
+	}
+
+	// Once the window has passed, counting starts again.
+	later := start.Add(15 * time.Minute)
+	for i, want := range []int{0, 0, 3} {
+		if got := l.record("alice@example.com", later); got != want {
+			t.Errorf("failure %d in the next window: got %d; want %d", i+1, got, want)
+		}
+	}
+}
+
+func TestLoginFailuresPurge(t *testing.T) {
+	l := newLoginFailures(3, 15*time.Minute)
+	start := time.Now()
+
+	l.record("alice@example.com", start)
+	l.record("bob@example.com", start.Add(10*time.Minute))
+
+	l.purge(start.Add(15 * time.Minute))
+
+	if _, ok := l.counts["alice@example.com"]; ok {
+		t.Error("expected alice's expired window to be purged")
+	}
+
+	if _, ok := l.counts["bob@example.com"]; !ok {
+		t.Error("expected bob's current window to be kept")
+	}
+}
@@ -15,6 +15,14 @@ type contextKey string
 // in the request context.
 const userContextKey = contextKey("user")
 
+// The permissions of the authenticated user are stored under permissionsContextKey,
+// when they were loaded along with the user.
+const permissionsContextKey = contextKey("permissions")
+
+// The plaintext of the authentication token that the request was made with is stored
+// under tokenContextKey, so that handlers can tell which session is the current one.
+const tokenContextKey = contextKey("token")
+
 // The contextSetUser() method returns a new copy of the request with the provided
 // User struct added to the context. Note that we use our userContextKey constant as the
 // key.
@@ -34,3 +42,32 @@ func (app *application) contextGetUser(r *http.Request) *data.User {
 
 	return user
 }
+
+// The contextSetToken() method returns a new copy of the request with the plaintext
+// authentication token added to the context.
+func (app *application) contextSetToken(r *http.Request, token string) *http.Request {
+	ctx := context.WithValue(r.Context(), tokenContextKey, token)
+	return r.WithContext(ctx)
+}
+
+// The contextGetToken() method retrieves the plaintext authentication token from the
+// request context. It returns an empty string for anonymous requests.
+func (app *application) contextGetToken(r *http.Request) string {
+	token, _ := r.Context().Value(tokenContextKey).(string)
+	return token
+}
+
+// The contextSetPermissions() method returns a new copy of the request with the
+// authenticated user's permissions added to the context.
+func (app *application) contextSetPermissions(r *http.Request, permissions data.Permissions) *http.Request {
+	ctx := context.WithValue(r.Context(), permissionsContextKey, permissions)
+	return r.WithContext(ctx)
+}
+
+// The contextGetPermissions() method retrieves the authenticated user's permissions
+// from the request context. The boolean is false if they weren't loaded, in which case
+// the caller should look them up itself.
+func (app *application) contextGetPermissions(r *http.Request) (data.Permissions, bool) {
+	permissions, ok := r.Context().Value(permissionsContextKey).(data.Permissions)
+	return permissions, ok
+}
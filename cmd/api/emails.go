@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bal3000/greenlight/internal/data"
+	"github.com/bal3000/greenlight/internal/mailer"
+	"github.com/bal3000/greenlight/internal/validator"
+	"github.com/julienschmidt/httprouter"
+)
+
+// errSuppressedByPreference is returned by notifyOptional when the user has opted out
+// of the email's category, or is a service account.
+var errSuppressedByPreference = errors.New("email suppressed by user preference")
+
+// The notifyOptional() helper sends a non-essential email, in the given category, only
+// if the user hasn't opted out of that category. Transactional emails (activation,
+// security notices) must be sent with app.notifier directly, so that they ignore the
+// user's preferences. Service accounts are never sent optional email. The email is
+// sent straight away with the mailer rather than through the queue, so that bulk sends
+// can't fill the queue up, which means this should be called from a background task.
+func (app *application) notifyOptional(ctx context.Context, user *data.User, category, templateFile string, templateData interface{}) error {
+	if user.IsService {
+		return errSuppressedByPreference
+	}
+
+	prefs, err := app.models.Users.GetEmailPreferences(user.ID)
+	if err != nil {
+		return err
+	}
+
+	if !prefs.Allows(category) {
+		return errSuppressedByPreference
+	}
+
+	return app.mailer.Notify(ctx, user.Email, app.mailer.Localize(templateFile, user.Locale), templateData)
+}
+
+// The broadcastEmailHandler sends a newsletter or product update to every activated
+// user who hasn't opted out of its category. The emails are sent by a background task,
+// so the response only means that sending has started.
+func (app *application) broadcastEmailHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Category string `json:"category"`
+		Subject  string `json:"subject"`
+		Message  string `json:"message"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	v.Check(validator.In(input.Category, data.EmailCategories...), "category", fmt.Sprintf("must be one of %s", strings.Join(data.EmailCategories, ", ")))
+	v.Check(input.Subject != "", "subject", "must be provided")
+	v.Check(len(input.Subject) <= 200, "subject", "must not be more than 200 bytes long")
+	v.Check(!strings.ContainsAny(input.Subject, "\r\n"), "subject", "must not contain line breaks")
+	v.Check(input.Message != "", "message", "must be provided")
+	v.Check(len(input.Message) <= 10_000, "message", "must not be more than 10000 bytes long")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	app.background(func() {
+		app.broadcastEmail(input.Category, map[string]interface{}{
+			"subject": input.Subject,
+			"message": input.Message,
+		})
+	})
+
+	err = app.writeJSON(w, http.StatusAccepted, envelope{"message": "the email will be sent to every user who has opted in"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// broadcastEmail sends the broadcast template to every activated user, through
+// notifyOptional, and logs how many were sent. It stops early if the application
+// starts shutting down.
+func (app *application) broadcastEmail(category string, templateData map[string]interface{}) {
+	// StreamAll holds its query open while it calls us, and notifyOptional needs the
+	// database, so collect the users first and send once the query has finished.
+	var users []*data.User
+
+	err := app.models.Users.StreamAll(func(user *data.User) error {
+		if user.Activated {
+			users = append(users, user)
+		}
+		return nil
+	})
+	if err != nil {
+		app.logger.PrintError(err, nil)
+		return
+	}
+
+	var sent, skipped, failed int
+
+	for _, user := range users {
+		select {
+		case <-app.shutdown:
+			app.logger.PrintInfo("broadcast interrupted by shutdown", map[string]string{
+				"category":  category,
+				"sent":      strconv.Itoa(sent),
+				"remaining": strconv.Itoa(len(users) - sent - skipped - failed),
+			})
+			return
+		default:
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		err := app.notifyOptional(ctx, user, category, "broadcast.tmpl", templateData)
+		cancel()
+
+		switch {
+		case err == nil:
+			sent++
+		case errors.Is(err, errSuppressedByPreference), errors.Is(err, mailer.ErrSuppressed):
+			skipped++
+		default:
+			failed++
+			app.logger.PrintError(err, map[string]string{
+				"user_id": strconv.FormatInt(user.ID, 10),
+			})
+		}
+	}
+
+	app.logger.PrintInfo("sent broadcast email", map[string]string{
+		"category": category,
+		"sent":     strconv.Itoa(sent),
+		"skipped":  strconv.Itoa(skipped),
+		"failed":   strconv.Itoa(failed),
+	})
+}
+
+// The previewEmailHandler renders an email template with some sample data and returns
+// the HTML body, so that templates can be checked in a browser without sending any
+// mail. The plain text body is returned instead if the request has ?format=plain, and
+// the rendered subject is sent in the X-Email-Subject header.
+func (app *application) previewEmailHandler(w http.ResponseWriter, r *http.Request) {
+	params := httprouter.ParamsFromContext(r.Context())
+
+	// The sample data covers every key that is used by the templates.
+	sample := map[string]interface{}{
+		"activationToken": "Y3QMGX3PJ3WLRL2YRTQGQ6KRHU",
+		"activationURL":   app.links.BuildActivationURL("Y3QMGX3PJ3WLRL2YRTQGQ6KRHU"),
+		"userID":          1,
+		"subject":         "Greenlight product update",
+		"message":         "Here's what we've been working on.",
+	}
+
+	rendered, err := app.mailer.RenderOnly(params.ByName("template"), sample)
+	if err != nil {
+		switch {
+		case errors.Is(err, mailer.ErrTemplateNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	w.Header().Set("X-Email-Subject", rendered.Subject)
+
+	if r.URL.Query().Get("format") == "plain" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte(rendered.PlainBody))
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(rendered.HTMLBody))
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/bal3000/greenlight/internal/data"
+)
+
+func TestNotifyOptionalSkipsServiceAccounts(t *testing.T) {
+	// The application has no models or mailer, so this fails loudly if notifyOptional
+	// looks up preferences or tries to send anything for a service account.
+	app := &application{}
+
+	user := &data.User{ID: 1, Email: "ci-bot@example.com", Activated: true, IsService: true}
+
+	for _, category := range data.EmailCategories {
+		err := app.notifyOptional(context.Background(), user, category, "broadcast.tmpl", nil)
+		if !errors.Is(err, errSuppressedByPreference) {
+			t.Errorf("%s: got %v; want errSuppressedByPreference", category, err)
+		}
+	}
+}
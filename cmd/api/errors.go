@@ -2,7 +2,10 @@ package main
 
 import (
 	"fmt"
+	"math"
 	"net/http"
+	"strconv"
+	"time"
 )
 
 // The logError() method is a generic helper for logging an error message. Later in the
@@ -77,6 +80,19 @@ func (app *application) rateLimitExceededResponse(w http.ResponseWriter, r *http
 	app.errorResponse(w, r, http.StatusTooManyRequests, message)
 }
 
+// The retryAfterResponse() method is used when a throttled operation has been tried
+// again too soon. It sets the Retry-After header to the wait, rounded up to a whole
+// number of seconds.
+func (app *application) retryAfterResponse(w http.ResponseWriter, r *http.Request, retryAfter time.Duration) {
+	seconds := int64(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+
+	w.Header().Set("Retry-After", strconv.FormatInt(seconds, 10))
+	app.rateLimitExceededResponse(w, r)
+}
+
 func (app *application) invalidCredentialsResponse(w http.ResponseWriter, r *http.Request) {
 	message := "invalid authentication credentials"
 	app.errorResponse(w, r, http.StatusUnauthorized, message)
@@ -98,7 +114,27 @@ func (app *application) inactiveAccountResponse(w http.ResponseWriter, r *http.R
 	app.errorResponse(w, r, http.StatusForbidden, message)
 }
 
+func (app *application) accountSuspendedResponse(w http.ResponseWriter, r *http.Request) {
+	message := "your user account has been suspended"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
 func (app *application) notPermittedResponse(w http.ResponseWriter, r *http.Request) {
 	message := "your user account doesn't have the necessary permissions to access this resource"
 	app.errorResponse(w, r, http.StatusForbidden, message)
 }
+
+func (app *application) passwordExpiredResponse(w http.ResponseWriter, r *http.Request) {
+	message := "password_expired: your password has expired and must be changed"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
+func (app *application) idempotencyConflictResponse(w http.ResponseWriter, r *http.Request) {
+	message := "a request with this idempotency key is already being processed, please try again"
+	app.errorResponse(w, r, http.StatusConflict, message)
+}
+
+func (app *application) idempotencyMismatchResponse(w http.ResponseWriter, r *http.Request) {
+	message := "this idempotency key has already been used for a different request"
+	app.errorResponse(w, r, http.StatusUnprocessableEntity, message)
+}
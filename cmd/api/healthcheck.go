@@ -2,15 +2,69 @@ package main
 
 import (
 	"net/http"
+	"sync"
+	"time"
 )
 
+// mailerHealth remembers the last mailer error that the healthcheck saw, so that a
+// readiness probe polling every few seconds only logs when the mailer's health changes
+// rather than on every request.
+type mailerHealth struct {
+	mu      sync.Mutex
+	lastErr string
+}
+
+// update records the mailer's current error (nil if it's healthy), and reports whether
+// that's a change from the last time it was called.
+func (h *mailerHealth) update(err error) bool {
+	var msg string
+	if err != nil {
+		msg = err.Error()
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if msg == h.lastErr {
+		return false
+	}
+
+	h.lastErr = msg
+	return true
+}
+
 func (app *application) healthcheckHandler(w http.ResponseWriter, r *http.Request) {
+	// Report how the mailer is doing, so that a readiness probe can tell a mailer that
+	// is quietly failing from a healthy one.
+	mailerInfo := map[string]string{"status": "ok"}
+
+	if lastSuccess := app.mailer.LastSuccess(); !lastSuccess.IsZero() {
+		mailerInfo["last_success"] = lastSuccess.Format(time.RFC3339)
+	}
+
+	// The endpoint isn't authenticated, so only report that the mailer is degraded. The
+	// error itself can include the SMTP host and details of authentication failures, so
+	// it goes to the log instead, but only when it changes.
+	mailerErr := app.mailer.LastError()
+	if mailerErr != nil {
+		mailerInfo["status"] = "degraded"
+	}
+
+	if app.mailerHealth.update(mailerErr) {
+		if mailerErr != nil {
+			app.logger.PrintError(mailerErr, map[string]string{"component": "mailer"})
+		} else {
+			app.logger.PrintInfo("mailer recovered", map[string]string{"component": "mailer"})
+		}
+	}
+
 	env := envelope{
 		"status": "available",
 		"system_info": map[string]string{
 			"environment": app.config.env,
 			"version":     version,
 		},
+		"mailer": mailerInfo,
 	}
 
 	err := app.writeJSON(w, http.StatusOK, env, nil)
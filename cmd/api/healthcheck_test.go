@@ -0,0 +1,30 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestMailerHealthUpdate(t *testing.T) {
+	h := &mailerHealth{}
+	errTimeout := errors.New("dial tcp: i/o timeout")
+	errAuth := errors.New("535 authentication failed")
+
+	steps := []struct {
+		err  error
+		want bool
+	}{
+		{err: nil, want: false}, // healthy from the start
+		{err: errTimeout, want: true},
+		{err: errTimeout, want: false}, // the same error isn't logged again
+		{err: errAuth, want: true},
+		{err: nil, want: true}, // recovered
+		{err: nil, want: false},
+	}
+
+	for i, step := range steps {
+		if got := h.update(step.err); got != step.want {
+			t.Errorf("step %d (%v): got %t; want %t", i+1, step.err, got, step.want)
+		}
+	}
+}
@@ -9,7 +9,9 @@ import (
 	"net/url"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/bal3000/greenlight/internal/data"
 	"github.com/bal3000/greenlight/internal/validator"
 	"github.com/julienschmidt/httprouter"
 )
@@ -29,6 +31,33 @@ func (app *application) readIDParam(r *http.Request) (int64, error) {
 	return id, nil
 }
 
+// The tenantHeader names the request header that carries the tenant ID in a
+// multi-tenant deployment.
+const tenantHeader = "X-Tenant-ID"
+
+// The readTenantID() helper returns the tenant that an unauthenticated request (such
+// as registration or login) is for. In a multi-tenant deployment it's read from the
+// X-Tenant-ID header, which must be set by the proxy in front of the API (e.g. from
+// the hostname) rather than trusted from clients. Otherwise, or if the header isn't
+// set, it's data.DefaultTenantID.
+func (app *application) readTenantID(r *http.Request) (int64, error) {
+	if !app.config.tenants.enabled {
+		return data.DefaultTenantID, nil
+	}
+
+	s := r.Header.Get(tenantHeader)
+	if s == "" {
+		return data.DefaultTenantID, nil
+	}
+
+	id, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || id < 0 {
+		return 0, fmt.Errorf("invalid %s header", tenantHeader)
+	}
+
+	return id, nil
+}
+
 // Update to generics when possible
 func (app *application) writeJSON(w http.ResponseWriter, status int, data envelope, headers http.Header) error {
 	// Encode the data to JSON, returning the error if there was one.
@@ -198,18 +227,57 @@ func (app *application) readInt(qs url.Values, key string, defaultValue int, v *
 	return i
 }
 
-// Background task runner.  The background() helper accepts an arbitrary function as a parameter
-func (app *application) background(fn func()) {
-	app.wg.Add(1)
-	go func() {
-		defer app.wg.Done()
+// The readBool() helper reads a boolean value ("true", "false", "1", "0" etc.) from the
+// query string. If no matching key could be found it returns the provided default
+// value, and if the value couldn't be parsed it records an error in the Validator.
+func (app *application) readBool(qs url.Values, key string, defaultValue bool, v *validator.Validator) bool {
+	s := qs.Get(key)
 
-		defer func() {
-			if err := recover(); err != nil {
-				app.logger.PrintError(fmt.Errorf("%s", err), nil)
-			}
-		}()
+	if s == "" {
+		return defaultValue
+	}
 
-		fn()
-	}()
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		v.AddError(key, "must be a boolean value")
+		return defaultValue
+	}
+
+	return b
+}
+
+// The readTimezone() helper reads an IANA time zone name (e.g. "Europe/London") from
+// the query string, for rendering timestamps in the client's time zone. If no matching
+// key could be found it returns UTC, and if the time zone isn't valid it records an
+// error in the Validator.
+func (app *application) readTimezone(qs url.Values, key string, v *validator.Validator) *time.Location {
+	s := qs.Get(key)
+
+	if s == "" {
+		return time.UTC
+	}
+
+	// LoadLocation treats "Local" as the server's own time zone, which means nothing to
+	// the client.
+	loc, err := time.LoadLocation(s)
+	if err != nil || s == "Local" {
+		v.AddError(key, "must be a valid IANA time zone")
+		return time.UTC
+	}
+
+	return loc
+}
+
+// The inTimezone() helper converts the users' timestamps to the given time zone before
+// they're written out, so that they're rendered as RFC 3339 with that zone's offset.
+// Only the presentation changes; the instants are the same.
+func (app *application) inTimezone(loc *time.Location, users ...*data.User) {
+	for _, user := range users {
+		user.CreatedAt = user.CreatedAt.In(loc)
+	}
+}
+
+// Background task runner.  The background() helper accepts an arbitrary function as a parameter
+func (app *application) background(fn func()) {
+	app.tasks.Go(fn)
 }
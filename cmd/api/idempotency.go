@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/bal3000/greenlight/internal/data"
+)
+
+// The hashIdempotentRequest() helper returns the hash which is stored with an
+// idempotency key, so that the key can't be reused for a different request. It covers
+// the method, path and body. The path is quoted so that it can't run into the body.
+func hashIdempotentRequest(method, path string, body []byte) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s %q\n", method, path)
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// The readIdempotentRequestHash() helper reads the request body to hash it, and then
+// puts it back so that the handler can still decode it with readJSON().
+func (app *application) readIdempotentRequestHash(w http.ResponseWriter, r *http.Request) (string, error) {
+	maxBytes := 1_048_576
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, int64(maxBytes)))
+	if err != nil {
+		if err.Error() == "http: request body too large" {
+			return "", fmt.Errorf("body must not be larger than %d bytes", maxBytes)
+		}
+		return "", err
+	}
+
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	return hashIdempotentRequest(r.Method, r.URL.Path, body), nil
+}
+
+// The replayIdempotentResponse() helper writes the stored response for an idempotency
+// key that has already been used. If the original request is still being processed we
+// send a 409 Conflict response instead, so the client knows to try again shortly. If
+// the key was used for a different request we send a 422 Unprocessable Entity response.
+func (app *application) replayIdempotentResponse(w http.ResponseWriter, r *http.Request, key, requestHash string) {
+	record, err := app.models.Idempotency.Get(key)
+	if err != nil {
+		switch {
+		// The key expired between reserving and reading it, so there's nothing to
+		// replay. Ask the client to retry, which will reserve it again.
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.idempotencyConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if record.RequestHash != "" && record.RequestHash != requestHash {
+		app.idempotencyMismatchResponse(w, r)
+		return
+	}
+
+	if record.StatusCode == 0 {
+		app.idempotencyConflictResponse(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(record.StatusCode)
+	w.Write(record.Response)
+}
@@ -0,0 +1,30 @@
+package main
+
+import "testing"
+
+func TestHashIdempotentRequest(t *testing.T) {
+	body := []byte(`{"email":"alice@example.com"}`)
+	want := hashIdempotentRequest("POST", "/v1/users", body)
+
+	if got := hashIdempotentRequest("POST", "/v1/users", []byte(`{"email":"alice@example.com"}`)); got != want {
+		t.Errorf("same request: got %s; want %s", got, want)
+	}
+
+	different := []struct {
+		name   string
+		method string
+		path   string
+		body   []byte
+	}{
+		{name: "method", method: "PUT", path: "/v1/users", body: body},
+		{name: "path", method: "POST", path: "/v1/users/activated", body: body},
+		{name: "body", method: "POST", path: "/v1/users", body: []byte(`{"email":"bob@example.com"}`)},
+		{name: "path runs into body", method: "POST", path: "/v1/users\n{", body: body[1:]},
+	}
+
+	for _, tt := range different {
+		if got := hashIdempotentRequest(tt.method, tt.path, tt.body); got == want {
+			t.Errorf("different %s: got the same hash as the original request", tt.name)
+		}
+	}
+}
@@ -3,18 +3,24 @@ package main
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"expvar"
 	"flag"
 	"fmt"
+	"net/mail"
 	"os"
 	"runtime"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/bal3000/greenlight/internal/data"
 	"github.com/bal3000/greenlight/internal/jsonlog"
+	"github.com/bal3000/greenlight/internal/links"
 	"github.com/bal3000/greenlight/internal/mailer"
+	"github.com/bal3000/greenlight/internal/notifier"
+	"github.com/bal3000/greenlight/internal/sms"
+	"github.com/bal3000/greenlight/internal/tasks"
+	"github.com/bal3000/greenlight/internal/validator"
 	_ "github.com/lib/pq"
 )
 
@@ -49,21 +55,96 @@ type config struct {
 		username string
 		password string
 		sender   string
+		replyTo  string
+		envelope string
+		charset  string
+		encoding string
+		images   []string
+		prefix   string
+		subjects map[string]string
+		maxBody  int
+		maxRcpt  int
+		verify   bool
+		mjml     string
+		spam     struct {
+			command   string
+			threshold float64
+		}
+		tls struct {
+			minVersion string
+		}
+		queue struct {
+			workers int
+			size    int
+			maxAge  time.Duration
+		}
 	}
-	cors struct {
+	baseURL string
+	cors    struct {
 		trustedOrigins []string
 	}
+	password struct {
+		history int
+		maxAge  time.Duration
+	}
+	webhook struct {
+		url              string
+		loginThreshold   int
+		loginAlertWindow time.Duration
+	}
+	suppression struct {
+		secret string
+	}
+	sms struct {
+		from        string
+		twilioSID   string
+		twilioToken string
+	}
+	emailHash struct {
+		key string
+	}
+	userCache struct {
+		ttl  time.Duration
+		size int
+	}
+	tenants struct {
+		enabled bool
+	}
+	tokens struct {
+		encoding    string
+		expiryGrace time.Duration
+		hashKey     string
+		signingKey  string
+	}
+	activation struct {
+		required      bool
+		codes         bool
+		codeTTL       time.Duration
+		reminderAfter time.Duration
+	}
 }
 
 // Define an application struct to hold the dependencies for our HTTP handlers, helpers,
 // and middleware. At the moment this only contains a copy of the config struct and a
 // logger, but it will grow to include a lot more as our build progresses.
 type application struct {
-	config config
-	logger *jsonlog.Logger
-	models data.Models
-	mailer mailer.Mailer
-	wg     sync.WaitGroup
+	config    config
+	logger    *jsonlog.Logger
+	models    data.Models
+	mailer    mailer.Mailer
+	mailQueue *mailer.Queue
+	notifier  notifier.Notifier
+	alerts    notifier.Notifier
+	sms       sms.SMSSender
+	tasks     *tasks.BackgroundTasks
+	links     *links.Builder
+	shutdown  chan struct{}
+
+	// loginFailures counts failed logins for the login_failures alert.
+	loginFailures *loginFailures
+
+	// mailerHealth remembers the mailer error that the healthcheck last logged.
+	mailerHealth *mailerHealth
 }
 
 func main() {
@@ -92,12 +173,69 @@ func main() {
 	flag.StringVar(&cfg.smtp.username, "smtp-username", "fb03cfa24c2049", "SMTP username")
 	flag.StringVar(&cfg.smtp.password, "smtp-password", "a5e06e92dc40f2", "SMTP password")
 	flag.StringVar(&cfg.smtp.sender, "smtp-sender", "Greenlight <no-reply@greenlight.balvinderbains.com>", "SMTP sender")
+	flag.StringVar(&cfg.smtp.replyTo, "smtp-reply-to", "", "Reply-To address for outgoing email")
+	flag.StringVar(&cfg.smtp.envelope, "smtp-envelope-sender", "", "SMTP envelope sender for bounces ({recipient} is replaced with the VERP-encoded recipient)")
+	flag.StringVar(&cfg.smtp.prefix, "smtp-subject-prefix", "", "Prefix for every email subject, e.g. \"[STAGING] \"")
+	cfg.smtp.subjects = make(map[string]string)
+	flag.Func("smtp-subject", "Subject template for an email, as template=subject, e.g. \"token_activation.tmpl=Activate your Greenlight account\" (repeatable)", func(val string) error {
+		templateFile, subject, ok := strings.Cut(val, "=")
+		if !ok {
+			return errors.New("must be in the form template=subject")
+		}
+		cfg.smtp.subjects[strings.TrimSpace(templateFile)] = subject
+		return nil
+	})
+	flag.StringVar(&cfg.smtp.charset, "smtp-charset", "UTF-8", "Charset for outgoing email")
+	flag.StringVar(&cfg.smtp.encoding, "smtp-encoding", "quoted-printable", "Transfer encoding for outgoing email bodies (quoted-printable|base64|8bit)")
+	flag.IntVar(&cfg.smtp.maxBody, "smtp-max-body-size", mailer.DefaultMaxBodySize, "Maximum combined size in bytes of a rendered email's bodies (0 to disable)")
+	flag.IntVar(&cfg.smtp.maxRcpt, "smtp-max-recipients", mailer.DefaultMaxRecipients, "Maximum number of recipients in a batch send (0 to disable)")
+	flag.BoolVar(&cfg.smtp.verify, "smtp-verify", false, "Check the SMTP connection and credentials at startup (defaults to true in production)")
+	flag.StringVar(&cfg.smtp.mjml, "smtp-mjml-command", "", "Path to the mjml command, to compile MJML templates at send time (pre-compiled HTML is used if empty)")
+	flag.StringVar(&cfg.smtp.spam.command, "smtp-spam-command", "", "Path to SpamAssassin's spamc command, to refuse to send emails which score as spam (disabled if empty)")
+	flag.Float64Var(&cfg.smtp.spam.threshold, "smtp-spam-threshold", mailer.DefaultSpamThreshold, "SpamAssassin score above which an email is not sent")
+	flag.StringVar(&cfg.smtp.tls.minVersion, "smtp-tls-min-version", "1.2", "Minimum TLS version for SMTP connections (1.0|1.1|1.2|1.3)")
+	flag.Func("smtp-embed-images", "Images in the templates/images directory to embed when referenced by cid: (space separated)", func(val string) error {
+		cfg.smtp.images = strings.Fields(val)
+		return nil
+	})
+	flag.IntVar(&cfg.smtp.queue.workers, "smtp-queue-workers", 2, "Number of workers sending queued email")
+	flag.IntVar(&cfg.smtp.queue.size, "smtp-queue-size", 100, "Maximum number of queued emails")
+	flag.DurationVar(&cfg.smtp.queue.maxAge, "smtp-queue-max-age", time.Hour, "Drop queued emails which haven't been sent within this time (0 to disable)")
+
+	flag.StringVar(&cfg.baseURL, "base-url", "http://localhost:3000", "Base URL of the frontend, used for links in emails")
 
 	flag.Func("cors-trusted-origins", "Trusted CORS origins (space separated)", func(val string) error {
 		cfg.cors.trustedOrigins = strings.Fields(val)
 		return nil
 	})
 
+	flag.IntVar(&cfg.password.history, "password-history", 5, "Number of previous passwords that cannot be reused (0 to disable)")
+	flag.DurationVar(&cfg.password.maxAge, "password-max-age", 0, "Maximum password age before a change is required (0 to disable)")
+
+	flag.DurationVar(&cfg.userCache.ttl, "user-cache-ttl", 0, "How long to cache users looked up by email (0 to disable)")
+	flag.IntVar(&cfg.userCache.size, "user-cache-size", 1000, "Maximum number of cached users")
+
+	flag.StringVar(&cfg.tokens.encoding, "token-encoding", "base32", "Token plaintext encoding (base32|base58|base64url)")
+	flag.DurationVar(&cfg.tokens.expiryGrace, "token-expiry-grace", 0, "Grace period after expiry during which tokens are still accepted")
+	flag.StringVar(&cfg.tokens.signingKey, "token-signing-key", "", "Secret key for signing activation tokens (tokens are unsigned if empty)")
+	flag.StringVar(&cfg.tokens.hashKey, "token-hash-key", "", "Secret key for hashing tokens with HMAC-SHA256 (plain SHA-256 if empty)")
+
+	flag.BoolVar(&cfg.tenants.enabled, "multi-tenant", false, "Take the tenant for registration and login from the X-Tenant-ID header (set by a trusted proxy)")
+
+	flag.BoolVar(&cfg.activation.required, "activation-required", true, "Require new users to activate their account from the activation email")
+	flag.BoolVar(&cfg.activation.codes, "activation-codes", false, "Also send a 6-digit activation code with activation emails")
+	flag.DurationVar(&cfg.activation.codeTTL, "activation-code-ttl", 15*time.Minute, "How long activation codes are valid for")
+	flag.DurationVar(&cfg.activation.reminderAfter, "activation-reminder-after", 2*24*time.Hour, "Remind users to activate their account this long after signing up (0 to disable)")
+
+	flag.StringVar(&cfg.webhook.url, "webhook-url", "", "Webhook URL for ops alerts (e.g. a Slack incoming webhook)")
+	flag.IntVar(&cfg.webhook.loginThreshold, "login-alert-threshold", 10, "Failed logins for one account which trigger an ops alert")
+	flag.DurationVar(&cfg.webhook.loginAlertWindow, "login-alert-window", 15*time.Minute, "Window over which failed logins are counted for the ops alert")
+	flag.StringVar(&cfg.emailHash.key, "email-hash-key", "", "Secret key for hashing email addresses in logs (addresses are logged as-is if empty)")
+	flag.StringVar(&cfg.sms.from, "sms-from", "", "Phone number (E.164) to send SMS codes from (SMS is disabled if empty)")
+	flag.StringVar(&cfg.sms.twilioSID, "sms-twilio-account-sid", "", "Twilio account SID for sending SMS")
+	flag.StringVar(&cfg.sms.twilioToken, "sms-twilio-auth-token", "", "Twilio auth token for sending SMS")
+	flag.StringVar(&cfg.suppression.secret, "suppression-webhook-secret", "", "Shared secret for the bounce/complaint webhook (the endpoint is disabled if empty)")
+
 	displayVersion := flag.Bool("version", false, "Display version and exit")
 
 	flag.Parse()
@@ -108,10 +246,29 @@ func main() {
 		os.Exit(0)
 	}
 
+	// Check the SMTP connection at startup in production, where a broken mailer should be
+	// caught before deploying, but not elsewhere, where there often isn't an SMTP server
+	// running. An explicit -smtp-verify always wins.
+	smtpVerifySet := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "smtp-verify" {
+			smtpVerifySet = true
+		}
+	})
+
+	if !smtpVerifySet {
+		cfg.smtp.verify = cfg.env == "production"
+	}
+
 	// Initialize a new jsonlog.Logger which writes any messages *at or above* the INFO
 	// severity level to the standard out stream.
 	logger := jsonlog.New(os.Stdout, jsonlog.LevelInfo)
 
+	tokenEncoding, err := data.ParseTokenEncoding(cfg.tokens.encoding)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+
 	// Call the openDB() helper function (see below) to create the connection pool,
 	// passing in the config struct. If this returns an error, we log it and exit the
 	// application immediately.
@@ -142,13 +299,153 @@ func main() {
 		return time.Now().Unix()
 	}))
 
+	// Publish counters for the writes made by the user and token models, grouped
+	// under a single "models" map.
+	modelVars := expvar.NewMap("models")
+	counter := func(name string) *expvar.Int {
+		c := new(expvar.Int)
+		modelVars.Set(name, c)
+		return c
+	}
+
+	userMetrics := data.ModelMetrics{
+		Inserts:         counter("users_inserted"),
+		Updates:         counter("users_updated"),
+		DuplicateEmails: counter("users_duplicate_email"),
+		EditConflicts:   counter("users_edit_conflict"),
+	}
+
+	tokenMetrics := data.ModelMetrics{
+		Inserts: counter("tokens_inserted"),
+	}
+
+	models := data.NewModels(db, data.Config{
+		PasswordHistory:        cfg.password.history,
+		TokenEncoding:          tokenEncoding,
+		TokenExpiryGracePeriod: cfg.tokens.expiryGrace,
+		AutoActivate:           !cfg.activation.required,
+		EmailHashKey:           []byte(cfg.emailHash.key),
+		TokenHashKey:           []byte(cfg.tokens.hashKey),
+		TokenSigningKey:        []byte(cfg.tokens.signingKey),
+		UserMetrics:            userMetrics,
+		TokenMetrics:           tokenMetrics,
+		UserCacheTTL:           cfg.userCache.ttl,
+		UserCacheSize:          cfg.userCache.size,
+	})
+
+	// Never send email to addresses which have hard-bounced or complained.
+	mailerOpts := []mailer.Option{mailer.WithSuppressionList(models.Suppressions)}
+
+	if cfg.smtp.replyTo != "" {
+		_, err := mail.ParseAddress(cfg.smtp.replyTo)
+		if err != nil {
+			logger.PrintFatal(fmt.Errorf("invalid smtp-reply-to address: %w", err), nil)
+		}
+
+		mailerOpts = append(mailerOpts, mailer.WithReplyTo(cfg.smtp.replyTo))
+	}
+
+	if cfg.smtp.envelope != "" {
+		mailerOpts = append(mailerOpts, mailer.WithEnvelopeSender(cfg.smtp.envelope))
+	}
+
+	minTLSVersion, err := mailer.ParseTLSVersion(cfg.smtp.tls.minVersion)
+	if err != nil {
+		logger.PrintFatal(fmt.Errorf("invalid smtp-tls-min-version: %w", err), nil)
+	}
+
+	mailerOpts = append(mailerOpts, mailer.WithMinTLSVersion(minTLSVersion))
+
+	transferEncoding, err := mailer.ParseTransferEncoding(cfg.smtp.encoding)
+	if err != nil {
+		logger.PrintFatal(fmt.Errorf("invalid smtp-encoding: %w", err), nil)
+	}
+
+	mailerOpts = append(mailerOpts, mailer.WithCharset(cfg.smtp.charset), mailer.WithTransferEncoding(transferEncoding))
+	mailerOpts = append(mailerOpts, mailer.WithMaxBodySize(cfg.smtp.maxBody), mailer.WithMaxRecipients(cfg.smtp.maxRcpt))
+
+	if cfg.smtp.prefix != "" {
+		mailerOpts = append(mailerOpts, mailer.WithSubjectPrefix(cfg.smtp.prefix))
+	}
+
+	if len(cfg.smtp.subjects) > 0 {
+		mailerOpts = append(mailerOpts, mailer.WithSubjects(cfg.smtp.subjects))
+	}
+
+	if cfg.smtp.mjml != "" {
+		mailerOpts = append(mailerOpts, mailer.WithMJMLCompiler(mailer.CommandMJMLCompiler{Path: cfg.smtp.mjml}))
+	}
+
+	if cfg.smtp.spam.command != "" {
+		mailerOpts = append(mailerOpts, mailer.WithSpamChecker(mailer.CommandSpamChecker{Path: cfg.smtp.spam.command}, cfg.smtp.spam.threshold))
+	}
+
+	if len(cfg.smtp.images) > 0 {
+		mailerOpts = append(mailerOpts, mailer.WithEmbedImages(cfg.smtp.images...))
+	}
+
+	linkBuilder, err := links.New(cfg.baseURL)
+	if err != nil {
+		logger.PrintFatal(fmt.Errorf("invalid base-url: %w", err), nil)
+	}
+
+	smtpMailer := mailer.New(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.password, cfg.smtp.sender, mailerOpts...)
+
+	err = smtpMailer.CheckSubjects()
+	if err != nil {
+		logger.PrintFatal(fmt.Errorf("invalid smtp-subject: %w", err), nil)
+	}
+
+	if cfg.smtp.verify {
+		err = smtpMailer.Verify()
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+
+		logger.PrintInfo("smtp connection verified", nil)
+	}
+
+	var queueOpts []mailer.QueueOption
+
+	if cfg.emailHash.key != "" {
+		queueOpts = append(queueOpts, mailer.WithRecipientRedaction(models.EmailHasher.Hash))
+	}
+
+	mailQueue := mailer.NewQueue(smtpMailer, logger, cfg.smtp.queue.workers, cfg.smtp.queue.size, cfg.smtp.queue.maxAge, queueOpts...)
+
 	// Declare an instance of the application struct, containing the config struct and
 	// the logger.
 	app := &application{
-		config: cfg,
-		logger: logger,
-		models: data.NewModels(db),
-		mailer: mailer.New(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.password, cfg.smtp.sender),
+		config:    cfg,
+		logger:    logger,
+		models:    models,
+		mailer:    smtpMailer,
+		mailQueue: mailQueue,
+		notifier:  mailQueue,
+		tasks:     tasks.New(logger),
+		links:     linkBuilder,
+		shutdown:  make(chan struct{}),
+
+		loginFailures: newLoginFailures(cfg.webhook.loginThreshold, cfg.webhook.loginAlertWindow),
+		mailerHealth:  &mailerHealth{},
+	}
+
+	// Only send ops alerts if a webhook has been configured.
+	if cfg.webhook.url != "" {
+		app.alerts = notifier.NewWebhook(cfg.webhook.url, nil)
+	}
+
+	// Only offer phone verification if there's an SMS provider to send the codes.
+	if cfg.sms.from != "" {
+		if !validator.IsE164(cfg.sms.from) {
+			logger.PrintFatal(fmt.Errorf("invalid sms-from number %q: must be in E.164 format", cfg.sms.from), nil)
+		}
+
+		if cfg.sms.twilioSID == "" || cfg.sms.twilioToken == "" {
+			logger.PrintFatal(errors.New("sms-from requires sms-twilio-account-sid and sms-twilio-auth-token"), nil)
+		}
+
+		app.sms = sms.NewTwilio(cfg.sms.twilioSID, cfg.sms.twilioToken, cfg.sms.from, nil)
 	}
 
 	err = app.serve()
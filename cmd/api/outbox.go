@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/bal3000/greenlight/internal/data"
+	"github.com/bal3000/greenlight/internal/mailer"
+)
+
+const (
+	// How often the relay checks the outbox for emails to send.
+	outboxInterval = 5 * time.Second
+	// The maximum number of emails that the relay claims at a time.
+	outboxBatchSize = 50
+	// How long a claimed email is locked for before it can be retried.
+	outboxLockDuration = 5 * time.Minute
+	// How long to wait for each send. This must be well within outboxLockDuration, so
+	// that an email can't be claimed again while it's still being sent.
+	outboxSendTimeout = 30 * time.Second
+)
+
+// The relayOutbox() method runs until the application starts shutting down,
+// periodically sending the emails in the outbox and deleting them once they've been
+// sent.
+func (app *application) relayOutbox() {
+	ticker := time.NewTicker(outboxInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-app.shutdown:
+			return
+		case <-ticker.C:
+			app.dispatchOutbox()
+		}
+	}
+}
+
+func (app *application) dispatchOutbox() {
+	emails, err := app.models.Outbox.Claim(outboxBatchSize, outboxLockDuration)
+	if err != nil {
+		app.logger.PrintError(err, nil)
+		return
+	}
+
+	for _, email := range emails {
+		// Send synchronously (rather than through the queue) so that we know whether
+		// it's safe to delete the email. If sending fails the email stays in the outbox
+		// and is retried once its lock expires.
+		ctx, cancel := context.WithTimeout(context.Background(), outboxSendTimeout)
+		err := app.mailer.Notify(ctx, email.Recipient, email.Template, email.Data)
+		cancel()
+
+		if err != nil && !errors.Is(err, mailer.ErrSuppressed) {
+			app.logger.PrintError(err, map[string]string{
+				"outbox_id": strconv.FormatInt(email.ID, 10),
+				"attempts":  strconv.Itoa(email.Attempts),
+			})
+
+			// Claim won't pick the email up again once it's used up its attempts, so
+			// this is the last we'll hear of it. It's left in the outbox to be looked
+			// into.
+			if email.Attempts >= data.OutboxMaxAttempts {
+				app.logger.PrintError(fmt.Errorf("giving up on outbox email after %d attempts", email.Attempts), map[string]string{
+					"outbox_id": strconv.FormatInt(email.ID, 10),
+					"template":  email.Template,
+				})
+			}
+			continue
+		}
+
+		// Suppressed recipients will never be sent the email, so it's deleted too.
+		err = app.models.Outbox.Delete(email.ID)
+		if err != nil {
+			app.logger.PrintError(err, nil)
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"strconv"
+	"time"
+)
+
+// How often expired permission grants are deleted.
+const expiredPermissionsInterval = 10 * time.Minute
+
+// The purgeExpiredPermissions() method runs until the application starts shutting
+// down, periodically deleting time-boxed permission grants which have expired.
+func (app *application) purgeExpiredPermissions() {
+	ticker := time.NewTicker(expiredPermissionsInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-app.shutdown:
+			return
+		case <-ticker.C:
+			deleted, err := app.models.Permissions.DeleteExpired()
+			if err != nil {
+				app.logger.PrintError(err, nil)
+				continue
+			}
+
+			if deleted > 0 {
+				app.logger.PrintInfo("deleted expired permissions", map[string]string{
+					"count": strconv.FormatInt(deleted, 10),
+				})
+			}
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/bal3000/greenlight/internal/data"
+)
+
+const (
+	// How often to look for users who need an activation reminder.
+	activationReminderInterval = time.Hour
+	// The local time of day that activation reminders are sent at.
+	activationReminderHour   = 9
+	activationReminderMinute = 0
+)
+
+// The remindUnactivatedUsers() method runs until the application starts shutting
+// down, periodically scheduling a reminder for each user who still hasn't activated
+// their account app.config.activation.reminderAfter after signing up. It does nothing
+// if reminders are disabled.
+func (app *application) remindUnactivatedUsers() {
+	if app.config.activation.reminderAfter <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(activationReminderInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-app.shutdown:
+			return
+		case <-ticker.C:
+			app.scheduleActivationReminders()
+		}
+	}
+}
+
+// The scheduleActivationReminders() helper schedules the activation reminders for
+// 9am in each user's own time zone. Each user is only ever sent one reminder, however
+// many times this runs: the reminder's dedupe key is the user's ID. The reminder
+// doesn't carry a token (it would sit in the scheduled_emails table until it was
+// sent), so it asks the user to request a new activation email instead.
+func (app *application) scheduleActivationReminders() {
+	users, err := app.models.Users.GetStaleUnactivated(app.config.activation.reminderAfter)
+	if err != nil {
+		app.logger.PrintError(err, nil)
+		return
+	}
+
+	scheduled := 0
+
+	for _, user := range users {
+		if user.Status != data.StatusPending {
+			continue
+		}
+
+		templateFile := app.mailer.Localize("activation_reminder.tmpl", user.Locale)
+		templateData := map[string]interface{}{
+			"name": user.DisplayName,
+		}
+		dedupeKey := "activation_reminder:" + strconv.FormatInt(user.ID, 10)
+
+		err := app.sendAtLocalTime(user, activationReminderHour, activationReminderMinute, templateFile, templateData, dedupeKey)
+		if err != nil {
+			if !errors.Is(err, data.ErrDuplicateScheduledEmail) {
+				app.logger.PrintError(err, map[string]string{
+					"user_id": strconv.FormatInt(user.ID, 10),
+				})
+			}
+			continue
+		}
+
+		scheduled++
+	}
+
+	if scheduled > 0 {
+		app.logger.PrintInfo("scheduled activation reminders", map[string]string{
+			"count": strconv.Itoa(scheduled),
+		})
+	}
+}
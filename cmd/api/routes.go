@@ -32,9 +32,50 @@ func (app *application) routes() http.Handler {
 	router.HandlerFunc(http.MethodPost, "/v1/users", app.registerUserHandler)
 
 	router.HandlerFunc(http.MethodPut, "/v1/users/activated", app.activateUserHandler)
+	router.HandlerFunc(http.MethodPut, "/v1/users/activated/code", app.activateUserWithCodeHandler)
+	router.HandlerFunc(http.MethodPut, "/v1/users/password", app.updateUserPasswordHandler)
+	router.HandlerFunc(http.MethodPut, "/v1/users/password/change", app.requireActivatedUser(app.changeUserPasswordHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/users/timezone", app.requireActivatedUser(app.updateTimezoneHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/users/sessions", app.requireActivatedUser(app.showSessionsHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/users/email-preferences", app.requireActivatedUser(app.showEmailPreferencesHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/users/email-preferences", app.requireActivatedUser(app.updateEmailPreferencesHandler))
 
 	router.HandlerFunc(http.MethodPost, "/v1/tokens/authentication", app.createAuthenticationTokenHandler)
 	router.HandlerFunc(http.MethodPost, "/v1/tokens/activation", app.createActivationTokenHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/activation/resend", app.resendActivationTokenHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/password-reset", app.createPasswordResetTokenHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/password-reset/verify", app.verifyPasswordResetTokenHandler)
+
+	router.HandlerFunc(http.MethodGet, "/v1/admin/users", app.requirePermission("admin", app.searchUsersHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/service-accounts", app.requirePermission("admin", app.createServiceAccountHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/users/recent", app.requirePermission("admin", app.listRecentUsersHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/users/exists", app.requirePermission("admin", app.checkEmailExistsHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/password-costs", app.requirePermission("admin", app.showPasswordCostsHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/permissions/:code/users", app.requirePermission("admin", app.listUsersWithPermissionHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/users/:id/merge", app.requirePermission("admin", app.mergeUsersHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/admin/users/:id/status", app.requirePermission("admin", app.updateUserStatusHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/scheduled-emails/:id/retry", app.requirePermission("admin", app.retryFailedEmailHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/tokens/revoke", app.requirePermission("admin", app.revokeTokensHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/emails/broadcast", app.requirePermission("admin", app.broadcastEmailHandler))
+
+	// Bounce and complaint events from the email provider. The endpoint authenticates
+	// with a shared secret rather than a user token, so it's only enabled if one has
+	// been configured.
+	if app.config.suppression.secret != "" {
+		router.HandlerFunc(http.MethodPost, "/v1/webhooks/email-events", app.emailEventsWebhookHandler)
+	}
+
+	// Phone numbers can only be verified if there's somewhere to send the codes.
+	if app.sms != nil {
+		router.HandlerFunc(http.MethodPost, "/v1/users/phone/code", app.requireActivatedUser(app.createPhoneCodeHandler))
+		router.HandlerFunc(http.MethodPut, "/v1/users/phone", app.requireActivatedUser(app.updatePhoneHandler))
+	}
+
+	// Email previews are only for developing templates, so never expose them in
+	// production.
+	if app.config.env != "production" {
+		router.HandlerFunc(http.MethodGet, "/v1/admin/emails/:template", app.requirePermission("admin", app.previewEmailHandler))
+	}
 
 	router.Handler(http.MethodGet, "/debug/vars", expvar.Handler())
 
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/bal3000/greenlight/internal/data"
+	"github.com/bal3000/greenlight/internal/mailer"
+)
+
+const (
+	// How often the reaper checks for scheduled emails which are due.
+	scheduledEmailInterval = 30 * time.Second
+	// The maximum number of emails that the reaper claims at a time.
+	scheduledEmailBatchSize = 50
+	// The number of delivery attempts before a scheduled email is marked as failed.
+	scheduledEmailMaxAttempts = 3
+	// How long an email can be left "sending" before the reaper decides that the send
+	// was interrupted. This must be comfortably longer than a whole batch takes.
+	scheduledEmailStaleAfter = time.Hour
+	// How long to wait for each send. A whole batch at this timeout has to fit well
+	// within scheduledEmailStaleAfter.
+	scheduledEmailSendTimeout = 30 * time.Second
+)
+
+// The sendAt() helper schedules an email to be sent at (or soon after) the given time.
+// The email is stored in the database, so it survives a restart, and is delivered by
+// the reapScheduledEmails() background task. If dedupeKey isn't empty and an email has
+// already been scheduled with the same key, it returns data.ErrDuplicateScheduledEmail.
+func (app *application) sendAt(t time.Time, recipient, templateFile string, templateData map[string]interface{}, dedupeKey string) error {
+	email := &data.ScheduledEmail{
+		Recipient: recipient,
+		Template:  templateFile,
+		Data:      templateData,
+		SendAt:    t,
+		DedupeKey: dedupeKey,
+	}
+
+	return app.models.ScheduledEmails.Insert(email)
+}
+
+// The sendAtLocalTime() helper schedules an email for the next time that it's
+// hour:minute in the user's time zone (e.g. 9am for a daily digest). The send time is
+// converted to UTC when the email is scheduled, so the reaper doesn't need to know
+// about time zones.
+func (app *application) sendAtLocalTime(user *data.User, hour, minute int, templateFile string, templateData map[string]interface{}, dedupeKey string) error {
+	t, err := data.NextLocalTime(time.Now(), user.Timezone, hour, minute)
+	if err != nil {
+		return err
+	}
+
+	return app.sendAt(t, user.Email, templateFile, templateData, dedupeKey)
+}
+
+// The reapScheduledEmails() method runs until the application starts shutting down,
+// periodically sending any scheduled emails which are due.
+func (app *application) reapScheduledEmails() {
+	ticker := time.NewTicker(scheduledEmailInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-app.shutdown:
+			return
+		case <-ticker.C:
+			app.dispatchScheduledEmails()
+		}
+	}
+}
+
+func (app *application) dispatchScheduledEmails() {
+	app.failStaleScheduledEmails()
+
+	emails, err := app.models.ScheduledEmails.ClaimDue(scheduledEmailBatchSize)
+	if err != nil {
+		app.logger.PrintError(err, nil)
+		return
+	}
+
+	for _, email := range emails {
+		ctx, cancel := context.WithTimeout(context.Background(), scheduledEmailSendTimeout)
+		err := app.mailer.Notify(ctx, email.Recipient, email.Template, email.Data)
+		cancel()
+
+		if err == nil {
+			err = app.models.ScheduledEmails.MarkSent(email.ID)
+			if err != nil {
+				app.logger.PrintError(err, nil)
+			}
+			continue
+		}
+
+		app.logger.PrintError(fmt.Errorf("scheduled email failed: %w", err), map[string]string{
+			"id":       strconv.FormatInt(email.ID, 10),
+			"attempts": strconv.Itoa(email.Attempts),
+		})
+
+		// Back off a little more after each failed attempt, and give up once we've hit
+		// the maximum number of attempts. There's no point retrying a suppressed
+		// recipient, or an email that rendered too large or too spammy (it'll render
+		// the same next time).
+		var retryAt *time.Time
+		if email.Attempts < scheduledEmailMaxAttempts && !errors.Is(err, mailer.ErrSuppressed) && !errors.Is(err, mailer.ErrBodyTooLarge) && !errors.Is(err, mailer.ErrSpam) {
+			t := time.Now().Add(time.Duration(email.Attempts) * time.Minute)
+			retryAt = &t
+		}
+
+		err = app.models.ScheduledEmails.MarkFailed(email.ID, err, retryAt)
+		if err != nil {
+			app.logger.PrintError(err, nil)
+		}
+	}
+}
+
+// The failStaleScheduledEmails() helper fails any emails which were claimed but never
+// finished, e.g. because the server crashed mid-batch, and logs each of them. They
+// might already have been delivered, so they aren't retried automatically: once
+// someone has checked, they can be re-sent with the
+// POST /v1/admin/scheduled-emails/:id/retry endpoint.
+func (app *application) failStaleScheduledEmails() {
+	ids, err := app.models.ScheduledEmails.FailStale(scheduledEmailStaleAfter)
+	if err != nil {
+		app.logger.PrintError(err, nil)
+		return
+	}
+
+	for _, id := range ids {
+		app.logger.PrintError(fmt.Errorf("scheduled email failed: %w", data.ErrStaleSending), map[string]string{
+			"id": strconv.FormatInt(id, 10),
+		})
+	}
+}
+
+// The retryFailedEmail() helper re-sends a scheduled email which has permanently
+// failed, through the same send path as the reaper. The template is rendered afresh.
+// On success the email is marked as sent (clearing its last error); otherwise it is
+// marked as failed again, with the new error, and that error is returned.
+func (app *application) retryFailedEmail(id int64) error {
+	email, err := app.models.ScheduledEmails.ClaimFailed(id)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), scheduledEmailSendTimeout)
+	defer cancel()
+
+	sendErr := app.mailer.Notify(ctx, email.Recipient, email.Template, email.Data)
+	if sendErr != nil {
+		err = app.models.ScheduledEmails.MarkFailed(email.ID, sendErr, nil)
+		if err != nil {
+			app.logger.PrintError(err, nil)
+		}
+
+		return sendErr
+	}
+
+	return app.models.ScheduledEmails.MarkSent(email.ID)
+}
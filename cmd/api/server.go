@@ -48,10 +48,34 @@ func (app *application) serve() error {
 			"addr": srv.Addr,
 		})
 
-		app.wg.Wait()
+		// Signal any long-running background tasks to stop.
+		close(app.shutdown)
+
+		// Give the background tasks a while to finish what they're doing. If some are
+		// still running after that, log it and carry on shutting down.
+		waitCtx, waitCancel := context.WithTimeout(context.Background(), 20*time.Second)
+		defer waitCancel()
+
+		err = app.tasks.Wait(waitCtx)
+		if err != nil {
+			app.logger.PrintError(err, nil)
+		}
+
+		// Let the mail queue drain. If some background tasks are still running, any
+		// mail they try to queue from now on fails with mailer.ErrQueueClosed (and is
+		// logged by the task) rather than being lost silently.
+		app.mailQueue.Close()
+
 		shutdownErrorChan <- nil
 	}()
 
+	app.background(app.reapScheduledEmails)
+	app.background(app.relayOutbox)
+	app.background(app.purgeExpiredPermissions)
+	app.background(app.purgeExpiredTokens)
+	app.background(app.purgeLoginFailures)
+	app.background(app.remindUnactivatedUsers)
+
 	app.logger.PrintInfo("starting server", map[string]string{
 		"addr": srv.Addr,
 		"env":  app.config.env,
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/bal3000/greenlight/internal/data"
@@ -24,14 +26,20 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 	v := validator.New()
 
 	data.ValidateEmail(v, input.Email)
-	data.ValidatePasswordPlainText(v, input.Password)
+	data.ValidatePasswordPlainText(v, input.Password, app.models.Hasher)
 
 	if !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 
-	user, err := app.models.Users.GetByEmail(input.Email)
+	tenantID, err := app.readTenantID(r)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	user, err := app.models.Users.GetByEmailForTenant(tenantID, input.Email)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -43,17 +51,49 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 		return
 	}
 
-	match, err := user.Password.Matches(input.Password)
+	match, err := user.Password.Matches(app.models.Hasher, input.Password)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
 	if !match {
+		app.alertLoginFailure(user.Email)
+		app.invalidCredentialsResponse(w, r)
+		return
+	}
+
+	// Suspended and deleted users had their tokens revoked when their status changed,
+	// so don't let them sign in again. A deleted account is treated as if it didn't
+	// exist.
+	switch user.Status {
+	case data.StatusSuspended:
+		app.accountSuspendedResponse(w, r)
+		return
+	case data.StatusDeleted:
 		app.invalidCredentialsResponse(w, r)
 		return
 	}
 
+	// If the password was hashed with old settings (e.g. a lower bcrypt cost), take the
+	// chance to upgrade it now that we have the plaintext. This is slow, so do it in the
+	// background.
+	if user.Password.NeedsRehash(app.models.Hasher) {
+		app.background(func() {
+			err := app.models.Users.RehashPassword(user.ID, input.Password)
+			if err != nil {
+				app.logger.PrintError(err, nil)
+			}
+		})
+	}
+
+	// If password expiry is enabled and the user's password is too old, refuse to issue
+	// a token so that the client is forced to send them through a password reset.
+	if user.PasswordExpired(app.config.password.maxAge) {
+		app.passwordExpiredResponse(w, r)
+		return
+	}
+
 	token, err := app.models.Tokens.New(user.ID, 24*time.Hour, data.ScopeAuthentication)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
@@ -83,7 +123,13 @@ func (app *application) createActivationTokenHandler(w http.ResponseWriter, r *h
 		return
 	}
 
-	user, err := app.models.Users.GetByEmail(input.Email)
+	tenantID, err := app.readTenantID(r)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	user, err := app.models.Users.GetByEmailForTenant(tenantID, input.Email)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -107,12 +153,22 @@ func (app *application) createActivationTokenHandler(w http.ResponseWriter, r *h
 		return
 	}
 
+	code, err := app.newActivationCode(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
 	app.background(func() {
 		data := map[string]interface{}{
-			"activationToken": token.PlainText,
+			"activationToken": app.activationTokenText(token),
+			"activationURL":   app.links.BuildActivationURL(app.activationTokenText(token)),
+			"activationCode":  code,
 		}
 
-		err = app.mailer.Send(user.Email, "token_activation.tmpl", data)
+		templateFile := app.mailer.Localize("token_activation.tmpl", user.Locale)
+
+		err = app.notifier.Notify(context.Background(), user.Email, templateFile, data)
 		if err != nil {
 			app.logger.PrintError(err, nil)
 		}
@@ -125,3 +181,303 @@ func (app *application) createActivationTokenHandler(w http.ResponseWriter, r *h
 		app.serverErrorResponse(w, r, err)
 	}
 }
+
+// The createPasswordResetTokenHandler emails a password reset token to the user. The
+// response is the same whether or not the email address belongs to an activated
+// account, so that the endpoint can't be used to find out which addresses are
+// registered.
+func (app *application) createPasswordResetTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email string `json:"email"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if data.ValidateEmail(v, input.Email); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	env := envelope{"message": "an email will be sent to you containing password reset instructions"}
+
+	tenantID, err := app.readTenantID(r)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	user, err := app.models.Users.GetByEmailForTenant(tenantID, input.Email)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			err = app.writeJSON(w, http.StatusAccepted, env, nil)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+			}
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if user.Activated {
+		token, err := app.models.Tokens.New(user.ID, 45*time.Minute, data.ScopePasswordReset)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		app.background(func() {
+			data := map[string]interface{}{
+				"passwordResetToken": token.PlainText,
+			}
+
+			templateFile := app.mailer.Localize("token_password_reset.tmpl", user.Locale)
+
+			err := app.notifier.Notify(context.Background(), user.Email, templateFile, data)
+			if err != nil {
+				app.logger.PrintError(err, nil)
+			}
+		})
+	}
+
+	err = app.writeJSON(w, http.StatusAccepted, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// verifyPasswordResetTokenHandler checks a password reset token without using it up,
+// so that a client can show the reset form only if the link in the email still works.
+// The token is only consumed when the new password is submitted to
+// updateUserPasswordHandler.
+func (app *application) verifyPasswordResetTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		TokenPlainText string `json:"token"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateTokenPlainText(v, input.TokenPlainText); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	_, err = app.models.Tokens.Verify(data.ScopePasswordReset, input.TokenPlainText)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrTokenUsed):
+			v.AddError("token", "this password reset link has already been used")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrTokenExpired):
+			v.AddError("token", "password reset token has expired, please request a new one")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired password reset token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"valid": true}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// activationTokenText returns the activation token as it should be sent to the user:
+// signed with the user's ID if a token signing key is configured, so that
+// activateUserHandler can reject tampered tokens without a database lookup, and the
+// plain token otherwise.
+func (app *application) activationTokenText(token *data.Token) string {
+	if !app.models.TokenSigner.Enabled() {
+		return token.PlainText
+	}
+
+	return app.models.TokenSigner.Sign(token.PlainText, token.UserID)
+}
+
+// newActivationCode issues a 6-digit activation code for the user if activation codes
+// are enabled, and returns an empty string if they aren't. The code is sent in the same
+// email as the activation token, and either can be used to activate the account.
+func (app *application) newActivationCode(userID int64) (string, error) {
+	if !app.config.activation.codes {
+		return "", nil
+	}
+
+	code, err := app.models.ActivationCodes.New(userID, app.config.activation.codeTTL)
+	if err != nil {
+		return "", err
+	}
+
+	return code.PlainText, nil
+}
+
+// The minimum time between activation emails being resent to the same user.
+const activationResendInterval = time.Minute
+
+// resendActivationTokenHandler re-issues the activation email in the requested locale.
+// The locale is saved as the user's preference, so that future emails default to it.
+// Any previous activation tokens are revoked, and resends are throttled per user.
+func (app *application) resendActivationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email  string `json:"email"`
+		Locale string `json:"locale"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	data.ValidateEmail(v, input.Email)
+	data.ValidateLocale(v, input.Locale)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	tenantID, err := app.readTenantID(r)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	user, err := app.models.Users.GetByEmailForTenant(tenantID, input.Email)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("email", "no matching email address found")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if user.Activated {
+		v.AddError("email", "user has already been activated")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Tokens.ThrottleIssue(data.ScopeActivation, user.ID, activationResendInterval)
+	if err != nil {
+		var rateLimited *data.ErrRateLimited
+		switch {
+		case errors.As(err, &rateLimited):
+			app.retryAfterResponse(w, r, rateLimited.RetryAfter)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if user.Locale != input.Locale {
+		user.Locale = input.Locale
+
+		err = app.models.Users.Update(user)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrEditConflict):
+				app.editConflictResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+	}
+
+	// Supersede the previous activation links, marking them as used rather than
+	// deleting them so that following one says it's no longer valid.
+	err = app.models.Tokens.MarkAllUsedForUser(data.ScopeActivation, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	token, err := app.models.Tokens.New(user.ID, 3*24*time.Hour, data.ScopeActivation)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	code, err := app.newActivationCode(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.background(func() {
+		data := map[string]interface{}{
+			"activationToken": app.activationTokenText(token),
+			"activationURL":   app.links.BuildActivationURL(app.activationTokenText(token)),
+			"activationCode":  code,
+		}
+
+		templateFile := app.mailer.Localize("token_activation.tmpl", user.Locale)
+
+		err := app.notifier.Notify(context.Background(), user.Email, templateFile, data)
+		if err != nil {
+			app.logger.PrintError(err, nil)
+		}
+	})
+
+	env := envelope{"message": "an email will be sent to you containing activation instructions"}
+
+	err = app.writeJSON(w, http.StatusAccepted, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+const (
+	// How often expired and used tokens are deleted.
+	expiredTokensInterval = time.Hour
+	// How long tokens are kept after they expire, so that using one can still be
+	// reported as expired or already used.
+	expiredTokensRetention = 7 * 24 * time.Hour
+)
+
+// The purgeExpiredTokens() method runs until the application starts shutting down,
+// periodically deleting tokens which expired more than expiredTokensRetention ago.
+func (app *application) purgeExpiredTokens() {
+	ticker := time.NewTicker(expiredTokensInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-app.shutdown:
+			return
+		case <-ticker.C:
+			deleted, err := app.models.Tokens.DeleteExpired(time.Now().Add(-expiredTokensRetention))
+			if err != nil {
+				app.logger.PrintError(err, nil)
+				continue
+			}
+
+			if deleted > 0 {
+				app.logger.PrintInfo("deleted expired tokens", map[string]string{
+					"count": strconv.FormatInt(deleted, 10),
+				})
+			}
+		}
+	}
+}
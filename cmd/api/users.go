@@ -1,7 +1,9 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
 	"net/http"
 	"time"
 
@@ -10,10 +12,53 @@ import (
 )
 
 func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Request) {
+	// If the client sent an Idempotency-Key header, reserve the key before doing
+	// anything else. If it has already been used we replay the original response rather
+	// than trying to register the user a second time, as long as it was used for the
+	// same request. If this request fails part way through, the reservation is released
+	// so that the client can retry with the same key.
+	idempotencyKey := r.Header.Get("Idempotency-Key")
+	idempotencyCompleted := false
+
+	if idempotencyKey != "" {
+		v := validator.New()
+		if data.ValidateIdempotencyKey(v, idempotencyKey); !v.Valid() {
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+
+		requestHash, err := app.readIdempotentRequestHash(w, r)
+		if err != nil {
+			app.badRequestResponse(w, r, err)
+			return
+		}
+
+		reserved, err := app.models.Idempotency.Reserve(idempotencyKey, requestHash, 24*time.Hour)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		if !reserved {
+			app.replayIdempotentResponse(w, r, idempotencyKey, requestHash)
+			return
+		}
+
+		defer func() {
+			if !idempotencyCompleted {
+				err := app.models.Idempotency.Delete(idempotencyKey)
+				if err != nil {
+					app.logError(r, err)
+				}
+			}
+		}()
+	}
+
 	var input struct {
-		Name     string `json:"name"`
-		Email    string `json:"email"`
-		Password string `json:"password"`
+		Name        string `json:"name"`
+		DisplayName string `json:"display_name"`
+		Email       string `json:"email"`
+		Password    string `json:"password"`
 	}
 
 	err := app.readJSON(w, r, &input)
@@ -22,26 +67,62 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
+	tenantID, err := app.readTenantID(r)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
 	user := &data.User{
-		Name:      input.Name,
-		Email:     input.Email,
-		Activated: false,
+		Name:        input.Name,
+		DisplayName: input.DisplayName,
+		Email:       input.Email,
+		Activated:   false,
+		TenantID:    tenantID,
 	}
 
-	err = user.Password.Set(input.Password)
+	v := validator.New()
+
+	err = user.Password.Set(app.models.Hasher, input.Password)
 	if err != nil {
-		app.serverErrorResponse(w, r, err)
+		switch {
+		case errors.Is(err, data.ErrPasswordAlreadyHashed):
+			v.AddError("password", "must not be a password hash")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
 		return
 	}
 
-	v := validator.New()
-
-	if data.ValidateUser(v, user); !v.Valid() {
+	if data.ValidateUser(v, user, app.models.Hasher); !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 
-	err = app.models.Users.Insert(user)
+	// If activation codes are enabled, send one with the welcome email too.
+	var codeTTL time.Duration
+	if app.config.activation.codes {
+		codeTTL = app.config.activation.codeTTL
+	}
+
+	// Insert the user, their permissions, activation token (and code) and welcome email
+	// in one transaction. The email is sent by the outbox relay once this has committed.
+	// If activation isn't required, the user comes back already activated and no email
+	// is sent.
+	err = app.models.Users.Register(user, []string{"movies:read"}, 3*24*time.Hour, codeTTL, "user_welcome.tmpl", func(token *data.Token, code *data.ActivationCode) map[string]interface{} {
+		data := map[string]interface{}{
+			"activationToken": app.activationTokenText(token),
+			"activationURL":   app.links.BuildActivationURL(app.activationTokenText(token)),
+			"userID":          user.ID,
+		}
+
+		if code != nil {
+			data["activationCode"] = code.PlainText
+		}
+
+		return data
+	})
 	if err != nil {
 		switch {
 		// If we get a ErrDuplicateEmail error, use the v.AddError() method to manually
@@ -56,38 +137,197 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	err = app.models.Permissions.AddForUser(user.ID, "movies:read")
+	env := envelope{"user": user}
+
+	// There's nothing more for the user to do if they were activated straight away, so
+	// report the account as created rather than accepted.
+	status := http.StatusAccepted
+	if user.Activated {
+		status = http.StatusCreated
+	}
+
+	if idempotencyKey != "" {
+		js, err := json.MarshalIndent(env, "", "\t")
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		err = app.models.Idempotency.Complete(idempotencyKey, user.ID, status, append(js, '\n'))
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		idempotencyCompleted = true
+	}
+
+	err = app.writeJSON(w, status, env, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		TokenPlainText string `json:"token"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	// If tokens are signed, check the signature before going anywhere near the
+	// database, so that scanning for valid tokens is cheap to turn away. Note that this
+	// means plain tokens (including ones issued before signing was turned on) are no
+	// longer accepted.
+	if app.models.TokenSigner.Enabled() {
+		plainText, _, err := app.models.TokenSigner.Verify(input.TokenPlainText)
+		if err != nil {
+			v.AddError("token", "invalid or expired activation token")
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+
+		input.TokenPlainText = plainText
+	}
+
+	if data.ValidateTokenPlainText(v, input.TokenPlainText); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 
-	token, err := app.models.Tokens.New(user.ID, 3*24*time.Hour, data.ScopeActivation)
+	// Activate the user and mark their activation tokens as used in one go.
+	user, err := app.models.Users.ActivateByToken(input.TokenPlainText)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrTokenUsed):
+			v.AddError("token", "this activation link is no longer valid, as it has already been used or a newer one has been sent")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrTokenExpired):
+			v.AddError("token", "activation token has expired, please request a new one")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired activation token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// activateUserWithCodeHandler activates a user with the 6-digit code from their
+// activation email, as an alternative to the activation token. Codes have a short TTL
+// and are thrown away after too many wrong attempts.
+func (app *application) activateUserWithCodeHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email         string `json:"email"`
+		CodePlainText string `json:"code"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
 		return
 	}
 
-	app.background(func() {
-		data := map[string]interface{}{
-			"activationToken": token.PlainText,
-			"userID":          user.ID,
+	v := validator.New()
+
+	data.ValidateEmail(v, input.Email)
+	data.ValidateSMSCodePlainText(v, input.CodePlainText)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	tenantID, err := app.readTenantID(r)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	user, err := app.models.Users.GetByEmailForTenant(tenantID, input.Email)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("code", "invalid or expired activation code")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
 		}
+		return
+	}
 
-		err = app.mailer.Send(user.Email, "user_welcome.tmpl", data)
-		if err != nil {
-			app.logger.PrintError(err, nil)
+	// Don't say that the user is already activated, or this would reveal which email
+	// addresses are registered. Their code was deleted when they activated anyway.
+	if user.Activated {
+		v.AddError("code", "invalid or expired activation code")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	ok, err := app.models.ActivationCodes.Verify(user.ID, input.CodePlainText)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrTooManyAttempts):
+			v.AddError("code", "too many attempts, please try again later or use the activation link")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("code", "invalid or expired activation code")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
 		}
-	})
+		return
+	}
+
+	if !ok {
+		v.AddError("code", "invalid or expired activation code")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Activate the user and mark the activation token sent in the same email as used,
+	// so that following the link afterwards says so.
+	err = app.models.Users.Activate(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
 
-	err = app.writeJSON(w, http.StatusAccepted, envelope{"user": user}, nil)
+	err = app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
 }
 
-func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Request) {
+// The updateUserPasswordHandler sets a new password for the user with a password reset
+// token. The new password can't be the current one or any of the recently used ones
+// kept in the password history. This is also how users whose password has expired set
+// a new one, since they can't get an authentication token until they do.
+func (app *application) updateUserPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	// Sessions created before the reset are signed out once it's done. Any created
+	// while it's in progress are left alone.
+	start := time.Now()
+
 	var input struct {
+		Password       string `json:"password"`
 		TokenPlainText string `json:"token"`
 	}
 
@@ -99,16 +339,19 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 
 	v := validator.New()
 
-	if data.ValidateTokenPlainText(v, input.TokenPlainText); !v.Valid() {
+	data.ValidatePasswordPlainText(v, input.Password, app.models.Hasher)
+	data.ValidateTokenPlainText(v, input.TokenPlainText)
+
+	if !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 
-	user, err := app.models.Users.GetForToken(data.ScopeActivation, input.TokenPlainText)
+	user, err := app.models.Users.GetForToken(data.ScopePasswordReset, input.TokenPlainText)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
-			v.AddError("token", "invalid or expired activation token")
+			v.AddError("token", "invalid or expired password reset token")
 			app.failedValidationResponse(w, r, v.Errors)
 		default:
 			app.serverErrorResponse(w, r, err)
@@ -116,7 +359,76 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	user.Activated = true
+	if !app.setUserPassword(w, r, v, user, input.Password) {
+		return
+	}
+
+	err = app.models.Tokens.DeleteAllForUser(data.ScopePasswordReset, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// If the reset was made from one of the user's sessions, keep that one and sign out
+	// all of the others. Otherwise sign out the sessions created before the reset
+	// started, leaving any created while it was in progress alone.
+	if keep := app.contextGetToken(r); keep != "" && app.contextGetUser(r).ID == user.ID {
+		_, err = app.models.Tokens.RotateForUser(user.ID, keep)
+	} else {
+		err = app.models.Tokens.DeleteAllForUserBefore(data.ScopeAuthentication, user.ID, start)
+	}
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "your password was successfully reset"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The setUserPassword() helper checks a new password for the user and saves it: it
+// can't be the current one or any of the recently used ones kept in the password
+// history. The password expiry clock is restarted and the new password is added to the
+// history. If anything goes wrong, the error response is sent and false is returned.
+func (app *application) setUserPassword(w http.ResponseWriter, r *http.Request, v *validator.Validator, user *data.User, plaintext string) bool {
+	if data.ValidatePasswordForUser(v, plaintext, user); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return false
+	}
+
+	// The current password isn't necessarily in the history (it isn't for a password
+	// set at registration), so check it separately.
+	current, err := user.Password.Matches(app.models.Hasher, plaintext)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return false
+	}
+
+	reused, err := app.models.Users.CheckPasswordReuse(user.ID, plaintext)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return false
+	}
+
+	if current || reused {
+		v.AddError("password", "must not be the same as a recent password")
+		app.failedValidationResponse(w, r, v.Errors)
+		return false
+	}
+
+	err = user.Password.Set(app.models.Hasher, plaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrPasswordAlreadyHashed):
+			v.AddError("password", "must not be a password hash")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return false
+	}
 
 	err = app.models.Users.Update(user)
 	if err != nil {
@@ -126,17 +438,308 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
+		return false
+	}
+
+	// Restart the password expiry clock.
+	err = app.models.Users.TouchPasswordChanged(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return false
+	}
+
+	// Record the new password, so that it can't be reused when it's next changed.
+	err = app.models.Users.AddPasswordHistory(user)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return false
+	}
+
+	return true
+}
+
+// The changeUserPasswordHandler lets a signed-in user change their password, given
+// their current one. All of their other sessions are signed out, but the one that the
+// request was made with is kept.
+func (app *application) changeUserPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	var input struct {
+		CurrentPassword string `json:"current_password"`
+		Password        string `json:"password"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	v.Check(input.CurrentPassword != "", "current_password", "must be provided")
+	data.ValidatePasswordPlainText(v, input.Password, app.models.Hasher)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	match, err := user.Password.Matches(app.models.Hasher, input.CurrentPassword)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !match {
+		v.AddError("current_password", "is incorrect")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if !app.setUserPassword(w, r, v, user, input.Password) {
+		return
+	}
+
+	revoked, err := app.models.Tokens.RotateForUser(user.ID, app.contextGetToken(r))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	env := envelope{"message": "your password was successfully changed", "revoked_sessions": revoked}
+
+	err = app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) showEmailPreferencesHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	prefs, err := app.models.Users.GetEmailPreferences(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Fill in the categories that the user hasn't set, so the client sees the effective
+	// preference for each one.
+	effective := make(data.EmailPreferences, len(data.EmailCategories))
+	for _, category := range data.EmailCategories {
+		effective[category] = prefs.Allows(category)
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"email_preferences": effective}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The updateEmailPreferencesHandler changes only the categories which are given in the
+// request body, leaving the others as they were.
+func (app *application) updateEmailPreferencesHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	var input struct {
+		EmailPreferences data.EmailPreferences `json:"email_preferences"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if data.ValidateEmailPreferences(v, input.EmailPreferences); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 
-	err = app.models.Tokens.DeleteAllForUser(data.ScopeActivation, user.ID)
+	err = app.models.Users.SetEmailPreferences(user.ID, input.EmailPreferences)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
+	app.showEmailPreferencesHandler(w, r)
+}
+
+// The showSessionsHandler reports how many sessions (authentication tokens) the user
+// has open, for display on security pages.
+func (app *application) showSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	count, err := app.models.Tokens.CountActive(data.ScopeAuthentication, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"active_sessions": count}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The updateTimezoneHandler sets the time zone that the user's scheduled emails are
+// sent in.
+func (app *application) updateTimezoneHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Timezone string `json:"timezone"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateTimezone(v, input.Timezone); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user := app.contextGetUser(r)
+	user.Timezone = input.Timezone
+
+	err = app.models.Users.Update(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
 	err = app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
 }
+
+// How long a code sent to verify a phone number is valid for.
+const phoneCodeTTL = 5 * time.Minute
+
+// The minimum time between codes being sent to the same user, or to the same phone
+// number.
+const phoneCodeResendInterval = time.Minute
+
+// createPhoneCodeHandler sends a 6-digit code by SMS to the phone number given, so that
+// the user can prove they own it with updatePhoneHandler.
+func (app *application) createPhoneCodeHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Phone string `json:"phone"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if data.ValidatePhone(v, input.Phone); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	err = app.models.SMSCodes.ThrottleSend(user.ID, input.Phone, phoneCodeResendInterval)
+	if err != nil {
+		var rateLimited *data.ErrRateLimited
+		switch {
+		case errors.As(err, &rateLimited):
+			app.retryAfterResponse(w, r, rateLimited.RetryAfter)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	code, err := app.models.SMSCodes.New(user.ID, input.Phone, phoneCodeTTL)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.background(func() {
+		message := fmt.Sprintf("Your Greenlight verification code is %s. It expires in %d minutes.", code.PlainText, int(phoneCodeTTL.Minutes()))
+
+		err := app.sms.SendSMS(code.Phone, message)
+		if err != nil {
+			app.logger.PrintError(err, nil)
+		}
+	})
+
+	err = app.writeJSON(w, http.StatusAccepted, envelope{"message": "a verification code will be sent to your phone"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// updatePhoneHandler sets the user's phone number, once they have entered the code
+// that createPhoneCodeHandler sent to it.
+func (app *application) updatePhoneHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Phone string `json:"phone"`
+		Code  string `json:"code"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	data.ValidatePhone(v, input.Phone)
+	data.ValidateSMSCodePlainText(v, input.Code)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	ok, err := app.models.SMSCodes.Verify(user.ID, input.Phone, input.Code)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrTooManyAttempts):
+			v.AddError("code", "too many attempts, please try again later")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("code", "invalid or expired verification code")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if !ok {
+		v.AddError("code", "invalid or expired verification code")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Users.SetPhone(user.ID, input.Phone)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"phone": input.Phone}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
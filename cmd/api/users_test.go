@@ -0,0 +1,65 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/bal3000/greenlight/internal/data"
+	"github.com/bal3000/greenlight/internal/jsonlog"
+	"github.com/bal3000/greenlight/internal/links"
+)
+
+func TestRegisterUserIdempotency(t *testing.T) {
+	builder, err := links.New("https://greenlight.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app := &application{
+		logger: jsonlog.New(io.Discard, jsonlog.LevelOff),
+		models: data.NewMockModels(),
+		links:  builder,
+	}
+
+	register := func(body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/v1/users", strings.NewReader(body))
+		r.Header.Set("Idempotency-Key", "signup-1")
+
+		w := httptest.NewRecorder()
+		app.registerUserHandler(w, r)
+		return w
+	}
+
+	body := `{"name": "Alice", "email": "alice@example.com", "password": "pa55word1234"}`
+
+	first := register(body)
+	if first.Code != http.StatusAccepted {
+		t.Fatalf("first request: got status %d; want %d: %s", first.Code, http.StatusAccepted, first.Body)
+	}
+
+	replay := register(body)
+	if replay.Code != http.StatusAccepted || replay.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("retried request: got status %d, replayed %q; want the stored response", replay.Code, replay.Header().Get("Idempotent-Replayed"))
+	}
+
+	if replay.Body.String() != first.Body.String() {
+		t.Errorf("retried request: got body %s; want %s", replay.Body, first.Body)
+	}
+
+	mismatch := register(`{"name": "Bob", "email": "bob@example.com", "password": "pa55word1234"}`)
+	if mismatch.Code != http.StatusUnprocessableEntity {
+		t.Errorf("different request: got status %d; want %d", mismatch.Code, http.StatusUnprocessableEntity)
+	}
+
+	exists, err := app.models.Users.EmailExists("bob@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if exists {
+		t.Error("different request: the user was registered")
+	}
+}
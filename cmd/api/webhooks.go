@@ -0,0 +1,52 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+
+	"github.com/bal3000/greenlight/internal/data"
+	"github.com/bal3000/greenlight/internal/validator"
+)
+
+// The emailEventsWebhookHandler receives hard bounces and complaints from the email
+// provider, and adds the addresses to the suppression list so that we stop mailing
+// them. The provider must send the shared secret in the X-Webhook-Secret header.
+func (app *application) emailEventsWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	secret := r.Header.Get("X-Webhook-Secret")
+	if subtle.ConstantTimeCompare([]byte(secret), []byte(app.config.suppression.secret)) != 1 {
+		app.invalidCredentialsResponse(w, r)
+		return
+	}
+
+	var input struct {
+		Email  string `json:"email"`
+		Reason string `json:"reason"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	data.ValidateEmail(v, input.Email)
+	data.ValidateSuppressionReason(v, input.Reason)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Suppressions.Add(input.Email, input.Reason)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "email address suppressed"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
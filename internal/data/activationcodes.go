@@ -0,0 +1,162 @@
+package data
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// The maximum number of wrong activation codes a user can enter in one attempt window.
+// The window starts with the first code they're sent and lasts as long as that code,
+// and requesting another code doesn't start a new one, so resending can't be used to
+// get more guesses.
+const ActivationCodeMaxAttempts = 5
+
+// ActivationCode is a 6-digit code which can be used to activate an account instead of
+// the (much longer) activation token, for users who have to type it in by hand. It
+// works exactly like an SMSCode, but is sent by email.
+type ActivationCode struct {
+	PlainText string
+	Hash      []byte
+	UserID    int64
+	Expiry    time.Time
+}
+
+type ActivationCodeModel struct {
+	DB *sql.DB
+}
+
+type ActivationCodeModeler interface {
+	New(userID int64, ttl time.Duration) (*ActivationCode, error)
+	Verify(userID int64, codePlainText string) (bool, error)
+}
+
+// New generates an activation code for the user and stores it, replacing any code that
+// they had previously been sent. The count of failed attempts is carried over from the
+// previous code unless its attempt window has ended.
+func (m ActivationCodeModel) New(userID int64, ttl time.Duration) (*ActivationCode, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return insertActivationCode(ctx, m.DB, userID, ttl)
+}
+
+// insertActivationCode implements New, inside or outside a transaction.
+func insertActivationCode(ctx context.Context, db execer, userID int64, ttl time.Duration) (*ActivationCode, error) {
+	sms, err := generateSMSCode(userID, "", ttl)
+	if err != nil {
+		return nil, err
+	}
+
+	code := &ActivationCode{
+		PlainText: sms.PlainText,
+		Hash:      sms.Hash,
+		UserID:    sms.UserID,
+		Expiry:    sms.Expiry,
+	}
+
+	query := `
+		INSERT INTO activation_codes (user_id, hash, expiry, attempts, attempts_expiry)
+		VALUES ($1, $2, $3, 0, $3)
+		ON CONFLICT (user_id) DO UPDATE
+		SET hash = EXCLUDED.hash, expiry = EXCLUDED.expiry,
+			attempts = CASE WHEN activation_codes.attempts_expiry < NOW() THEN 0 ELSE activation_codes.attempts END,
+			attempts_expiry = CASE WHEN activation_codes.attempts_expiry < NOW() THEN EXCLUDED.expiry ELSE activation_codes.attempts_expiry END`
+
+	args := []interface{}{code.UserID, code.Hash, code.Expiry}
+
+	_, err = db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	return code, nil
+}
+
+// Verify checks the code entered by the user, in the same way as SMSCodeModel.Verify.
+// A correct code is deleted straight away, and an incorrect one counts as a failed
+// attempt. Once ActivationCodeMaxAttempts is reached, ErrTooManyAttempts is returned
+// (even for the right code) until the attempt window ends. The row is kept until then,
+// so that a new code doesn't reset the count. If there is no unexpired code for the
+// user, ErrRecordNotFound is returned.
+func (m ActivationCodeModel) Verify(userID int64, codePlainText string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	query := `
+		SELECT hash, expiry, attempts, attempts_expiry
+		FROM activation_codes
+		WHERE user_id = $1
+		FOR UPDATE`
+
+	var (
+		hash           []byte
+		expiry         time.Time
+		attempts       int
+		attemptsExpiry time.Time
+	)
+
+	err = tx.QueryRowContext(ctx, query, userID).Scan(&hash, &expiry, &attempts, &attemptsExpiry)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return false, ErrRecordNotFound
+		default:
+			return false, err
+		}
+	}
+
+	// Start a new attempt window if the last one has ended.
+	if time.Now().After(attemptsExpiry) {
+		attempts = 0
+		attemptsExpiry = expiry
+	}
+
+	if attempts >= ActivationCodeMaxAttempts {
+		return false, ErrTooManyAttempts
+	}
+
+	// An expired code is left in place (rather than deleted), so that it still carries
+	// the attempt count.
+	if time.Now().After(expiry) {
+		return false, ErrRecordNotFound
+	}
+
+	codeHash := sha256.Sum256([]byte(codePlainText))
+
+	if subtle.ConstantTimeCompare(codeHash[:], hash) == 1 {
+		_, err = tx.ExecContext(ctx, "DELETE FROM activation_codes WHERE user_id = $1", userID)
+		if err != nil {
+			return false, err
+		}
+
+		return true, tx.Commit()
+	}
+
+	attempts++
+
+	_, err = tx.ExecContext(ctx, "UPDATE activation_codes SET attempts = $1, attempts_expiry = $2 WHERE user_id = $3", attempts, attemptsExpiry, userID)
+	if err != nil {
+		return false, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return false, err
+	}
+
+	if attempts >= ActivationCodeMaxAttempts {
+		return false, ErrTooManyAttempts
+	}
+
+	return false, nil
+}
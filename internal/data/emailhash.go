@@ -0,0 +1,27 @@
+package data
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+)
+
+// EmailHasher hashes email addresses with a secret key. The key must be kept as secret
+// as a password: anyone with it can confirm whether a hash belongs to a given address
+// by hashing it themselves. Changing the key changes every hash.
+type EmailHasher struct {
+	Key []byte
+}
+
+// Hash returns a deterministic, hex-encoded HMAC-SHA256 of the normalized (trimmed and
+// lower-cased) email address. It is one way (the address can't be recovered from the
+// hash), so it can be logged or stored wherever we only need to know whether two
+// addresses are the same, such as correlating log lines or counting distinct
+// recipients.
+func (h EmailHasher) Hash(email string) string {
+	mac := hmac.New(sha256.New, h.Key)
+	mac.Write([]byte(strings.ToLower(strings.TrimSpace(email))))
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
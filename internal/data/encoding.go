@@ -0,0 +1,81 @@
+package data
+
+import (
+	"encoding/base32"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"regexp"
+)
+
+// TokenEncoding is the encoding used to turn a token's random bytes into its
+// plaintext form.
+type TokenEncoding string
+
+const (
+	TokenEncodingBase32    TokenEncoding = "base32"    // 26 characters, the default
+	TokenEncodingBase58    TokenEncoding = "base58"    // up to 22 characters, no ambiguous characters
+	TokenEncodingBase64URL TokenEncoding = "base64url" // 22 characters, URL safe
+)
+
+const base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+// The formats of a plaintext token (generated from 16 random bytes) under each of the
+// supported encodings.
+var tokenEncodingRX = map[TokenEncoding]*regexp.Regexp{
+	TokenEncodingBase32:    regexp.MustCompile(`^[A-Z2-7]{26}$`),
+	TokenEncodingBase58:    regexp.MustCompile(`^[` + base58Alphabet + `]{16,22}$`),
+	TokenEncodingBase64URL: regexp.MustCompile(`^[A-Za-z0-9_-]{22}$`),
+}
+
+// ParseTokenEncoding converts a config value into a TokenEncoding, returning an error
+// if the encoding isn't supported.
+func ParseTokenEncoding(s string) (TokenEncoding, error) {
+	e := TokenEncoding(s)
+	if _, ok := tokenEncodingRX[e]; !ok {
+		return "", fmt.Errorf("unsupported token encoding %q", s)
+	}
+
+	return e, nil
+}
+
+// EncodeToString encodes the bytes using the encoding. An empty TokenEncoding is
+// treated as base32.
+func (e TokenEncoding) EncodeToString(b []byte) string {
+	switch e {
+	case TokenEncodingBase58:
+		return encodeBase58(b)
+	case TokenEncodingBase64URL:
+		return base64.RawURLEncoding.EncodeToString(b)
+	default:
+		return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b)
+	}
+}
+
+// encodeBase58 encodes the bytes using the Bitcoin base58 alphabet. Leading zero bytes
+// are encoded as leading '1' characters.
+func encodeBase58(b []byte) string {
+	n := new(big.Int).SetBytes(b)
+	radix := big.NewInt(58)
+	mod := new(big.Int)
+
+	var out []byte
+	for n.Sign() > 0 {
+		n.DivMod(n, radix, mod)
+		out = append(out, base58Alphabet[mod.Int64()])
+	}
+
+	for _, c := range b {
+		if c != 0 {
+			break
+		}
+		out = append(out, base58Alphabet[0])
+	}
+
+	// Reverse the output, as we built it least significant digit first.
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+
+	return string(out)
+}
@@ -47,12 +47,12 @@ func (f Filters) offset() int {
 }
 
 func ValidateFilters(v *validator.Validator, f Filters) {
-	v.Check(f.Page > 0, "page", "must be greater than zero")
-	v.Check(f.Page <= 10_000_000, "page", "must be a maximum of 10 million")
-	v.Check(f.PageSize > 0, "page_size", "must be greater than zero")
-	v.Check(f.PageSize <= 100, "page_size", "must be a maximum of 100")
+	v.Check(validator.AtLeast(f.Page, 1), "page", "must be greater than zero")
+	v.Check(validator.AtMost(f.Page, 10_000_000), "page", "must be a maximum of 10 million")
+	v.Check(validator.AtLeast(f.PageSize, 1), "page_size", "must be greater than zero")
+	v.Check(validator.AtMost(f.PageSize, 100), "page_size", "must be a maximum of 100")
 
-	v.Check(validator.In(f.Sort, f.SortSafelist...), "sort", "invalid sort value")
+	v.ValidFilterSort("sort", f.Sort, f.SortSafelist)
 }
 
 // Defines a Metadata struct for holding the pagination metadata
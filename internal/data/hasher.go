@@ -0,0 +1,60 @@
+package data
+
+import (
+	"errors"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// PasswordHasher hashes and checks passwords. MaxLength is the longest plaintext (in
+// bytes) that the algorithm takes fully into account, which ValidatePasswordPlainText
+// uses as its upper limit. NeedsRehash reports whether a stored hash wasn't made with
+// the hasher's current settings, so should be replaced the next time we have the
+// plaintext.
+type PasswordHasher interface {
+	Hash(plaintext string) ([]byte, error)
+	Compare(hash []byte, plaintext string) (bool, error)
+	MaxLength() int
+	NeedsRehash(hash []byte) bool
+}
+
+// The bcrypt cost used for new password hashes.
+const DefaultBcryptCost = 12
+
+// defaultHasher is used when Config.Hasher isn't set.
+var defaultHasher PasswordHasher = BcryptHasher{Cost: DefaultBcryptCost}
+
+// BcryptHasher hashes passwords with bcrypt, which ignores anything after the first 72
+// bytes of a password.
+type BcryptHasher struct {
+	Cost int
+}
+
+func (h BcryptHasher) Hash(plaintext string) ([]byte, error) {
+	return bcrypt.GenerateFromPassword([]byte(plaintext), h.Cost)
+}
+
+func (h BcryptHasher) Compare(hash []byte, plaintext string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword(hash, []byte(plaintext))
+	if err != nil {
+		switch {
+		case errors.Is(err, bcrypt.ErrMismatchedHashAndPassword):
+			return false, nil
+		default:
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+func (h BcryptHasher) MaxLength() int {
+	return 72
+}
+
+// NeedsRehash reports whether the hash was made with a different cost from h.Cost (or
+// can't be parsed as a bcrypt hash at all).
+func (h BcryptHasher) NeedsRehash(hash []byte) bool {
+	cost, err := bcrypt.Cost(hash)
+	return err != nil || cost != h.Cost
+}
@@ -0,0 +1,95 @@
+package data
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/bal3000/greenlight/internal/validator"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// longHasher stands in for a hasher without bcrypt's 72-byte limit, such as Argon2id.
+type longHasher struct{}
+
+func (longHasher) Hash(plaintext string) ([]byte, error) { return []byte(plaintext), nil }
+
+func (longHasher) Compare(hash []byte, plaintext string) (bool, error) {
+	return string(hash) == plaintext, nil
+}
+
+func (longHasher) MaxLength() int { return 4096 }
+
+func (longHasher) NeedsRehash(hash []byte) bool { return false }
+
+func TestBcryptHasherMaxLength(t *testing.T) {
+	if got := (BcryptHasher{Cost: DefaultBcryptCost}).MaxLength(); got != 72 {
+		t.Errorf("got %d; want 72", got)
+	}
+}
+
+func TestBcryptHasherNeedsRehash(t *testing.T) {
+	hash, err := BcryptHasher{Cost: bcrypt.MinCost}.Hash("pa55word1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if (BcryptHasher{Cost: bcrypt.MinCost}).NeedsRehash(hash) {
+		t.Error("expected a hash at the hasher's cost not to need rehashing")
+	}
+
+	if !(BcryptHasher{Cost: bcrypt.MinCost + 1}).NeedsRehash(hash) {
+		t.Error("expected a hash at a different cost to need rehashing")
+	}
+
+	if !(BcryptHasher{Cost: bcrypt.MinCost}).NeedsRehash([]byte("not a bcrypt hash")) {
+		t.Error("expected an unparseable hash to need rehashing")
+	}
+}
+
+func TestValidatePasswordPlainTextMaxLength(t *testing.T) {
+	tests := []struct {
+		name   string
+		hasher PasswordHasher
+		length int
+		valid  bool
+	}{
+		{name: "bcrypt at the limit", hasher: BcryptHasher{Cost: DefaultBcryptCost}, length: 72, valid: true},
+		{name: "bcrypt over the limit", hasher: BcryptHasher{Cost: DefaultBcryptCost}, length: 73},
+		{name: "long hasher over bcrypt's limit", hasher: longHasher{}, length: 73, valid: true},
+		{name: "long hasher at the limit", hasher: longHasher{}, length: 4096, valid: true},
+		{name: "long hasher over the limit", hasher: longHasher{}, length: 4097},
+	}
+
+	for _, tt := range tests {
+		v := validator.New()
+		ValidatePasswordPlainText(v, strings.Repeat("a", tt.length), tt.hasher)
+
+		if v.Valid() != tt.valid {
+			t.Errorf("%s: got valid %t; want %t (errors %v)", tt.name, v.Valid(), tt.valid, v.Errors)
+		}
+
+		if !tt.valid {
+			want := fmt.Sprintf("must not be more than %d bytes long", tt.hasher.MaxLength())
+			if got := v.Errors["password"]; got != want {
+				t.Errorf("%s: got error %q; want %q", tt.name, got, want)
+			}
+		}
+	}
+}
+
+func TestNewModelsHasher(t *testing.T) {
+	if got := NewModels(nil, Config{}).Hasher; got != defaultHasher {
+		t.Errorf("got %#v; want the default bcrypt hasher", got)
+	}
+
+	models := NewModels(nil, Config{Hasher: longHasher{}})
+
+	if _, ok := models.Hasher.(longHasher); !ok {
+		t.Errorf("got %#v; want the configured hasher", models.Hasher)
+	}
+
+	if _, ok := models.Users.(UserModel).Hasher.(longHasher); !ok {
+		t.Error("the configured hasher wasn't passed to the user model")
+	}
+}
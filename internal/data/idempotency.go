@@ -0,0 +1,128 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/bal3000/greenlight/internal/validator"
+)
+
+// IdempotencyRecord holds the stored result of a request made with an Idempotency-Key
+// header. A StatusCode of 0 means that the original request is still in progress.
+// RequestHash identifies the request that the key was first used for, so that reusing
+// the key for a different request can be caught. It's empty for keys reserved before
+// the hash was stored.
+type IdempotencyRecord struct {
+	Key         string
+	RequestHash string
+	StatusCode  int
+	Response    []byte
+	Expiry      time.Time
+}
+
+func ValidateIdempotencyKey(v *validator.Validator, key string) {
+	v.Check(len(key) <= 255, "Idempotency-Key", "must not be more than 255 bytes long")
+}
+
+type IdempotencyModel struct {
+	DB *sql.DB
+}
+
+type IdempotencyModeler interface {
+	Reserve(key, requestHash string, ttl time.Duration) (bool, error)
+	Get(key string) (*IdempotencyRecord, error)
+	Complete(key string, userID int64, statusCode int, response []byte) error
+	Delete(key string) error
+}
+
+// Reserve claims an idempotency key before the request is processed. It returns false
+// if the key has already been used (and hasn't expired), in which case the caller
+// should replay the stored response with Get() rather than processing the request
+// again. Reserving the key up front, rather than storing it after the fact, means that
+// two concurrent requests with the same key can't both get through. requestHash is
+// stored with the key, and is compared by the caller before a response is replayed.
+func (m IdempotencyModel) Reserve(key, requestHash string, ttl time.Duration) (bool, error) {
+	query := `
+		INSERT INTO idempotency_keys (key, request_hash, status_code, response, expiry)
+		VALUES ($1, $2, 0, NULL, $3)
+		ON CONFLICT (key) DO UPDATE
+		SET request_hash = EXCLUDED.request_hash, status_code = 0, response = NULL, user_id = NULL, expiry = EXCLUDED.expiry
+		WHERE idempotency_keys.expiry < NOW()`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, key, requestHash, time.Now().Add(ttl))
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rowsAffected == 1, nil
+}
+
+func (m IdempotencyModel) Get(key string) (*IdempotencyRecord, error) {
+	query := `
+		SELECT key, COALESCE(request_hash, ''), status_code, response, expiry
+		FROM idempotency_keys
+		WHERE key = $1 AND expiry > NOW()`
+
+	var record IdempotencyRecord
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, key).Scan(
+		&record.Key,
+		&record.RequestHash,
+		&record.StatusCode,
+		&record.Response,
+		&record.Expiry,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &record, nil
+}
+
+// Complete stores the response for a reserved key, so that it can be replayed. userID
+// is the user that the response is about (or 0 if there isn't one), so that the
+// response can be deleted if the user is erased.
+func (m IdempotencyModel) Complete(key string, userID int64, statusCode int, response []byte) error {
+	query := `
+		UPDATE idempotency_keys
+		SET status_code = $1, response = $2, user_id = NULLIF($3::bigint, 0)
+		WHERE key = $4`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, statusCode, response, userID, key)
+	return err
+}
+
+// Delete releases a reserved key, so that a request which failed can be retried with
+// the same key.
+func (m IdempotencyModel) Delete(key string) error {
+	query := `
+		DELETE FROM idempotency_keys
+		WHERE key = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, key)
+	return err
+}
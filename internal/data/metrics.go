@@ -0,0 +1,32 @@
+package data
+
+// Counter is the subset of *expvar.Int that the models need to record metrics. Taking
+// an interface keeps expvar out of the data package.
+type Counter interface {
+	Add(delta int64)
+}
+
+type nopCounter struct{}
+
+func (nopCounter) Add(int64) {}
+
+// ModelMetrics holds the counters which a model increments as it writes records. Any
+// counter left nil is ignored.
+type ModelMetrics struct {
+	Inserts         Counter
+	Updates         Counter
+	DuplicateEmails Counter
+	EditConflicts   Counter
+}
+
+// withDefaults returns a copy of the metrics with every nil counter replaced by a
+// no-op, so that the models can increment them unconditionally.
+func (m ModelMetrics) withDefaults() ModelMetrics {
+	for _, c := range []*Counter{&m.Inserts, &m.Updates, &m.DuplicateEmails, &m.EditConflicts} {
+		if *c == nil {
+			*c = nopCounter{}
+		}
+	}
+
+	return m
+}
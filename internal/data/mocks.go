@@ -0,0 +1,1967 @@
+package data
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bal3000/greenlight/internal/validator"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// mockPasswordHistory is how many previous passwords the mock user model remembers, to
+// match the default of the -password-history flag.
+const mockPasswordHistory = 5
+
+// NewMockModels returns Models backed by an in-memory store rather than PostgreSQL, for
+// testing handlers without a database. All of the mocks share the one store, so they
+// see each other's changes: a user created with Register can be activated with the
+// token from the welcome email that it put in the outbox, for example. Passwords are
+// hashed with bcrypt's minimum cost to keep tests fast.
+//
+// The mocks behave like the real models as far as the handlers can tell, including
+// unique email addresses, version checks and token expiry, but they don't enforce the
+// rest of the schema. Any permission code can be granted, and movie titles are matched
+// as a case-insensitive substring rather than by full-text search.
+func NewMockModels() Models {
+	store := newMockStore()
+	hasher := BcryptHasher{Cost: bcrypt.MinCost}
+
+	return Models{
+		Hasher:          hasher,
+		Movies:          MockMovieModel{store: store},
+		Users:           MockUserModel{store: store, Hasher: hasher, PasswordHistory: mockPasswordHistory},
+		Tokens:          MockTokenModel{store: store},
+		Permissions:     MockPermissionModel{store: store},
+		SMSCodes:        MockSMSCodeModel{store: store},
+		Idempotency:     MockIdempotencyModel{store: store},
+		ScheduledEmails: MockScheduledEmailModel{store: store},
+		Outbox:          MockOutboxModel{store: store},
+		Suppressions:    MockSuppressionModel{store: store},
+		ActivationCodes: MockActivationCodeModel{store: store},
+	}
+}
+
+// mockStore holds the rows for all of the mock models. Every method takes the mutex
+// for its whole run, which stands in for the real models' transactions.
+type mockStore struct {
+	mu     sync.Mutex
+	nextID int64
+
+	movies          map[int64]*Movie
+	users           map[int64]*mockUser
+	tokens          []*mockToken
+	grants          map[int64]map[string]*time.Time // user ID to code to expiry (nil if permanent)
+	passwordHistory map[int64][][]byte              // oldest first
+	smsCodes        map[int64]*mockCode
+	activationCodes map[int64]*mockCode
+	idempotencyKeys map[string]*mockIdempotencyRecord
+	scheduledEmails map[int64]*mockScheduledEmail
+	outbox          map[int64]*mockOutboxEmail
+	suppressed      map[string]string // lower-cased email to reason
+}
+
+func newMockStore() *mockStore {
+	return &mockStore{
+		movies:          make(map[int64]*Movie),
+		users:           make(map[int64]*mockUser),
+		grants:          make(map[int64]map[string]*time.Time),
+		passwordHistory: make(map[int64][][]byte),
+		smsCodes:        make(map[int64]*mockCode),
+		activationCodes: make(map[int64]*mockCode),
+		idempotencyKeys: make(map[string]*mockIdempotencyRecord),
+		scheduledEmails: make(map[int64]*mockScheduledEmail),
+		outbox:          make(map[int64]*mockOutboxEmail),
+		suppressed:      make(map[string]string),
+	}
+}
+
+// id returns the next ID, like a sequence. It's shared by all of the tables. The mutex
+// must be held.
+func (s *mockStore) id() int64 {
+	s.nextID++
+	return s.nextID
+}
+
+// mockUser is a row of the users table, including the columns which aren't on User.
+type mockUser struct {
+	user         User
+	phone        string
+	pendingEmail string
+	prefs        EmailPreferences
+}
+
+type mockToken struct {
+	Token
+	createdAt time.Time
+	usedAt    sql.NullTime
+}
+
+// mockCode is a row of the sms_codes or activation_codes table.
+type mockCode struct {
+	hash           []byte
+	phone          string
+	expiry         time.Time
+	attempts       int
+	attemptsExpiry time.Time
+	sentAt         time.Time
+}
+
+type mockIdempotencyRecord struct {
+	IdempotencyRecord
+	userID int64
+}
+
+type mockScheduledEmail struct {
+	ScheduledEmail
+	claimedAt time.Time
+}
+
+type mockOutboxEmail struct {
+	OutboxEmail
+	lockedUntil time.Time
+}
+
+// copyEmailData copies template data by round-tripping it through JSON, as storing it
+// in the database does, so that the mocks hand back the same types as the real models.
+func copyEmailData(data map[string]interface{}) (map[string]interface{}, error) {
+	js, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var c map[string]interface{}
+	err = json.Unmarshal(js, &c)
+	return c, err
+}
+
+// withoutHash returns a copy of the user without their password hash, for the methods
+// which don't load it.
+func withoutHash(user *User) *User {
+	c := copyUser(user)
+	c.Password = password{}
+	return c
+}
+
+// MockMovieModel is an in-memory MovieModeler. See NewMockModels.
+type MockMovieModel struct {
+	store *mockStore
+}
+
+func copyMovie(movie *Movie) *Movie {
+	c := *movie
+	c.Genres = append([]string(nil), movie.Genres...)
+	return &c
+}
+
+func (m MockMovieModel) Insert(movie *Movie) error {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	movie.ID = m.store.id()
+	movie.CreatedAt = time.Now()
+	movie.Version = 1
+
+	m.store.movies[movie.ID] = copyMovie(movie)
+	return nil
+}
+
+func (m MockMovieModel) GetAll(title string, genres []string, filters Filters) ([]*Movie, Metadata, error) {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	var matches []*Movie
+
+	for _, movie := range m.store.movies {
+		if !strings.Contains(strings.ToLower(movie.Title), strings.ToLower(title)) {
+			continue
+		}
+
+		hasGenres := true
+		for _, genre := range genres {
+			if !validator.In(genre, movie.Genres...) {
+				hasGenres = false
+				break
+			}
+		}
+
+		if hasGenres {
+			matches = append(matches, movie)
+		}
+	}
+
+	column, desc := filters.sortColumn(), filters.sortDirection() == "DESC"
+
+	sort.Slice(matches, func(i, j int) bool {
+		a, b := matches[i], matches[j]
+
+		var less, equal bool
+		switch column {
+		case "title":
+			less, equal = a.Title < b.Title, a.Title == b.Title
+		case "year":
+			less, equal = a.Year < b.Year, a.Year == b.Year
+		case "runtime":
+			less, equal = a.Runtime < b.Runtime, a.Runtime == b.Runtime
+		default:
+			less, equal = a.ID < b.ID, a.ID == b.ID
+		}
+
+		if equal {
+			return a.ID < b.ID
+		}
+
+		return less != desc
+	})
+
+	movies := []*Movie{}
+	for i := filters.offset(); i < len(matches) && len(movies) < filters.limit(); i++ {
+		movies = append(movies, copyMovie(matches[i]))
+	}
+
+	return movies, calculateMetadata(len(matches), filters.Page, filters.PageSize), nil
+}
+
+func (m MockMovieModel) Get(id int64) (*Movie, error) {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	movie, ok := m.store.movies[id]
+	if !ok {
+		return nil, ErrRecordNotFound
+	}
+
+	return copyMovie(movie), nil
+}
+
+func (m MockMovieModel) Update(movie *Movie) error {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	stored, ok := m.store.movies[movie.ID]
+	if !ok || stored.Version != movie.Version {
+		return ErrEditConflict
+	}
+
+	movie.Version++
+	movie.CreatedAt = stored.CreatedAt
+
+	m.store.movies[movie.ID] = copyMovie(movie)
+	return nil
+}
+
+func (m MockMovieModel) Delete(id int64) error {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	if _, ok := m.store.movies[id]; !ok {
+		return ErrRecordNotFound
+	}
+
+	delete(m.store.movies, id)
+	return nil
+}
+
+// MockUserModel is an in-memory UserModeler. See NewMockModels.
+type MockUserModel struct {
+	store           *mockStore
+	Hasher          PasswordHasher
+	PasswordHistory int
+}
+
+// byEmail returns the user with the email address in the tenant, or nil. The mutex
+// must be held.
+func (m MockUserModel) byEmail(tenantID int64, email string) *mockUser {
+	for _, row := range m.store.users {
+		if row.user.TenantID == tenantID && strings.EqualFold(row.user.Email, email) {
+			return row
+		}
+	}
+
+	return nil
+}
+
+// insert adds the user, filling in the columns which the database would. The mutex
+// must be held.
+func (m MockUserModel) insert(user *User) error {
+	if m.byEmail(user.TenantID, user.Email) != nil {
+		return ErrDuplicateEmail
+	}
+
+	user.ID = m.store.id()
+	user.CreatedAt = time.Now()
+	user.Version = 1
+	user.PasswordChangedAt = user.CreatedAt
+
+	if user.Locale == "" {
+		user.Locale = "en"
+	}
+
+	if user.Timezone == "" {
+		user.Timezone = "UTC"
+	}
+
+	m.store.users[user.ID] = &mockUser{user: *copyUser(user), prefs: EmailPreferences{}}
+	return nil
+}
+
+// grant gives the user the permissions until the given time, or permanently if until
+// is nil, in the same way as AddForUserUntil and AddForUser. The mutex must be held.
+func (s *mockStore) grant(userID int64, until *time.Time, codes ...string) {
+	if s.grants[userID] == nil {
+		s.grants[userID] = make(map[string]*time.Time)
+	}
+
+	for _, code := range codes {
+		current, ok := s.grants[userID][code]
+
+		switch {
+		case !ok || until == nil:
+			s.grants[userID][code] = until
+		case current != nil && until.After(*current):
+			s.grants[userID][code] = until
+		}
+	}
+}
+
+// permissions returns the user's unexpired permissions. The mutex must be held.
+func (s *mockStore) permissions(userID int64) Permissions {
+	var permissions Permissions
+
+	for code, expiry := range s.grants[userID] {
+		if expiry == nil || expiry.After(time.Now()) {
+			permissions = append(permissions, code)
+		}
+	}
+
+	sort.Strings(permissions)
+	return permissions
+}
+
+// findToken returns the token with the plaintext, or nil. The mutex must be held.
+func (s *mockStore) findToken(tokenPlainText string) *mockToken {
+	hash := legacyTokenHash(tokenPlainText)
+
+	for _, token := range s.tokens {
+		if bytes.Equal(token.Hash, hash) {
+			return token
+		}
+	}
+
+	return nil
+}
+
+// insertToken stores a token. The mutex must be held.
+func (s *mockStore) insertToken(token *Token) {
+	s.tokens = append(s.tokens, &mockToken{Token: *token, createdAt: time.Now()})
+}
+
+// deleteTokens deletes the tokens that match, returning how many there were. The
+// mutex must be held.
+func (s *mockStore) deleteTokens(match func(token *mockToken) bool) int64 {
+	var (
+		kept    []*mockToken
+		deleted int64
+	)
+
+	for _, token := range s.tokens {
+		if match(token) {
+			deleted++
+			continue
+		}
+
+		kept = append(kept, token)
+	}
+
+	s.tokens = kept
+	return deleted
+}
+
+// markTokensUsed is the mock of markTokensUsed. The mutex must be held.
+func (s *mockStore) markTokensUsed(scope string, userID int64) {
+	for _, token := range s.tokens {
+		if token.Scope == scope && token.UserID == userID && !token.usedAt.Valid {
+			token.usedAt = sql.NullTime{Time: time.Now(), Valid: true}
+		}
+	}
+}
+
+// live reports whether a token for the scope can still be used.
+func (t *mockToken) live(scope string) bool {
+	return t.Scope == scope && !t.usedAt.Valid && t.Expiry.After(time.Now())
+}
+
+// insertOutboxEmail is the mock of insertOutboxEmail. The mutex must be held.
+func (s *mockStore) insertOutboxEmail(email *OutboxEmail) error {
+	data, err := copyEmailData(email.Data)
+	if err != nil {
+		return err
+	}
+
+	email.ID = s.id()
+	email.CreatedAt = time.Now()
+
+	row := &mockOutboxEmail{OutboxEmail: *email}
+	row.Data = data
+
+	s.outbox[email.ID] = row
+	return nil
+}
+
+func (m MockUserModel) Insert(user *User) error {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	user.defaultDisplayName()
+	user.Status = StatusOf(user)
+
+	return m.insert(user)
+}
+
+func (m MockUserModel) Get(id int64) (*User, error) {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	row, ok := m.store.users[id]
+	if !ok {
+		return nil, ErrRecordNotFound
+	}
+
+	return copyUser(&row.user), nil
+}
+
+func (m MockUserModel) GetByEmail(email string) (*User, error) {
+	return m.GetByEmailForTenant(DefaultTenantID, email)
+}
+
+func (m MockUserModel) GetByEmailForTenant(tenantID int64, email string) (*User, error) {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	row := m.byEmail(tenantID, email)
+	if row == nil {
+		return nil, ErrRecordNotFound
+	}
+
+	return copyUser(&row.user), nil
+}
+
+func (m MockUserModel) Update(user *User) error {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	row, ok := m.store.users[user.ID]
+	if !ok || row.user.Version != user.Version {
+		return ErrEditConflict
+	}
+
+	if other := m.byEmail(row.user.TenantID, user.Email); other != nil && other != row {
+		return ErrDuplicateEmail
+	}
+
+	user.defaultDisplayName()
+	user.Version++
+
+	updated := copyUser(user)
+	row.user.Name = updated.Name
+	row.user.Email = updated.Email
+	row.user.Password = updated.Password
+	row.user.Activated = updated.Activated
+	row.user.Metadata = updated.Metadata
+	row.user.Locale = updated.Locale
+	row.user.Timezone = updated.Timezone
+	row.user.DisplayName = updated.DisplayName
+	row.user.Version = updated.Version
+
+	return nil
+}
+
+func (m MockUserModel) GetForToken(tokenScope, tokenPlainText string) (*User, error) {
+	user, _, err := m.getForToken(tokenScope, tokenPlainText, false)
+	return user, err
+}
+
+func (m MockUserModel) GetForTokenWithPermissions(tokenScope, tokenPlainText string) (*User, Permissions, error) {
+	return m.getForToken(tokenScope, tokenPlainText, true)
+}
+
+func (m MockUserModel) getForToken(tokenScope, tokenPlainText string, withPermissions bool) (*User, Permissions, error) {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	token := m.store.findToken(tokenPlainText)
+	if token == nil {
+		return nil, nil, ErrTokenNotFound
+	}
+
+	row, ok := m.store.users[token.UserID]
+	if !ok {
+		return nil, nil, ErrTokenNotFound
+	}
+
+	err := checkToken(tokenScope, token.Scope, token.Expiry, token.usedAt, time.Now())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var permissions Permissions
+	if withPermissions {
+		permissions = m.store.permissions(row.user.ID)
+		if permissions == nil {
+			permissions = Permissions{}
+		}
+	}
+
+	return copyUser(&row.user), permissions, nil
+}
+
+// Import works like UserModel.Import. The users are only added once every row has
+// been read, so a failure with stopOnError set leaves the store unchanged.
+func (m MockUserModel) Import(r io.Reader, stopOnError bool) ([]ImportResult, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	var (
+		results []ImportResult
+		users   []*User
+	)
+
+	for line := 1; ; line++ {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return results, err
+		}
+
+		if line == 1 && len(record) == 2 && strings.EqualFold(record[0], "name") && strings.EqualFold(record[1], "email") {
+			continue
+		}
+
+		result := ImportResult{Line: line}
+		result.Err = func() error {
+			if len(record) != 2 {
+				return fmt.Errorf("expected 2 fields, got %d", len(record))
+			}
+
+			user := &User{
+				Name:  strings.TrimSpace(record[0]),
+				Email: strings.TrimSpace(record[1]),
+			}
+			user.defaultDisplayName()
+			user.Status = StatusOf(user)
+
+			tempPassword, err := generateTemporaryPassword()
+			if err != nil {
+				return err
+			}
+
+			err = user.Password.Set(m.Hasher, tempPassword)
+			if err != nil {
+				return err
+			}
+
+			v := validator.New()
+			if ValidateUser(v, user, m.Hasher); !v.Valid() {
+				return v.Err()
+			}
+
+			for _, other := range users {
+				if strings.EqualFold(other.Email, user.Email) {
+					return ErrDuplicateEmail
+				}
+			}
+
+			result.User = user
+			result.TemporaryPassword = tempPassword
+			return nil
+		}()
+
+		if result.Err == nil {
+			users = append(users, result.User)
+		}
+
+		results = append(results, result)
+
+		if result.Err != nil && stopOnError {
+			return results, fmt.Errorf("line %d: %w", line, result.Err)
+		}
+	}
+
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	for i := range results {
+		if results[i].User == nil {
+			continue
+		}
+
+		err := m.insert(results[i].User)
+		if err != nil {
+			if stopOnError {
+				return results, fmt.Errorf("line %d: %w", results[i].Line, err)
+			}
+
+			results[i].Err = err
+			results[i].User = nil
+			results[i].TemporaryPassword = ""
+		}
+	}
+
+	return results, nil
+}
+
+func (m MockUserModel) ExportData(id int64) ([]byte, error) {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	row, ok := m.store.users[id]
+	if !ok {
+		return nil, ErrRecordNotFound
+	}
+
+	export := userExport{
+		User:              *withoutHash(&row.user),
+		Phone:             row.phone,
+		PendingEmail:      row.pendingEmail,
+		EmailPreferences:  row.prefs,
+		PasswordChangedAt: row.user.PasswordChangedAt,
+	}
+
+	for _, token := range m.store.tokens {
+		if token.UserID == id {
+			export.Tokens = append(export.Tokens, exportedToken{Scope: token.Scope, Expiry: token.Expiry})
+		}
+	}
+
+	sort.Slice(export.Tokens, func(i, j int) bool {
+		return export.Tokens[i].Expiry.Before(export.Tokens[j].Expiry)
+	})
+
+	for code := range m.store.grants[id] {
+		export.Permissions = append(export.Permissions, code)
+	}
+	sort.Strings(export.Permissions)
+
+	return json.MarshalIndent(export, "", "\t")
+}
+
+// deleteUserRows deletes everything that belongs to the user apart from their emails
+// and their own row, as eraseQueries do. The mutex must be held.
+func (s *mockStore) deleteUserRows(id int64) {
+	s.deleteTokens(func(token *mockToken) bool { return token.UserID == id })
+
+	delete(s.grants, id)
+	delete(s.passwordHistory, id)
+	delete(s.smsCodes, id)
+	delete(s.activationCodes, id)
+
+	for key, record := range s.idempotencyKeys {
+		if record.userID == id {
+			delete(s.idempotencyKeys, key)
+		}
+	}
+}
+
+func (m MockUserModel) Erase(id int64) error {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	row, ok := m.store.users[id]
+	if !ok {
+		return ErrRecordNotFound
+	}
+
+	m.store.deleteUserRows(id)
+
+	for emailID, email := range m.store.outbox {
+		if strings.EqualFold(email.Recipient, row.user.Email) {
+			delete(m.store.outbox, emailID)
+		}
+	}
+
+	for emailID, email := range m.store.scheduledEmails {
+		if strings.EqualFold(email.Recipient, row.user.Email) {
+			delete(m.store.scheduledEmails, emailID)
+		}
+	}
+
+	delete(m.store.users, id)
+	return nil
+}
+
+func (m MockUserModel) EmailExists(email string) (bool, error) {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	return m.byEmail(DefaultTenantID, email) != nil, nil
+}
+
+func (m MockUserModel) CheckPasswordReuse(userID int64, newPlaintext string) (bool, error) {
+	if m.PasswordHistory <= 0 {
+		return false, nil
+	}
+
+	m.store.mu.Lock()
+	hashes := m.store.passwordHistory[userID]
+	m.store.mu.Unlock()
+
+	for _, hash := range hashes {
+		p := password{hash: hash}
+
+		match, err := p.Matches(m.Hasher, newPlaintext)
+		if err != nil {
+			return false, err
+		}
+
+		if match {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func (m MockUserModel) AddPasswordHistory(user *User) error {
+	if m.PasswordHistory <= 0 {
+		return nil
+	}
+
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	history := append(m.store.passwordHistory[user.ID], append([]byte(nil), user.Password.hash...))
+	if len(history) > m.PasswordHistory {
+		history = history[len(history)-m.PasswordHistory:]
+	}
+
+	m.store.passwordHistory[user.ID] = history
+	return nil
+}
+
+func (m MockUserModel) TouchPasswordChanged(id int64) error {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	row, ok := m.store.users[id]
+	if !ok {
+		return ErrRecordNotFound
+	}
+
+	row.user.PasswordChangedAt = time.Now()
+	return nil
+}
+
+func (m MockUserModel) SetPhone(id int64, phone string) error {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	row, ok := m.store.users[id]
+	if !ok {
+		return ErrRecordNotFound
+	}
+
+	row.phone = phone
+	return nil
+}
+
+// activate marks the user as activated in the same way as the real Activate and
+// ActivateByToken. The mutex must be held.
+func (m MockUserModel) activate(row *mockUser) {
+	row.user.Activated = true
+	if row.user.Status == StatusPending {
+		row.user.Status = StatusActive
+	}
+	row.user.Version++
+
+	m.store.markTokensUsed(ScopeActivation, row.user.ID)
+}
+
+func (m MockUserModel) ActivateByToken(tokenPlainText string) (*User, error) {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	token := m.store.findToken(tokenPlainText)
+	if token == nil {
+		return nil, ErrTokenNotFound
+	}
+
+	row, ok := m.store.users[token.UserID]
+	if !ok {
+		return nil, ErrTokenNotFound
+	}
+
+	err := checkToken(ScopeActivation, token.Scope, token.Expiry, token.usedAt, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	m.activate(row)
+	return copyUser(&row.user), nil
+}
+
+func (m MockUserModel) Activate(user *User) error {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	row, ok := m.store.users[user.ID]
+	if !ok || row.user.Version != user.Version {
+		return ErrEditConflict
+	}
+
+	m.activate(row)
+
+	user.Activated = row.user.Activated
+	user.Status = row.user.Status
+	user.Version = row.user.Version
+	return nil
+}
+
+func (m MockUserModel) SetStatus(user *User, status Status) (int64, error) {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	row, ok := m.store.users[user.ID]
+	if !ok || row.user.Version != user.Version {
+		return 0, ErrEditConflict
+	}
+
+	row.user.Status = status
+	row.user.Version++
+
+	user.Status = row.user.Status
+	user.Version = row.user.Version
+
+	var revoked int64
+	if status == StatusSuspended || status == StatusDeleted {
+		revoked = m.store.deleteTokens(func(token *mockToken) bool { return token.UserID == user.ID })
+	}
+
+	return revoked, nil
+}
+
+func (m MockUserModel) GetForTokens(tokenScope string, tokenPlainTexts []string) (map[string]*User, error) {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	users := make(map[string]*User)
+
+	for _, plainText := range tokenPlainTexts {
+		token := m.store.findToken(plainText)
+		if token == nil || !token.live(tokenScope) {
+			continue
+		}
+
+		if row, ok := m.store.users[token.UserID]; ok {
+			users[plainText] = copyUser(&row.user)
+		}
+	}
+
+	return users, nil
+}
+
+func (m MockUserModel) Register(user *User, permissionCodes []string, activationTTL, codeTTL time.Duration, templateFile string, templateData func(token *Token, code *ActivationCode) map[string]interface{}) error {
+	user.defaultDisplayName()
+	user.Status = StatusOf(user)
+
+	token, err := generateToken(0, activationTTL, ScopeActivation, "", nil, nil)
+	if err != nil {
+		return err
+	}
+
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	err = m.insert(user)
+	if err != nil {
+		return err
+	}
+
+	m.store.grant(user.ID, nil, permissionCodes...)
+
+	if user.Activated {
+		return nil
+	}
+
+	token.UserID = user.ID
+	m.store.insertToken(token)
+
+	var code *ActivationCode
+	if codeTTL != 0 {
+		code, err = MockActivationCodeModel{store: m.store}.new(user.ID, codeTTL)
+		if err != nil {
+			return err
+		}
+	}
+
+	if templateData == nil {
+		templateData = defaultWelcomeData
+	}
+
+	return m.store.insertOutboxEmail(&OutboxEmail{
+		Recipient: user.Email,
+		Template:  templateFile,
+		Data:      templateData(token, code),
+	})
+}
+
+func (m MockUserModel) SearchByEmail(prefix string, limit int, includeService bool) ([]*User, error) {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	users := []*User{}
+
+	for _, row := range m.store.users {
+		if !strings.HasPrefix(strings.ToLower(row.user.Email), strings.ToLower(prefix)) {
+			continue
+		}
+
+		if row.user.IsService && !includeService {
+			continue
+		}
+
+		users = append(users, withoutHash(&row.user))
+	}
+
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Email < users[j].Email
+	})
+
+	if len(users) > limit {
+		users = users[:limit]
+	}
+
+	return users, nil
+}
+
+func (m MockUserModel) Merge(sourceID, targetID int64) error {
+	if sourceID == targetID {
+		return ErrMergeSameUser
+	}
+
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	source, ok := m.store.users[sourceID]
+	if !ok {
+		return ErrRecordNotFound
+	}
+
+	target, ok := m.store.users[targetID]
+	if !ok {
+		return ErrRecordNotFound
+	}
+
+	for _, token := range m.store.tokens {
+		if token.UserID == sourceID && token.Scope == ScopeAuthentication {
+			token.UserID = targetID
+		}
+	}
+
+	if m.store.grants[targetID] == nil {
+		m.store.grants[targetID] = make(map[string]*time.Time)
+	}
+
+	for code, expiry := range m.store.grants[sourceID] {
+		if _, ok := m.store.grants[targetID][code]; !ok {
+			m.store.grants[targetID][code] = expiry
+		}
+	}
+
+	for _, email := range m.store.outbox {
+		if strings.EqualFold(email.Recipient, source.user.Email) {
+			email.Recipient = target.user.Email
+		}
+	}
+
+	for _, email := range m.store.scheduledEmails {
+		if strings.EqualFold(email.Recipient, source.user.Email) {
+			email.Recipient = target.user.Email
+		}
+	}
+
+	target.user.Version++
+
+	m.store.deleteUserRows(sourceID)
+	delete(m.store.users, sourceID)
+
+	return nil
+}
+
+func (m MockUserModel) GetEmailPreferences(id int64) (EmailPreferences, error) {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	row, ok := m.store.users[id]
+	if !ok {
+		return nil, ErrRecordNotFound
+	}
+
+	prefs := EmailPreferences{}
+	for category, optedIn := range row.prefs {
+		prefs[category] = optedIn
+	}
+
+	return prefs, nil
+}
+
+func (m MockUserModel) SetEmailPreferences(id int64, prefs EmailPreferences) error {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	row, ok := m.store.users[id]
+	if !ok {
+		return ErrRecordNotFound
+	}
+
+	for category, optedIn := range prefs {
+		row.prefs[category] = optedIn
+	}
+
+	return nil
+}
+
+func (m MockUserModel) HashCostHistogram() (map[int]int, error) {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	histogram := make(map[int]int)
+
+	for _, row := range m.store.users {
+		cost, err := bcrypt.Cost(row.user.Password.hash)
+		if err != nil {
+			cost = 0
+		}
+
+		histogram[cost]++
+	}
+
+	return histogram, nil
+}
+
+func (m MockUserModel) RehashPassword(id int64, plaintext string) error {
+	m.store.mu.Lock()
+	row, ok := m.store.users[id]
+	if !ok {
+		m.store.mu.Unlock()
+		return ErrRecordNotFound
+	}
+
+	current := password{hash: row.user.Password.hash}
+	version := row.user.Version
+	m.store.mu.Unlock()
+
+	match, err := current.Matches(m.Hasher, plaintext)
+	if err != nil {
+		return err
+	}
+
+	if !match {
+		return ErrPasswordMismatch
+	}
+
+	if !current.NeedsRehash(m.Hasher) {
+		return nil
+	}
+
+	hash, err := m.Hasher.Hash(plaintext)
+	if err != nil {
+		return err
+	}
+
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	row, ok = m.store.users[id]
+	if !ok || row.user.Version != version {
+		return ErrEditConflict
+	}
+
+	row.user.Password = password{hash: hash}
+	row.user.Version++
+	return nil
+}
+
+// sortedUsers returns the users in id order. The mutex must be held.
+func (s *mockStore) sortedUsers() []*mockUser {
+	rows := make([]*mockUser, 0, len(s.users))
+	for _, row := range s.users {
+		rows = append(rows, row)
+	}
+
+	sort.Slice(rows, func(i, j int) bool {
+		return rows[i].user.ID < rows[j].user.ID
+	})
+
+	return rows
+}
+
+func (m MockUserModel) StreamAll(fn func(*User) error) error {
+	m.store.mu.Lock()
+	var users []*User
+	for _, row := range m.store.sortedUsers() {
+		users = append(users, withoutHash(&row.user))
+	}
+	m.store.mu.Unlock()
+
+	// fn is called without the mutex held, so that it can use the other mocks.
+	for _, user := range users {
+		err := fn(user)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (m MockUserModel) CancelEmailChange(id int64) error {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	row, ok := m.store.users[id]
+	if !ok || row.pendingEmail == "" {
+		return ErrRecordNotFound
+	}
+
+	row.pendingEmail = ""
+	m.store.deleteTokens(func(token *mockToken) bool {
+		return token.Scope == ScopeEmailChange && token.UserID == id
+	})
+
+	return nil
+}
+
+func (m MockUserModel) GetAllWithPermission(code string, filters Filters) ([]*User, Metadata, error) {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	var matches []*User
+
+	for _, row := range m.store.users {
+		if m.store.permissions(row.user.ID).Include(code) {
+			matches = append(matches, &row.user)
+		}
+	}
+
+	column, desc := filters.sortColumn(), filters.sortDirection() == "DESC"
+
+	sort.Slice(matches, func(i, j int) bool {
+		a, b := matches[i], matches[j]
+
+		var less, equal bool
+		switch column {
+		case "email":
+			less, equal = a.Email < b.Email, a.Email == b.Email
+		case "name":
+			less, equal = a.Name < b.Name, a.Name == b.Name
+		case "created_at":
+			less, equal = a.CreatedAt.Before(b.CreatedAt), a.CreatedAt.Equal(b.CreatedAt)
+		default:
+			less, equal = a.ID < b.ID, a.ID == b.ID
+		}
+
+		if equal {
+			return a.ID < b.ID
+		}
+
+		return less != desc
+	})
+
+	users := []*User{}
+	for i := filters.offset(); i < len(matches) && len(users) < filters.limit(); i++ {
+		users = append(users, withoutHash(matches[i]))
+	}
+
+	return users, calculateMetadata(len(matches), filters.Page, filters.PageSize), nil
+}
+
+func (m MockUserModel) VerifyPassword(id int64, plaintext string) (bool, error) {
+	m.store.mu.Lock()
+	row, ok := m.store.users[id]
+	if !ok {
+		m.store.mu.Unlock()
+		return false, ErrRecordNotFound
+	}
+
+	current := password{hash: row.user.Password.hash}
+	m.store.mu.Unlock()
+
+	return current.Matches(m.Hasher, plaintext)
+}
+
+func (m MockUserModel) GetRecent(limit int, includeService bool) ([]*User, error) {
+	if limit > MaxRecentUsers {
+		limit = MaxRecentUsers
+	}
+
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	rows := m.store.sortedUsers()
+	users := []*User{}
+
+	for i := len(rows) - 1; i >= 0 && len(users) < limit; i-- {
+		if rows[i].user.IsService && !includeService {
+			continue
+		}
+
+		users = append(users, withoutHash(&rows[i].user))
+	}
+
+	return users, nil
+}
+
+func (m MockUserModel) GetStaleUnactivated(olderThan time.Duration) ([]*User, error) {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	cutoff := time.Now().Add(-olderThan)
+	users := []*User{}
+
+	for _, row := range m.store.sortedUsers() {
+		if !row.user.Activated && row.user.CreatedAt.Before(cutoff) {
+			users = append(users, withoutHash(&row.user))
+		}
+	}
+
+	return users, nil
+}
+
+func (m MockUserModel) CreateServiceAccount(user *User, permissionCodes ...string) error {
+	user.Activated = true
+	user.IsService = true
+	user.defaultDisplayName()
+	user.Status = StatusOf(user)
+
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	err := m.insert(user)
+	if err != nil {
+		return err
+	}
+
+	m.store.grant(user.ID, nil, permissionCodes...)
+	return nil
+}
+
+// MockTokenModel is an in-memory TokenModeler. See NewMockModels. Tokens are hashed
+// with plain SHA-256, and there's no expiry grace period.
+type MockTokenModel struct {
+	store *mockStore
+}
+
+func (m MockTokenModel) New(userID int64, ttl time.Duration, scope string) (*Token, error) {
+	token, err := generateToken(userID, ttl, scope, "", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	err = m.Insert(token)
+	return token, err
+}
+
+func (m MockTokenModel) Insert(token *Token) error {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	m.store.insertToken(token)
+	return nil
+}
+
+func (m MockTokenModel) DeleteAllForUser(scope string, userID int64) error {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	m.store.deleteTokens(func(token *mockToken) bool {
+		return token.Scope == scope && token.UserID == userID
+	})
+
+	return nil
+}
+
+func (m MockTokenModel) DeleteAllForUserBefore(scope string, userID int64, before time.Time) error {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	m.store.deleteTokens(func(token *mockToken) bool {
+		return token.Scope == scope && token.UserID == userID && token.createdAt.Before(before)
+	})
+
+	return nil
+}
+
+func (m MockTokenModel) DeleteAllForUserAllScopes(userID int64) (int64, error) {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	return m.store.deleteTokens(func(token *mockToken) bool { return token.UserID == userID }), nil
+}
+
+func (m MockTokenModel) DeleteAllForUsers(scope string, userIDs []int64) (int64, error) {
+	if len(userIDs) > MaxBulkTokenUsers {
+		return 0, ErrTooManyUsers
+	}
+
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	return m.store.deleteTokens(func(token *mockToken) bool {
+		if token.Scope != scope {
+			return false
+		}
+
+		for _, id := range userIDs {
+			if token.UserID == id {
+				return true
+			}
+		}
+
+		return false
+	}), nil
+}
+
+func (m MockTokenModel) DeleteByIssuedBefore(cutoff time.Time) (int64, error) {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	return m.store.deleteTokens(func(token *mockToken) bool { return token.createdAt.Before(cutoff) }), nil
+}
+
+func (m MockTokenModel) DeleteExpired(before time.Time) (int64, error) {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	return m.store.deleteTokens(func(token *mockToken) bool { return token.Expiry.Before(before) }), nil
+}
+
+func (m MockTokenModel) MarkUsed(tokenPlainText string) error {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	token := m.store.findToken(tokenPlainText)
+	if token == nil || token.usedAt.Valid {
+		return ErrTokenNotFound
+	}
+
+	token.usedAt = sql.NullTime{Time: time.Now(), Valid: true}
+	return nil
+}
+
+func (m MockTokenModel) MarkAllUsedForUser(scope string, userID int64) error {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	m.store.markTokensUsed(scope, userID)
+	return nil
+}
+
+func (m MockTokenModel) RotateForUser(userID int64, keepPlainText string) (int64, error) {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	var keep []byte
+	if keepPlainText != "" {
+		keep = legacyTokenHash(keepPlainText)
+	}
+
+	return m.store.deleteTokens(func(token *mockToken) bool {
+		return token.Scope == ScopeAuthentication && token.UserID == userID && !bytes.Equal(token.Hash, keep)
+	}), nil
+}
+
+func (m MockTokenModel) LastIssuedForUser(scope string, userID int64) (time.Time, error) {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	var lastIssued time.Time
+
+	for _, token := range m.store.tokens {
+		if token.Scope == scope && token.UserID == userID && token.createdAt.After(lastIssued) {
+			lastIssued = token.createdAt
+		}
+	}
+
+	return lastIssued, nil
+}
+
+func (m MockTokenModel) ThrottleIssue(scope string, userID int64, interval time.Duration) error {
+	lastIssued, err := m.LastIssuedForUser(scope, userID)
+	if err != nil {
+		return err
+	}
+
+	return throttle(lastIssued, interval, time.Now())
+}
+
+func (m MockTokenModel) Verify(scope, tokenPlainText string) (bool, error) {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	token := m.store.findToken(tokenPlainText)
+	if token == nil {
+		return false, ErrTokenNotFound
+	}
+
+	err := checkToken(scope, token.Scope, token.Expiry, token.usedAt, time.Now())
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (m MockTokenModel) GetExpiringSoon(scope string, within time.Duration) ([]*Token, error) {
+	from, to := expiringSoonWindow(time.Now(), 0, within)
+
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	tokens := []*Token{}
+
+	for _, token := range m.store.tokens {
+		if token.Scope == scope && !token.usedAt.Valid && token.Expiry.After(from) && !token.Expiry.After(to) {
+			tokens = append(tokens, &Token{
+				Hash:   append([]byte(nil), token.Hash...),
+				UserID: token.UserID,
+				Expiry: token.Expiry,
+				Scope:  token.Scope,
+			})
+		}
+	}
+
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].Expiry.Before(tokens[j].Expiry)
+	})
+
+	return tokens, nil
+}
+
+func (m MockTokenModel) ExistsForUser(scope string, userID int64) (bool, error) {
+	count, err := m.CountActive(scope, userID)
+	return count > 0, err
+}
+
+func (m MockTokenModel) CountActive(scope string, userID int64) (int, error) {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	count := 0
+
+	for _, token := range m.store.tokens {
+		if token.UserID == userID && token.live(scope) {
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+// MockPermissionModel is an in-memory PermissionModeler. See NewMockModels.
+type MockPermissionModel struct {
+	store *mockStore
+}
+
+func (m MockPermissionModel) GetAllForUser(userID int64) (Permissions, error) {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	return m.store.permissions(userID), nil
+}
+
+func (m MockPermissionModel) AddForUser(userID int64, codes ...string) error {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	m.store.grant(userID, nil, codes...)
+	return nil
+}
+
+func (m MockPermissionModel) AddForUserUntil(userID int64, until time.Time, codes ...string) error {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	m.store.grant(userID, &until, codes...)
+	return nil
+}
+
+func (m MockPermissionModel) DeleteExpired() (int64, error) {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	var deleted int64
+
+	for _, grants := range m.store.grants {
+		for code, expiry := range grants {
+			if expiry != nil && !expiry.After(time.Now()) {
+				delete(grants, code)
+				deleted++
+			}
+		}
+	}
+
+	return deleted, nil
+}
+
+// matchesCode reports whether the plaintext is the code with the given hash.
+func matchesCode(hash []byte, codePlainText string) bool {
+	codeHash := sha256.Sum256([]byte(codePlainText))
+	return subtle.ConstantTimeCompare(codeHash[:], hash) == 1
+}
+
+// MockSMSCodeModel is an in-memory SMSCodeModeler. See NewMockModels.
+type MockSMSCodeModel struct {
+	store *mockStore
+}
+
+func (m MockSMSCodeModel) New(userID int64, phone string, ttl time.Duration) (*SMSCode, error) {
+	code, err := generateSMSCode(userID, phone, ttl)
+	if err != nil {
+		return nil, err
+	}
+
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	attempts := 0
+	if previous, ok := m.store.smsCodes[userID]; ok && previous.expiry.After(time.Now()) {
+		attempts = previous.attempts
+	}
+
+	m.store.smsCodes[userID] = &mockCode{
+		hash:     code.Hash,
+		phone:    phone,
+		expiry:   code.Expiry,
+		attempts: attempts,
+		sentAt:   time.Now(),
+	}
+
+	return code, nil
+}
+
+func (m MockSMSCodeModel) ThrottleSend(userID int64, phone string, interval time.Duration) error {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	var lastSent time.Time
+
+	for id, code := range m.store.smsCodes {
+		if (id == userID || code.phone == phone) && code.sentAt.After(lastSent) {
+			lastSent = code.sentAt
+		}
+	}
+
+	return throttle(lastSent, interval, time.Now())
+}
+
+func (m MockSMSCodeModel) Verify(userID int64, phone, codePlainText string) (bool, error) {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	code, ok := m.store.smsCodes[userID]
+	if !ok || code.phone != phone {
+		return false, ErrRecordNotFound
+	}
+
+	if time.Now().After(code.expiry) {
+		delete(m.store.smsCodes, userID)
+		return false, ErrRecordNotFound
+	}
+
+	if code.attempts >= SMSCodeMaxAttempts {
+		return false, ErrTooManyAttempts
+	}
+
+	if matchesCode(code.hash, codePlainText) {
+		delete(m.store.smsCodes, userID)
+		return true, nil
+	}
+
+	code.attempts++
+
+	if code.attempts >= SMSCodeMaxAttempts {
+		return false, ErrTooManyAttempts
+	}
+
+	return false, nil
+}
+
+// MockActivationCodeModel is an in-memory ActivationCodeModeler. See NewMockModels.
+type MockActivationCodeModel struct {
+	store *mockStore
+}
+
+func (m MockActivationCodeModel) New(userID int64, ttl time.Duration) (*ActivationCode, error) {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	return m.new(userID, ttl)
+}
+
+// new implements New, for Register too. The mutex must be held.
+func (m MockActivationCodeModel) new(userID int64, ttl time.Duration) (*ActivationCode, error) {
+	sms, err := generateSMSCode(userID, "", ttl)
+	if err != nil {
+		return nil, err
+	}
+
+	code := &ActivationCode{
+		PlainText: sms.PlainText,
+		Hash:      sms.Hash,
+		UserID:    sms.UserID,
+		Expiry:    sms.Expiry,
+	}
+
+	row := &mockCode{hash: code.Hash, expiry: code.Expiry, attemptsExpiry: code.Expiry}
+
+	if previous, ok := m.store.activationCodes[userID]; ok && !previous.attemptsExpiry.Before(time.Now()) {
+		row.attempts = previous.attempts
+		row.attemptsExpiry = previous.attemptsExpiry
+	}
+
+	m.store.activationCodes[userID] = row
+	return code, nil
+}
+
+func (m MockActivationCodeModel) Verify(userID int64, codePlainText string) (bool, error) {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	code, ok := m.store.activationCodes[userID]
+	if !ok {
+		return false, ErrRecordNotFound
+	}
+
+	if time.Now().After(code.attemptsExpiry) {
+		code.attempts = 0
+		code.attemptsExpiry = code.expiry
+	}
+
+	if code.attempts >= ActivationCodeMaxAttempts {
+		return false, ErrTooManyAttempts
+	}
+
+	if time.Now().After(code.expiry) {
+		return false, ErrRecordNotFound
+	}
+
+	if matchesCode(code.hash, codePlainText) {
+		delete(m.store.activationCodes, userID)
+		return true, nil
+	}
+
+	code.attempts++
+
+	if code.attempts >= ActivationCodeMaxAttempts {
+		return false, ErrTooManyAttempts
+	}
+
+	return false, nil
+}
+
+// MockIdempotencyModel is an in-memory IdempotencyModeler. See NewMockModels.
+type MockIdempotencyModel struct {
+	store *mockStore
+}
+
+func (m MockIdempotencyModel) Reserve(key, requestHash string, ttl time.Duration) (bool, error) {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	if record, ok := m.store.idempotencyKeys[key]; ok && !record.Expiry.Before(time.Now()) {
+		return false, nil
+	}
+
+	m.store.idempotencyKeys[key] = &mockIdempotencyRecord{
+		IdempotencyRecord: IdempotencyRecord{
+			Key:         key,
+			RequestHash: requestHash,
+			Expiry:      time.Now().Add(ttl),
+		},
+	}
+
+	return true, nil
+}
+
+func (m MockIdempotencyModel) Get(key string) (*IdempotencyRecord, error) {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	record, ok := m.store.idempotencyKeys[key]
+	if !ok || !record.Expiry.After(time.Now()) {
+		return nil, ErrRecordNotFound
+	}
+
+	c := record.IdempotencyRecord
+	c.Response = append([]byte(nil), record.Response...)
+	return &c, nil
+}
+
+func (m MockIdempotencyModel) Complete(key string, userID int64, statusCode int, response []byte) error {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	if record, ok := m.store.idempotencyKeys[key]; ok {
+		record.StatusCode = statusCode
+		record.Response = append([]byte(nil), response...)
+		record.userID = userID
+	}
+
+	return nil
+}
+
+func (m MockIdempotencyModel) Delete(key string) error {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	delete(m.store.idempotencyKeys, key)
+	return nil
+}
+
+// MockScheduledEmailModel is an in-memory ScheduledEmailModeler. See NewMockModels.
+type MockScheduledEmailModel struct {
+	store *mockStore
+}
+
+// copyScheduledEmail returns a copy of the stored email for the caller.
+func copyScheduledEmail(email *mockScheduledEmail) (*ScheduledEmail, error) {
+	c := email.ScheduledEmail
+
+	data, err := copyEmailData(email.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	c.Data = data
+	return &c, nil
+}
+
+func (m MockScheduledEmailModel) Insert(email *ScheduledEmail) error {
+	data, err := copyEmailData(email.Data)
+	if err != nil {
+		return err
+	}
+
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	if email.DedupeKey != "" {
+		for _, other := range m.store.scheduledEmails {
+			if other.DedupeKey == email.DedupeKey {
+				return ErrDuplicateScheduledEmail
+			}
+		}
+	}
+
+	email.ID = m.store.id()
+	email.CreatedAt = time.Now()
+	email.Status = "pending"
+
+	row := &mockScheduledEmail{ScheduledEmail: *email}
+	row.Data = data
+
+	m.store.scheduledEmails[email.ID] = row
+	return nil
+}
+
+// claim marks the email as being sent. The mutex must be held.
+func (m MockScheduledEmailModel) claim(email *mockScheduledEmail) {
+	email.Status = "sending"
+	email.Attempts++
+	email.claimedAt = time.Now()
+}
+
+func (m MockScheduledEmailModel) ClaimDue(limit int) ([]*ScheduledEmail, error) {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	var due []*mockScheduledEmail
+
+	for _, email := range m.store.scheduledEmails {
+		if email.Status == "pending" && !email.SendAt.After(time.Now()) {
+			due = append(due, email)
+		}
+	}
+
+	sort.Slice(due, func(i, j int) bool {
+		return due[i].SendAt.Before(due[j].SendAt)
+	})
+
+	if len(due) > limit {
+		due = due[:limit]
+	}
+
+	emails := []*ScheduledEmail{}
+
+	for _, email := range due {
+		m.claim(email)
+
+		c, err := copyScheduledEmail(email)
+		if err != nil {
+			return nil, err
+		}
+
+		emails = append(emails, c)
+	}
+
+	return emails, nil
+}
+
+func (m MockScheduledEmailModel) ClaimFailed(id int64) (*ScheduledEmail, error) {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	email, ok := m.store.scheduledEmails[id]
+	if !ok || email.Status != "failed" {
+		return nil, ErrRecordNotFound
+	}
+
+	m.claim(email)
+	return copyScheduledEmail(email)
+}
+
+func (m MockScheduledEmailModel) MarkSent(id int64) error {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	if email, ok := m.store.scheduledEmails[id]; ok {
+		email.Status = "sent"
+		email.LastError = ""
+	}
+
+	return nil
+}
+
+func (m MockScheduledEmailModel) MarkFailed(id int64, sendErr error, retryAt *time.Time) error {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	email, ok := m.store.scheduledEmails[id]
+	if !ok {
+		return nil
+	}
+
+	email.LastError = sendErr.Error()
+
+	if retryAt != nil {
+		email.Status = "pending"
+		email.SendAt = *retryAt
+	} else {
+		email.Status = "failed"
+	}
+
+	return nil
+}
+
+func (m MockScheduledEmailModel) FailStale(olderThan time.Duration) ([]int64, error) {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	cutoff := time.Now().Add(-olderThan)
+	ids := []int64{}
+
+	for id, email := range m.store.scheduledEmails {
+		if email.Status == "sending" && email.claimedAt.Before(cutoff) {
+			email.Status = "failed"
+			email.LastError = ErrStaleSending.Error()
+			ids = append(ids, id)
+		}
+	}
+
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
+
+// MockOutboxModel is an in-memory OutboxModeler. See NewMockModels.
+type MockOutboxModel struct {
+	store *mockStore
+}
+
+func (m MockOutboxModel) Claim(limit int, lockFor time.Duration) ([]*OutboxEmail, error) {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	var ids []int64
+	for id, email := range m.store.outbox {
+		if email.lockedUntil.Before(time.Now()) && email.Attempts < OutboxMaxAttempts {
+			ids = append(ids, id)
+		}
+	}
+
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	if len(ids) > limit {
+		ids = ids[:limit]
+	}
+
+	emails := []*OutboxEmail{}
+
+	for _, id := range ids {
+		email := m.store.outbox[id]
+		email.lockedUntil = time.Now().Add(lockFor)
+		email.Attempts++
+
+		c := email.OutboxEmail
+
+		data, err := copyEmailData(email.Data)
+		if err != nil {
+			return nil, err
+		}
+
+		c.Data = data
+		emails = append(emails, &c)
+	}
+
+	return emails, nil
+}
+
+func (m MockOutboxModel) Delete(id int64) error {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	delete(m.store.outbox, id)
+	return nil
+}
+
+// MockSuppressionModel is an in-memory SuppressionModeler. See NewMockModels.
+// Addresses are compared case-insensitively, as the citext column does.
+type MockSuppressionModel struct {
+	store *mockStore
+}
+
+func (m MockSuppressionModel) Add(email, reason string) error {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	m.store.suppressed[strings.ToLower(email)] = reason
+	return nil
+}
+
+func (m MockSuppressionModel) IsSuppressed(email string) (bool, error) {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	_, ok := m.store.suppressed[strings.ToLower(email)]
+	return ok, nil
+}
+
+func (m MockSuppressionModel) Remove(email string) error {
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	delete(m.store.suppressed, strings.ToLower(email))
+	return nil
+}
@@ -0,0 +1,124 @@
+package data
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestMockModelsUserLifecycle(t *testing.T) {
+	models := NewMockModels()
+
+	user := &User{Name: "Alice", Email: "alice@example.com"}
+	if err := user.Password.Set(models.Hasher, "pa55word1234"); err != nil {
+		t.Fatal(err)
+	}
+
+	err := models.Users.Register(user, []string{"movies:read"}, time.Hour, 0, "user_welcome.tmpl", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = models.Users.Register(&User{Name: "Alice", Email: "ALICE@example.com"}, nil, time.Hour, 0, "user_welcome.tmpl", nil)
+	if !errors.Is(err, ErrDuplicateEmail) {
+		t.Errorf("registering the same email again: got %v; want ErrDuplicateEmail", err)
+	}
+
+	// Register put the welcome email in the outbox, with the activation token.
+	emails, err := models.Outbox.Claim(10, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(emails) != 1 || emails[0].Recipient != user.Email {
+		t.Fatalf("got outbox %+v; want the welcome email to %s", emails, user.Email)
+	}
+
+	activationToken, _ := emails[0].Data["activationToken"].(string)
+
+	activated, err := models.Users.ActivateByToken(activationToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !activated.Activated || activated.Status != StatusActive {
+		t.Errorf("got activated %t, status %q; want an active user", activated.Activated, activated.Status)
+	}
+
+	_, err = models.Users.ActivateByToken(activationToken)
+	if !errors.Is(err, ErrTokenUsed) {
+		t.Errorf("reusing the activation token: got %v; want ErrTokenUsed", err)
+	}
+
+	session, err := models.Tokens.New(user.ID, time.Hour, ScopeAuthentication)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, permissions, err := models.Users.GetForTokenWithPermissions(ScopeAuthentication, session.PlainText)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !permissions.Include("movies:read") {
+		t.Errorf("got permissions %v; want movies:read", permissions)
+	}
+
+	revoked, err := models.Users.SetStatus(activated, StatusSuspended)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if revoked != 2 {
+		t.Errorf("suspending the user revoked %d tokens; want 2", revoked)
+	}
+
+	if _, err := models.Users.GetForToken(ScopeAuthentication, session.PlainText); !errors.Is(err, ErrTokenNotFound) {
+		t.Errorf("using a revoked session: got %v; want ErrTokenNotFound", err)
+	}
+
+	err = models.Users.Erase(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := models.Users.Get(user.ID); !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("getting an erased user: got %v; want ErrRecordNotFound", err)
+	}
+}
+
+func TestMockModelsMergeMovesEmails(t *testing.T) {
+	models := NewMockModels()
+
+	source := &User{Name: "Alice", Email: "alice@example.com"}
+	target := &User{Name: "Alice Smith", Email: "alice.smith@example.com", Activated: true}
+
+	for _, user := range []*User{source, target} {
+		if err := models.Users.Insert(user); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	email := &ScheduledEmail{Recipient: source.Email, Template: "reminder.tmpl", SendAt: time.Now().Add(-time.Minute)}
+	if err := models.ScheduledEmails.Insert(email); err != nil {
+		t.Fatal(err)
+	}
+
+	err := models.Users.Merge(source.ID, target.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	due, err := models.ScheduledEmails.ClaimDue(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(due) != 1 || due[0].Recipient != target.Email {
+		t.Errorf("got scheduled emails %+v; want one to %s", due, target.Email)
+	}
+
+	if _, err := models.Users.Get(source.ID); !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("getting the merged user: got %v; want ErrRecordNotFound", err)
+	}
+}
@@ -3,6 +3,7 @@ package data
 import (
 	"database/sql"
 	"errors"
+	"time"
 )
 
 // Define a custom ErrRecordNotFound error. We'll return this from our Get() method when
@@ -12,18 +13,126 @@ var (
 	ErrEditConflict   = errors.New("edit conflict")
 )
 
+// Config holds the settings for the models which can be tuned at startup.
+type Config struct {
+	// The number of previous password hashes to remember for each user. A value of 0
+	// disables the password reuse check.
+	PasswordHistory int
+
+	// The PasswordHasher used to hash and check every password. Defaults to bcrypt with
+	// DefaultBcryptCost.
+	Hasher PasswordHasher
+
+	// The encoding used for new token plaintexts. Defaults to base32.
+	TokenEncoding TokenEncoding
+
+	// How long after expiry a token is still accepted, to allow for clock skew between
+	// servers. Note that this extends the lifetime of every token (including a stolen
+	// one) by the same amount, so it should be kept small. Defaults to 0.
+	TokenExpiryGracePeriod time.Duration
+
+	// If AutoActivate is true, new users are activated as soon as they are inserted,
+	// for deployments which don't verify email addresses. Defaults to false.
+	AutoActivate bool
+
+	// The secret key for Models.EmailHasher, which hashes email addresses so that they
+	// can be logged without revealing them. It should be set whenever the hashes are
+	// used, since without a key they are easily reversed for known addresses.
+	EmailHashKey []byte
+
+	// The secret key for hashing tokens with HMAC-SHA256 before they are stored. If it is
+	// empty, tokens are hashed with plain SHA-256. Once it is set, existing tokens are
+	// re-hashed as they are used, so it mustn't be removed again, or those tokens will
+	// stop working.
+	TokenHashKey []byte
+
+	// The secret key for Models.TokenSigner. If it is empty, activation tokens aren't
+	// signed.
+	TokenSigningKey []byte
+
+	// Counters for the writes made by the user and token models. Both are optional.
+	UserMetrics  ModelMetrics
+	TokenMetrics ModelMetrics
+
+	// If UserCacheTTL is more than 0, users looked up by email are cached for that long,
+	// with at most UserCacheSize users held at a time.
+	UserCacheTTL  time.Duration
+	UserCacheSize int
+}
+
+// Models wraps all of the models in one place, so that handlers only need
+// app.models. Each field is an interface rather than the concrete model, so any of
+// them can be swapped for another implementation (as NewModels does for the user cache,
+// and NewMockModels does for tests).
 type Models struct {
-	Movies      MovieModeler
-	Users       UserModeler
-	Tokens      TokenModeler
-	Permissions PermissionModeler
+	// Hasher is the PasswordHasher from the Config, for handlers which set, check or
+	// validate passwords.
+	Hasher PasswordHasher
+
+	// EmailHasher hashes email addresses with the Config's EmailHashKey.
+	EmailHasher EmailHasher
+
+	// TokenSigner signs and verifies activation tokens with the Config's
+	// TokenSigningKey.
+	TokenSigner TokenSigner
+
+	Movies          MovieModeler
+	Users           UserModeler
+	Tokens          TokenModeler
+	Permissions     PermissionModeler
+	SMSCodes        SMSCodeModeler
+	Idempotency     IdempotencyModeler
+	ScheduledEmails ScheduledEmailModeler
+	Outbox          OutboxModeler
+	Suppressions    SuppressionModeler
+	ActivationCodes ActivationCodeModeler
 }
 
-func NewModels(db *sql.DB) Models {
-	return Models{
+func NewModels(db *sql.DB, cfg Config) Models {
+	if cfg.Hasher == nil {
+		cfg.Hasher = defaultHasher
+	}
+
+	models := Models{
+		Hasher:      cfg.Hasher,
+		EmailHasher: EmailHasher{Key: cfg.EmailHashKey},
+		TokenSigner: TokenSigner{Key: cfg.TokenSigningKey},
 		Movies:      MovieModel{DB: db},
-		Users:       UserModel{DB: db},
-		Tokens:      TokenModel{DB: db},
-		Permissions: PermissionModel{DB: db},
+		Users: UserModel{
+			DB:                     db,
+			Hasher:                 cfg.Hasher,
+			PasswordHistory:        cfg.PasswordHistory,
+			TokenExpiryGracePeriod: cfg.TokenExpiryGracePeriod,
+			TokenEncoding:          cfg.TokenEncoding,
+			TokenHashKey:           cfg.TokenHashKey,
+			AutoActivate:           cfg.AutoActivate,
+			Metrics:                cfg.UserMetrics.withDefaults(),
+		},
+		Tokens: TokenModel{
+			DB:                db,
+			Encoding:          cfg.TokenEncoding,
+			HashKey:           cfg.TokenHashKey,
+			ExpiryGracePeriod: cfg.TokenExpiryGracePeriod,
+			Metrics:           cfg.TokenMetrics.withDefaults(),
+		},
+		Permissions:     PermissionModel{DB: db},
+		SMSCodes:        SMSCodeModel{DB: db},
+		Idempotency:     IdempotencyModel{DB: db},
+		ScheduledEmails: ScheduledEmailModel{DB: db},
+		Outbox:          OutboxModel{DB: db},
+		Suppressions:    SuppressionModel{DB: db},
+		ActivationCodes: ActivationCodeModel{DB: db},
 	}
+
+	if cfg.UserCacheTTL > 0 && cfg.UserCacheSize > 0 {
+		models.Users = NewCachedUserModel(models.Users, cfg.UserCacheTTL, cfg.UserCacheSize)
+	}
+
+	return models
+}
+
+// EraseUser is the "right to be forgotten" counterpart to UserModel.ExportData. It
+// deletes the user and everything that belongs to them in a single transaction.
+func (m Models) EraseUser(id int64) error {
+	return m.Users.Erase(id)
 }
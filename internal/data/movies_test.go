@@ -0,0 +1,31 @@
+package data
+
+import (
+	"testing"
+
+	"github.com/bal3000/greenlight/internal/validator"
+)
+
+func TestValidateMovieGenres(t *testing.T) {
+	tests := []struct {
+		genres []string
+		want   string
+	}{
+		{genres: nil, want: "must be provided"},
+		{genres: []string{}, want: "must contain between 1 and 5 genres"},
+		{genres: []string{"drama"}},
+		{genres: []string{"a", "b", "c", "d", "e"}},
+		{genres: []string{"a", "b", "c", "d", "e", "f"}, want: "must contain between 1 and 5 genres"},
+	}
+
+	for _, tt := range tests {
+		movie := &Movie{Title: "Casablanca", Year: 1942, Runtime: 102, Genres: tt.genres}
+
+		v := validator.New()
+		ValidateMovie(v, movie)
+
+		if got := v.Errors["genres"]; got != tt.want {
+			t.Errorf("%d genres: got error %q; want %q", len(tt.genres), got, tt.want)
+		}
+	}
+}
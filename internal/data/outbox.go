@@ -0,0 +1,116 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+)
+
+// The number of times the relay will try to send an outbox email before giving up.
+const OutboxMaxAttempts = 5
+
+// OutboxEmail is an email which was written to the outbox in the same transaction as
+// the database change that it relates to. The relay sends it and then deletes it, so
+// an email is sent if (and only if) the change was committed.
+type OutboxEmail struct {
+	ID        int64
+	CreatedAt time.Time
+	Recipient string
+	Template  string
+	Data      map[string]interface{}
+	Attempts  int
+}
+
+type OutboxModel struct {
+	DB *sql.DB
+}
+
+type OutboxModeler interface {
+	Claim(limit int, lockFor time.Duration) ([]*OutboxEmail, error)
+	Delete(id int64) error
+}
+
+// insertOutboxEmail writes an email to the outbox as part of an existing transaction.
+func insertOutboxEmail(ctx context.Context, tx *sql.Tx, email *OutboxEmail) error {
+	js, err := json.Marshal(email.Data)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		INSERT INTO email_outbox (recipient, template, data)
+		VALUES ($1, $2, $3)
+		RETURNING id, created_at`
+
+	return tx.QueryRowContext(ctx, query, email.Recipient, email.Template, js).Scan(&email.ID, &email.CreatedAt)
+}
+
+// Claim locks up to limit outbox emails for sending. A claimed email won't be claimed
+// again until lockFor has passed, so if the relay fails to send (or crashes) the email
+// is retried later. This gives at-least-once delivery. Emails which have already been
+// tried OutboxMaxAttempts times are left alone.
+func (m OutboxModel) Claim(limit int, lockFor time.Duration) ([]*OutboxEmail, error) {
+	query := `
+		UPDATE email_outbox
+		SET locked_until = $1, attempts = attempts + 1
+		WHERE id IN (
+			SELECT id FROM email_outbox
+			WHERE (locked_until IS NULL OR locked_until < NOW()) AND attempts < $2
+			ORDER BY id
+			LIMIT $3
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, created_at, recipient, template, data, attempts`
+
+	args := []interface{}{time.Now().Add(lockFor), OutboxMaxAttempts, limit}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	emails := []*OutboxEmail{}
+
+	for rows.Next() {
+		var (
+			email OutboxEmail
+			js    []byte
+		)
+
+		err := rows.Scan(&email.ID, &email.CreatedAt, &email.Recipient, &email.Template, &js, &email.Attempts)
+		if err != nil {
+			return nil, err
+		}
+
+		err = json.Unmarshal(js, &email.Data)
+		if err != nil {
+			return nil, err
+		}
+
+		emails = append(emails, &email)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return emails, nil
+}
+
+// Delete removes an email from the outbox once it has been sent.
+func (m OutboxModel) Delete(id int64) error {
+	query := `
+		DELETE FROM email_outbox
+		WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, id)
+	return err
+}
@@ -24,6 +24,8 @@ func (p Permissions) Include(code string) bool {
 type PermissionModeler interface {
 	GetAllForUser(userID int64) (Permissions, error)
 	AddForUser(userID int64, codes ...string) error
+	AddForUserUntil(userID int64, until time.Time, codes ...string) error
+	DeleteExpired() (int64, error)
 }
 
 type PermissionModel struct {
@@ -31,14 +33,15 @@ type PermissionModel struct {
 }
 
 // The GetAllForUser() method returns all permission codes for a specific user in a
-// Permissions slice.
+// Permissions slice. Grants which have expired are left out.
 func (m PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
 	query := `
 		SELECT permissions.code
 		FROM permissions
 		INNER JOIN users_permissions ON users_permissions.permission_id = permissions.id
 		INNER JOIN users ON users_permissions.user_id = users.id
-		WHERE users.id = $1`
+		WHERE users.id = $1
+		AND (users_permissions.expires_at IS NULL OR users_permissions.expires_at > NOW())`
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
@@ -69,11 +72,15 @@ func (m PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
 	return permissions, nil
 }
 
-// Add the provided permission codes for a specific user
+// Add the provided permission codes for a specific user. If the user already has a
+// temporary grant of one of the permissions (see AddForUserUntil), it is made
+// permanent.
 func (m PermissionModel) AddForUser(userID int64, codes ...string) error {
 	query := `
-		INSERT INTO users_permissions
-		SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)`
+		INSERT INTO users_permissions (user_id, permission_id)
+		SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)
+		ON CONFLICT (user_id, permission_id) DO UPDATE
+		SET expires_at = NULL`
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
@@ -81,3 +88,42 @@ func (m PermissionModel) AddForUser(userID int64, codes ...string) error {
 	_, err := m.DB.ExecContext(ctx, query, userID, pq.Array(codes))
 	return err
 }
+
+// AddForUserUntil grants the permission codes to a user until the given time, e.g. for
+// temporary admin access. If the user already has one of the permissions, a permanent
+// grant is left as it is, and a temporary one is extended (but never shortened).
+func (m PermissionModel) AddForUserUntil(userID int64, until time.Time, codes ...string) error {
+	query := `
+		INSERT INTO users_permissions (user_id, permission_id, expires_at)
+		SELECT $1, permissions.id, $3 FROM permissions WHERE permissions.code = ANY($2)
+		ON CONFLICT (user_id, permission_id) DO UPDATE
+		SET expires_at = CASE
+			WHEN users_permissions.expires_at IS NULL THEN NULL
+			ELSE GREATEST(users_permissions.expires_at, EXCLUDED.expires_at)
+		END`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID, pq.Array(codes), until)
+	return err
+}
+
+// DeleteExpired removes the grants which have expired, returning how many were
+// removed. Expired grants are already ignored by GetAllForUser, so this just keeps the
+// table tidy.
+func (m PermissionModel) DeleteExpired() (int64, error) {
+	query := `
+		DELETE FROM users_permissions
+		WHERE expires_at <= NOW()`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
@@ -0,0 +1,122 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/bal3000/greenlight/internal/validator"
+)
+
+// The categories of non-essential email that a user can opt out of. Transactional
+// emails (activation, security notices and so on) don't have a category, and are
+// always sent.
+const (
+	EmailCategoryNewsletter     = "newsletter"
+	EmailCategoryProductUpdates = "product_updates"
+	EmailCategoryReminders      = "reminders"
+)
+
+var EmailCategories = []string{EmailCategoryNewsletter, EmailCategoryProductUpdates, EmailCategoryReminders}
+
+// EmailPreferences records whether a user wants to receive each category of
+// non-essential email. Categories which aren't in the map are opted in.
+type EmailPreferences map[string]bool
+
+// Allows reports whether the user wants emails in the given category.
+func (p EmailPreferences) Allows(category string) bool {
+	optedIn, ok := p[category]
+	return !ok || optedIn
+}
+
+// Value implements the driver.Valuer interface. A nil map is stored as an empty JSON
+// object.
+func (p EmailPreferences) Value() (driver.Value, error) {
+	if p == nil {
+		return []byte("{}"), nil
+	}
+
+	return json.Marshal(p)
+}
+
+// Scan implements the sql.Scanner interface, unmarshalling the JSONB column.
+func (p *EmailPreferences) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case nil:
+		*p = nil
+		return nil
+	case []byte:
+		return json.Unmarshal(v, p)
+	case string:
+		return json.Unmarshal([]byte(v), p)
+	default:
+		return fmt.Errorf("unsupported type for email preferences: %T", src)
+	}
+}
+
+func ValidateEmailPreferences(v *validator.Validator, prefs EmailPreferences) {
+	for category := range prefs {
+		v.Check(validator.In(category, EmailCategories...), "email_preferences", fmt.Sprintf("unknown category %q", category))
+	}
+}
+
+// GetEmailPreferences returns the user's email preferences.
+func (m UserModel) GetEmailPreferences(id int64) (EmailPreferences, error) {
+	query := `
+		SELECT email_preferences
+		FROM users
+		WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var prefs EmailPreferences
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(&prefs)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	if prefs == nil {
+		prefs = EmailPreferences{}
+	}
+
+	return prefs, nil
+}
+
+// SetEmailPreferences merges the given preferences into the user's existing ones, so
+// that a client can change one category without having to send the others.
+func (m UserModel) SetEmailPreferences(id int64, prefs EmailPreferences) error {
+	query := `
+		UPDATE users
+		SET email_preferences = email_preferences || $1::jsonb
+		WHERE id = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, prefs, id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
@@ -0,0 +1,29 @@
+package data
+
+import (
+	"fmt"
+	"time"
+)
+
+// ErrRateLimited is returned by throttled operations when they've been tried again too
+// soon. RetryAfter is how long the caller has to wait before the operation is allowed,
+// so that handlers can pass it on in a Retry-After header. Check for it with
+// errors.As.
+type ErrRateLimited struct {
+	RetryAfter time.Duration
+}
+
+func (e *ErrRateLimited) Error() string {
+	return fmt.Sprintf("rate limited: retry after %s", e.RetryAfter)
+}
+
+// throttle returns an *ErrRateLimited if less than interval has passed between last
+// (the last time the operation was done, or the zero time if it never has been) and
+// now, or nil if the operation can go ahead.
+func throttle(last time.Time, interval time.Duration, now time.Time) error {
+	if wait := interval - now.Sub(last); wait > 0 {
+		return &ErrRateLimited{RetryAfter: wait}
+	}
+
+	return nil
+}
@@ -0,0 +1,44 @@
+package data
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestThrottle(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name      string
+		last      time.Time
+		wantRetry time.Duration // 0 means not rate limited
+	}{
+		{name: "never done", last: time.Time{}},
+		{name: "done long ago", last: now.Add(-time.Hour)},
+		{name: "done exactly interval ago", last: now.Add(-time.Minute)},
+		{name: "done just now", last: now, wantRetry: time.Minute},
+		{name: "done part way through interval", last: now.Add(-20 * time.Second), wantRetry: 40 * time.Second},
+	}
+
+	for _, tt := range tests {
+		err := throttle(tt.last, time.Minute, now)
+
+		if tt.wantRetry == 0 {
+			if err != nil {
+				t.Errorf("%s: got error %v; want nil", tt.name, err)
+			}
+			continue
+		}
+
+		var rateLimited *ErrRateLimited
+		if !errors.As(err, &rateLimited) {
+			t.Errorf("%s: got error %v; want *ErrRateLimited", tt.name, err)
+			continue
+		}
+
+		if rateLimited.RetryAfter != tt.wantRetry {
+			t.Errorf("%s: got RetryAfter %s; want %s", tt.name, rateLimited.RetryAfter, tt.wantRetry)
+		}
+	}
+}
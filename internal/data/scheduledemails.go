@@ -0,0 +1,300 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+const (
+	ScheduledEmailPending = "pending"
+	ScheduledEmailSending = "sending"
+	ScheduledEmailSent    = "sent"
+	ScheduledEmailFailed  = "failed"
+)
+
+// ScheduledEmail is an email which has been queued for delivery at a later time. Data
+// holds the template data, and is stored as JSON. If DedupeKey is set, at most one
+// email is ever scheduled with that key (e.g. one activation reminder per user).
+type ScheduledEmail struct {
+	ID        int64
+	CreatedAt time.Time
+	Recipient string
+	Template  string
+	Data      map[string]interface{}
+	SendAt    time.Time
+	Status    string
+	Attempts  int
+	LastError string
+	DedupeKey string
+}
+
+// ErrDuplicateScheduledEmail is returned by Insert when an email with the same
+// DedupeKey has already been scheduled.
+var ErrDuplicateScheduledEmail = errors.New("email has already been scheduled")
+
+// NextLocalTime returns the next time after now that the clock reads hour:minute in
+// the given IANA time zone, in UTC. Daylight saving changes are handled by the time
+// package: a time that's skipped when the clocks go forward is moved on by the size of
+// the gap.
+func NextLocalTime(now time.Time, timezone string, hour, minute int) (time.Time, error) {
+	loc, err := time.LoadLocation(timezone)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	local := now.In(loc)
+	next := time.Date(local.Year(), local.Month(), local.Day(), hour, minute, 0, 0, loc)
+
+	if !next.After(now) {
+		next = time.Date(local.Year(), local.Month(), local.Day()+1, hour, minute, 0, 0, loc)
+	}
+
+	return next.UTC(), nil
+}
+
+type ScheduledEmailModel struct {
+	DB *sql.DB
+}
+
+type ScheduledEmailModeler interface {
+	Insert(email *ScheduledEmail) error
+	ClaimDue(limit int) ([]*ScheduledEmail, error)
+	ClaimFailed(id int64) (*ScheduledEmail, error)
+	MarkSent(id int64) error
+	MarkFailed(id int64, sendErr error, retryAt *time.Time) error
+	FailStale(olderThan time.Duration) ([]int64, error)
+}
+
+// Insert schedules an email. If the email has a DedupeKey which has been used before,
+// nothing is inserted and ErrDuplicateScheduledEmail is returned.
+func (m ScheduledEmailModel) Insert(email *ScheduledEmail) error {
+	js, err := json.Marshal(email.Data)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		INSERT INTO scheduled_emails (recipient, template, data, send_at, dedupe_key)
+		VALUES ($1, $2, $3, $4, NULLIF($5, ''))
+		ON CONFLICT (dedupe_key) DO NOTHING
+		RETURNING id, created_at, status`
+
+	args := []interface{}{email.Recipient, email.Template, js, email.SendAt, email.DedupeKey}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err = m.DB.QueryRowContext(ctx, query, args...).Scan(&email.ID, &email.CreatedAt, &email.Status)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrDuplicateScheduledEmail
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ClaimDue picks up to limit pending emails which are due to be sent, and marks them as
+// "sending" in the same statement. Because the claim is committed before anything is
+// sent, two reapers can never pick up the same email (SKIP LOCKED), and an email whose
+// reaper crashes part way through a batch is left in the "sending" state rather than
+// being sent a second time after a restart. FailStale finds those emails later, so
+// that they can be checked and retried by hand.
+func (m ScheduledEmailModel) ClaimDue(limit int) ([]*ScheduledEmail, error) {
+	query := `
+		UPDATE scheduled_emails
+		SET status = 'sending', attempts = attempts + 1, claimed_at = NOW()
+		WHERE id IN (
+			SELECT id FROM scheduled_emails
+			WHERE status = 'pending' AND send_at <= NOW()
+			ORDER BY send_at
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, created_at, recipient, template, data, send_at, status, attempts, last_error`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	emails := []*ScheduledEmail{}
+
+	for rows.Next() {
+		var (
+			email ScheduledEmail
+			js    []byte
+		)
+
+		err := rows.Scan(
+			&email.ID,
+			&email.CreatedAt,
+			&email.Recipient,
+			&email.Template,
+			&js,
+			&email.SendAt,
+			&email.Status,
+			&email.Attempts,
+			&email.LastError,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		err = json.Unmarshal(js, &email.Data)
+		if err != nil {
+			return nil, err
+		}
+
+		emails = append(emails, &email)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return emails, nil
+}
+
+// ClaimFailed picks up a single permanently failed email so that it can be sent again,
+// marking it as "sending" and counting the attempt in the same way as ClaimDue. If
+// there is no failed email with the id (including when it has already been claimed),
+// ErrRecordNotFound is returned.
+func (m ScheduledEmailModel) ClaimFailed(id int64) (*ScheduledEmail, error) {
+	query := `
+		UPDATE scheduled_emails
+		SET status = 'sending', attempts = attempts + 1, claimed_at = NOW()
+		WHERE id = $1 AND status = 'failed'
+		RETURNING id, created_at, recipient, template, data, send_at, status, attempts, last_error`
+
+	var (
+		email ScheduledEmail
+		js    []byte
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&email.ID,
+		&email.CreatedAt,
+		&email.Recipient,
+		&email.Template,
+		&js,
+		&email.SendAt,
+		&email.Status,
+		&email.Attempts,
+		&email.LastError,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	err = json.Unmarshal(js, &email.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	return &email, nil
+}
+
+func (m ScheduledEmailModel) MarkSent(id int64) error {
+	query := `
+		UPDATE scheduled_emails
+		SET status = 'sent', last_error = ''
+		WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, id)
+	return err
+}
+
+// MarkFailed records a failed delivery attempt. If retryAt is not nil the email is put
+// back in the pending state to be tried again at that time, otherwise it is marked as
+// permanently failed.
+func (m ScheduledEmailModel) MarkFailed(id int64, sendErr error, retryAt *time.Time) error {
+	query := `
+		UPDATE scheduled_emails
+		SET status = 'failed', last_error = $1
+		WHERE id = $2`
+
+	args := []interface{}{sendErr.Error(), id}
+
+	if retryAt != nil {
+		query = `
+			UPDATE scheduled_emails
+			SET status = 'pending', last_error = $1, send_at = $3
+			WHERE id = $2`
+
+		args = append(args, *retryAt)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, args...)
+	return err
+}
+
+// ErrStaleSending is recorded as the last error of an email which FailStale gives up
+// on.
+var ErrStaleSending = errors.New("interrupted while sending, so it may or may not have been delivered")
+
+// FailStale marks the emails which have been "sending" for longer than olderThan as
+// permanently failed, and returns their ids. An email is only left in that state if
+// whatever claimed it stopped before recording the result, so we can't know whether it
+// was delivered. Rather than risk sending it twice, it is failed with ErrStaleSending,
+// and can be re-sent with ClaimFailed once someone has checked. Emails claimed before
+// claimed_at was recorded are always treated as stale.
+func (m ScheduledEmailModel) FailStale(olderThan time.Duration) ([]int64, error) {
+	query := `
+		UPDATE scheduled_emails
+		SET status = 'failed', last_error = $1
+		WHERE status = 'sending' AND (claimed_at IS NULL OR claimed_at < $2)
+		RETURNING id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, ErrStaleSending.Error(), time.Now().Add(-olderThan))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []int64{}
+
+	for rows.Next() {
+		var id int64
+
+		err := rows.Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+
+		ids = append(ids, id)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return ids, nil
+}
@@ -0,0 +1,208 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/bal3000/greenlight/internal/validator"
+)
+
+// The maximum number of times a user can try to enter their code. The count is kept
+// until the code expires, even if a new code is sent, so that requesting more codes
+// doesn't give more guesses.
+const SMSCodeMaxAttempts = 5
+
+var ErrTooManyAttempts = errors.New("too many attempts")
+
+type SMSCode struct {
+	PlainText string
+	Hash      []byte
+	UserID    int64
+	Phone     string
+	Expiry    time.Time
+}
+
+// generateSMSCode creates a new random 6-digit numeric code. As with tokens, we only
+// ever store the SHA-256 hash of the code.
+func generateSMSCode(userID int64, phone string, ttl time.Duration) (*SMSCode, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1_000_000))
+	if err != nil {
+		return nil, err
+	}
+
+	code := &SMSCode{
+		PlainText: fmt.Sprintf("%06d", n.Int64()),
+		UserID:    userID,
+		Phone:     phone,
+		Expiry:    time.Now().Add(ttl),
+	}
+
+	hash := sha256.Sum256([]byte(code.PlainText))
+	code.Hash = hash[:]
+
+	return code, nil
+}
+
+// Check that the plaintext code has been provided and is exactly 6 digits.
+func ValidateSMSCodePlainText(v *validator.Validator, codePlainText string) {
+	v.Check(codePlainText != "", "code", "must be provided")
+	v.Check(len(codePlainText) == 6 && strings.Trim(codePlainText, "0123456789") == "", "code", "must be 6 digits")
+}
+
+type SMSCodeModel struct {
+	DB *sql.DB
+}
+
+type SMSCodeModeler interface {
+	New(userID int64, phone string, ttl time.Duration) (*SMSCode, error)
+	Verify(userID int64, phone, codePlainText string) (bool, error)
+	ThrottleSend(userID int64, phone string, interval time.Duration) error
+}
+
+// New generates a code for the user and stores it, replacing any code that they had
+// previously been sent. The attempts made against the previous code carry over if it
+// hasn't expired yet. The caller is responsible for delivering the plaintext code via
+// an sms.SMSSender.
+func (m SMSCodeModel) New(userID int64, phone string, ttl time.Duration) (*SMSCode, error) {
+	code, err := generateSMSCode(userID, phone, ttl)
+	if err != nil {
+		return nil, err
+	}
+
+	query := `
+		INSERT INTO sms_codes (user_id, hash, phone, expiry, attempts, sent_at)
+		VALUES ($1, $2, $3, $4, 0, NOW())
+		ON CONFLICT (user_id) DO UPDATE
+		SET hash = EXCLUDED.hash, phone = EXCLUDED.phone, expiry = EXCLUDED.expiry, sent_at = EXCLUDED.sent_at,
+			attempts = CASE WHEN sms_codes.expiry > NOW() THEN sms_codes.attempts ELSE 0 END`
+
+	args := []interface{}{code.UserID, code.Hash, code.Phone, code.Expiry}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err = m.DB.ExecContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	return code, nil
+}
+
+// ThrottleSend checks that at least interval has passed since a code was last sent to
+// the user, and since one was last sent to the phone number (for any user), so that
+// the endpoint can't be used to flood someone's phone with messages. If it hasn't, it
+// returns an *ErrRateLimited saying how much longer the caller has to wait.
+func (m SMSCodeModel) ThrottleSend(userID int64, phone string, interval time.Duration) error {
+	query := `
+		SELECT MAX(sent_at)
+		FROM sms_codes
+		WHERE user_id = $1 OR phone = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	// As in LastIssuedForUser, MAX() returns NULL when there are no matching rows,
+	// which leaves lastSent as the zero time.
+	var lastSent sql.NullTime
+
+	err := m.DB.QueryRowContext(ctx, query, userID, phone).Scan(&lastSent)
+	if err != nil {
+		return err
+	}
+
+	return throttle(lastSent.Time, interval, time.Now())
+}
+
+// Verify checks the code entered by the user, which must have been sent to the given
+// phone number. Codes are single use, so a correct code is deleted straight away. An
+// incorrect code counts as a failed attempt, and once SMSCodeMaxAttempts is reached
+// ErrTooManyAttempts is returned until the code expires. If there is no unexpired code
+// for the user and phone number, ErrRecordNotFound is returned.
+func (m SMSCodeModel) Verify(userID int64, phone, codePlainText string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	query := `
+		SELECT hash, expiry, attempts
+		FROM sms_codes
+		WHERE user_id = $1 AND phone = $2
+		FOR UPDATE`
+
+	var (
+		hash     []byte
+		expiry   time.Time
+		attempts int
+	)
+
+	err = tx.QueryRowContext(ctx, query, userID, phone).Scan(&hash, &expiry, &attempts)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return false, ErrRecordNotFound
+		default:
+			return false, err
+		}
+	}
+
+	if time.Now().After(expiry) {
+		_, err = tx.ExecContext(ctx, "DELETE FROM sms_codes WHERE user_id = $1", userID)
+		if err != nil {
+			return false, err
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			return false, err
+		}
+
+		return false, ErrRecordNotFound
+	}
+
+	if attempts >= SMSCodeMaxAttempts {
+		return false, ErrTooManyAttempts
+	}
+
+	codeHash := sha256.Sum256([]byte(codePlainText))
+
+	if subtle.ConstantTimeCompare(codeHash[:], hash) == 1 {
+		_, err = tx.ExecContext(ctx, "DELETE FROM sms_codes WHERE user_id = $1", userID)
+		if err != nil {
+			return false, err
+		}
+
+		return true, tx.Commit()
+	}
+
+	attempts++
+
+	_, err = tx.ExecContext(ctx, "UPDATE sms_codes SET attempts = $1 WHERE user_id = $2", attempts, userID)
+	if err != nil {
+		return false, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return false, err
+	}
+
+	if attempts >= SMSCodeMaxAttempts {
+		return false, ErrTooManyAttempts
+	}
+
+	return false, nil
+}
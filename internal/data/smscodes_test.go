@@ -0,0 +1,33 @@
+package data
+
+import (
+	"testing"
+
+	"github.com/bal3000/greenlight/internal/validator"
+)
+
+func TestValidateSMSCodePlainText(t *testing.T) {
+	tests := []struct {
+		code  string
+		valid bool
+	}{
+		{code: "123456", valid: true},
+		{code: "000000", valid: true},
+		{code: ""},
+		{code: "12345"},
+		{code: "1234567"},
+		{code: "12345a"},
+		{code: "12 456"},
+		{code: "-12345"},
+		{code: "١٢٣٤٥٦"}, // Arabic-Indic digits
+	}
+
+	for _, tt := range tests {
+		v := validator.New()
+		ValidateSMSCodePlainText(v, tt.code)
+
+		if v.Valid() != tt.valid {
+			t.Errorf("ValidateSMSCodePlainText(%q): got valid %t; want %t", tt.code, v.Valid(), tt.valid)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package data
+
+import (
+	"github.com/bal3000/greenlight/internal/validator"
+)
+
+// Status is the lifecycle state of a user account.
+type Status string
+
+const (
+	StatusPending   Status = "pending"   // registered, but not yet activated
+	StatusActive    Status = "active"    // activated
+	StatusSuspended Status = "suspended" // blocked by an admin
+	StatusDeleted   Status = "deleted"   // closed; can't be reopened
+)
+
+// statusTransitions lists, for each status, the statuses that it can move to. Note
+// that a suspended account can only be reinstated to active by an explicit transition,
+// never by activating it again.
+var statusTransitions = map[Status][]Status{
+	StatusPending:   {StatusActive, StatusDeleted},
+	StatusActive:    {StatusSuspended, StatusDeleted},
+	StatusSuspended: {StatusActive, StatusDeleted},
+	StatusDeleted:   {},
+}
+
+// StatusOf returns the status that a new user starts in, given their activated flag.
+// After that the status is changed with UserModel.SetStatus.
+func StatusOf(user *User) Status {
+	if user.Activated {
+		return StatusActive
+	}
+
+	return StatusPending
+}
+
+// ValidateStatusTransition checks that a user can move from one status to another.
+// Staying in the same status is always allowed.
+func ValidateStatusTransition(v *validator.Validator, from, to Status) {
+	allowed, ok := statusTransitions[from]
+	if !ok {
+		v.AddErrorf("status", "unknown status %q", from)
+		return
+	}
+
+	if _, ok := statusTransitions[to]; !ok {
+		v.AddErrorf("status", "unknown status %q", to)
+		return
+	}
+
+	if from == to {
+		return
+	}
+
+	for _, status := range allowed {
+		if status == to {
+			return
+		}
+	}
+
+	v.AddErrorf("status", "cannot change from %s to %s", from, to)
+}
@@ -0,0 +1,73 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/bal3000/greenlight/internal/validator"
+)
+
+// The reasons for which an address can be suppressed.
+const (
+	SuppressionBounce    = "bounce"
+	SuppressionComplaint = "complaint"
+)
+
+func ValidateSuppressionReason(v *validator.Validator, reason string) {
+	v.Check(validator.In(reason, SuppressionBounce, SuppressionComplaint), "reason", "must be bounce or complaint")
+}
+
+// SuppressionModel holds the email addresses that have hard-bounced or complained, and
+// so must not be sent any more email.
+type SuppressionModel struct {
+	DB *sql.DB
+}
+
+type SuppressionModeler interface {
+	Add(email, reason string) error
+	IsSuppressed(email string) (bool, error)
+	Remove(email string) error
+}
+
+// Add suppresses an address. If it's already suppressed, the reason is updated.
+func (m SuppressionModel) Add(email, reason string) error {
+	query := `
+		INSERT INTO suppressed_emails (email, reason)
+		VALUES ($1, $2)
+		ON CONFLICT (email) DO UPDATE SET reason = EXCLUDED.reason`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, email, reason)
+	return err
+}
+
+// IsSuppressed reports whether an address has been suppressed. The email column is
+// citext, so the check ignores case.
+func (m SuppressionModel) IsSuppressed(email string) (bool, error) {
+	query := `SELECT EXISTS(SELECT 1 FROM suppressed_emails WHERE email = $1)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var suppressed bool
+
+	err := m.DB.QueryRowContext(ctx, query, email).Scan(&suppressed)
+	return suppressed, err
+}
+
+// Remove lifts the suppression for an address, e.g. once the user has fixed their
+// mailbox. It isn't an error if the address wasn't suppressed.
+func (m SuppressionModel) Remove(email string) error {
+	query := `
+		DELETE FROM suppressed_emails
+		WHERE email = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, email)
+	return err
+}
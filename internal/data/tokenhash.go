@@ -0,0 +1,47 @@
+package data
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+)
+
+// The algorithms used to hash token plaintexts, as recorded in tokens.hash_algorithm.
+const (
+	TokenHashSHA256     = "sha256"
+	TokenHashHMACSHA256 = "hmac-sha256"
+)
+
+// hashToken hashes a token plaintext with the current algorithm, returning the hash
+// and the name of the algorithm. The key is the secret key for hashing tokens with
+// HMAC-SHA256 (Config.TokenHashKey). If it is empty, tokens are hashed with plain
+// SHA-256, as they always used to be. Once it is set, new tokens are hashed with the
+// key, and existing SHA-256 tokens are re-hashed the next time they are successfully
+// used to authenticate.
+func hashToken(key []byte, plainText string) ([]byte, string) {
+	if len(key) == 0 {
+		return legacyTokenHash(plainText), TokenHashSHA256
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(plainText))
+
+	return mac.Sum(nil), TokenHashHMACSHA256
+}
+
+// legacyTokenHash hashes a token plaintext with plain SHA-256.
+func legacyTokenHash(plainText string) []byte {
+	hash := sha256.Sum256([]byte(plainText))
+	return hash[:]
+}
+
+// tokenLookupHashes returns every hash that a stored token with this plaintext could
+// have: the hash with the current algorithm and, if that's different, the legacy
+// SHA-256 hash.
+func tokenLookupHashes(key []byte, plainText string) [][]byte {
+	hash, algorithm := hashToken(key, plainText)
+	if algorithm == TokenHashSHA256 {
+		return [][]byte{hash}
+	}
+
+	return [][]byte{hash, legacyTokenHash(plainText)}
+}
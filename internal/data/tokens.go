@@ -3,68 +3,192 @@ package data
 import (
 	"context"
 	"crypto/rand"
-	"crypto/sha256"
 	"database/sql"
-	"encoding/base32"
+	"errors"
+	"fmt"
+	"io"
 	"time"
 
 	"github.com/bal3000/greenlight/internal/validator"
+	"github.com/lib/pq"
 )
 
 const (
 	ScopeActivation     = "activation"
 	ScopeAuthentication = "authentication"
+	ScopeEmailChange    = "email_change"
+	ScopePasswordReset  = "password-reset"
 )
 
+// Errors returned when a token can't be used. They all wrap ErrRecordNotFound, so
+// callers that don't care about the reason can keep checking for that.
+var (
+	ErrTokenNotFound      = fmt.Errorf("token not found: %w", ErrRecordNotFound)
+	ErrTokenExpired       = fmt.Errorf("token expired: %w", ErrRecordNotFound)
+	ErrTokenScopeMismatch = fmt.Errorf("token scope mismatch: %w", ErrRecordNotFound)
+	ErrTokenUsed          = fmt.Errorf("token already used: %w", ErrRecordNotFound)
+)
+
+// MaxBulkTokenUsers is the most users whose tokens DeleteAllForUsers will delete at
+// once. Larger groups should be split into batches.
+const MaxBulkTokenUsers = 1000
+
+// ErrTooManyUsers is returned by DeleteAllForUsers when it's given more than
+// MaxBulkTokenUsers users.
+var ErrTooManyUsers = fmt.Errorf("more than %d users", MaxBulkTokenUsers)
+
 type Token struct {
-	PlainText string    `json:"token"`
-	Hash      []byte    `json:"-"`
-	UserID    int64     `json:"-"`
-	Expiry    time.Time `json:"expiry"`
-	Scope     string    `json:"-"`
+	PlainText     string    `json:"token"`
+	Hash          []byte    `json:"-"`
+	HashAlgorithm string    `json:"-"`
+	UserID        int64     `json:"-"`
+	Expiry        time.Time `json:"expiry"`
+	Scope         string    `json:"-"`
 }
 
-func generateToken(userID int64, ttl time.Duration, scope string) (*Token, error) {
+// generateToken creates a new token, hashed with hashKey (see hashToken), reading its
+// random bytes from random. If random is nil, crypto/rand.Reader is used. Anything else
+// should only be passed in tests, to get predictable token values.
+func generateToken(userID int64, ttl time.Duration, scope string, encoding TokenEncoding, hashKey []byte, random io.Reader) (*Token, error) {
 	token := &Token{
 		UserID: userID,
 		Expiry: time.Now().Add(ttl),
 		Scope:  scope,
 	}
 
+	if random == nil {
+		random = rand.Reader
+	}
+
 	randomBytes := make([]byte, 16)
-	// Use the Read() function from the crypto/rand package to fill the byte slice with
-	// random bytes from your operating system's CSPRNG. This will return an error if
-	// the CSPRNG fails to function correctly.
-	_, err := rand.Read(randomBytes)
+	// Use io.ReadFull() to fill the byte slice with random bytes, by default from your
+	// operating system's CSPRNG. This will return an error if the CSPRNG fails to
+	// function correctly.
+	_, err := io.ReadFull(random, randomBytes)
 	if err != nil {
 		return nil, err
 	}
 
-	token.PlainText = base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes)
-	hash := sha256.Sum256([]byte(token.PlainText))
-	token.Hash = hash[:]
+	token.PlainText = encoding.EncodeToString(randomBytes)
+	token.Hash, token.HashAlgorithm = hashToken(hashKey, token.PlainText)
 
 	return token, nil
 }
 
-// Check that the plaintext token has been provided and is exactly 26 bytes long.
+// ValidateUserIDs checks a list of users for DeleteAllForUsers: there must be at least
+// one and at most MaxBulkTokenUsers, and every ID must be positive.
+func ValidateUserIDs(v *validator.Validator, userIDs []int64) {
+	v.Check(validator.SliceLength(userIDs, 1, MaxBulkTokenUsers), "user_ids", fmt.Sprintf("must contain between 1 and %d users", MaxBulkTokenUsers))
+
+	for _, id := range userIDs {
+		if id < 1 {
+			v.AddError("user_ids", "must only contain positive integers")
+			break
+		}
+	}
+}
+
+// Check that the plaintext token has been provided and is in the format of one of the
+// supported encodings. We accept all of them, rather than just the configured one, so
+// that tokens issued before the encoding was changed keep working until they expire.
 func ValidateTokenPlainText(v *validator.Validator, tokenPlainText string) {
 	v.Check(tokenPlainText != "", "token", "must be provided")
-	v.Check(len(tokenPlainText) == 26, "token", "must be 26 bytes long")
+
+	valid := false
+	for _, rx := range tokenEncodingRX {
+		if validator.Matches(tokenPlainText, rx) {
+			valid = true
+			break
+		}
+	}
+
+	v.Check(valid, "token", "must be a valid token")
 }
 
 type TokenModel struct {
-	DB *sql.DB
+	DB       *sql.DB
+	Encoding TokenEncoding
+	Metrics  ModelMetrics
+	// The secret key tokens are hashed with. See Config.TokenHashKey.
+	HashKey []byte
+	// The source of randomness for new tokens. Leave nil to use crypto/rand; tests can
+	// set a fixed reader to get known token values.
+	Random io.Reader
+	// How long after expiry a token is still accepted. This must match
+	// UserModel.TokenExpiryGracePeriod, so that both models agree on which tokens are
+	// live.
+	ExpiryGracePeriod time.Duration
+}
+
+// tokenExpiryCutoff returns the time that token expiry times are compared against. Any
+// grace period extends the validity of every token by that amount, to allow for clock
+// skew between servers.
+func tokenExpiryCutoff(grace time.Duration) time.Time {
+	return time.Now().Add(-grace)
+}
+
+// execer is the part of *sql.DB and *sql.Tx that markTokensUsed needs, so that it can
+// run inside or outside a transaction.
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// markTokensUsed marks all of the user's unused tokens for the scope as used, rather
+// than deleting them, so that following an old link reports that it's no longer valid
+// instead of "unknown token". They're deleted with the other tokens once they expire.
+func markTokensUsed(ctx context.Context, db execer, scope string, userID int64) error {
+	query := `
+		UPDATE tokens
+		SET used_at = NOW()
+		WHERE scope = $1 AND user_id = $2 AND used_at IS NULL`
+
+	_, err := db.ExecContext(ctx, query, scope, userID)
+	return err
+}
+
+// checkToken compares a token's scope, expiry and used_at (as stored in the database)
+// against the scope that we were expecting, returning ErrTokenScopeMismatch,
+// ErrTokenUsed or ErrTokenExpired if the token can't be used. Tokens are looked up by
+// hash alone and then checked here, so that callers can tell exactly why a token was
+// rejected.
+func checkToken(wantScope, scope string, expiry time.Time, usedAt sql.NullTime, cutoff time.Time) error {
+	if scope != wantScope {
+		return ErrTokenScopeMismatch
+	}
+
+	if usedAt.Valid {
+		return ErrTokenUsed
+	}
+
+	if !expiry.After(cutoff) {
+		return ErrTokenExpired
+	}
+
+	return nil
 }
 
 type TokenModeler interface {
 	New(userID int64, ttl time.Duration, scope string) (*Token, error)
 	Insert(token *Token) error
 	DeleteAllForUser(scope string, userID int64) error
+	DeleteAllForUserBefore(scope string, userID int64, before time.Time) error
+	DeleteAllForUserAllScopes(userID int64) (int64, error)
+	DeleteAllForUsers(scope string, userIDs []int64) (int64, error)
+	DeleteByIssuedBefore(cutoff time.Time) (int64, error)
+	DeleteExpired(before time.Time) (int64, error)
+	MarkUsed(tokenPlainText string) error
+	MarkAllUsedForUser(scope string, userID int64) error
+	RotateForUser(userID int64, keepPlainText string) (int64, error)
+	LastIssuedForUser(scope string, userID int64) (time.Time, error)
+	ThrottleIssue(scope string, userID int64, interval time.Duration) error
+	Verify(scope, tokenPlainText string) (bool, error)
+	GetExpiringSoon(scope string, within time.Duration) ([]*Token, error)
+	ExistsForUser(scope string, userID int64) (bool, error)
+	CountActive(scope string, userID int64) (int, error)
 }
 
 func (m TokenModel) New(userID int64, ttl time.Duration, scope string) (*Token, error) {
-	token, err := generateToken(userID, ttl, scope)
+	token, err := generateToken(userID, ttl, scope, m.Encoding, m.HashKey, m.Random)
 	if err != nil {
 		return nil, err
 	}
@@ -75,16 +199,21 @@ func (m TokenModel) New(userID int64, ttl time.Duration, scope string) (*Token,
 
 func (m TokenModel) Insert(token *Token) error {
 	query := `
-		INSERT INTO tokens (hash, user_id, expiry, scope)
-		VALUES ($1, $2, $3, $4)`
+		INSERT INTO tokens (hash, user_id, expiry, scope, hash_algorithm)
+		VALUES ($1, $2, $3, $4, $5)`
 
-	args := []interface{}{token.Hash, token.UserID, token.Expiry, token.Scope}
+	args := []interface{}{token.Hash, token.UserID, token.Expiry, token.Scope, token.HashAlgorithm}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
 	_, err := m.DB.ExecContext(ctx, query, args...)
-	return err
+	if err != nil {
+		return err
+	}
+
+	m.Metrics.Inserts.Add(1)
+	return nil
 }
 
 func (m TokenModel) DeleteAllForUser(scope string, userID int64) error {
@@ -98,3 +227,339 @@ func (m TokenModel) DeleteAllForUser(scope string, userID int64) error {
 	_, err := m.DB.ExecContext(ctx, query, scope, userID)
 	return err
 }
+
+// DeleteAllForUserBefore deletes the user's tokens for a scope which were created
+// strictly before the given time. Tokens that are issued while an operation such as a
+// password change is in progress (i.e. at or after 'before') are left alone, so a
+// session created mid-flow isn't revoked by accident. Note that created_at is set by
+// the database clock. It's stored at full (microsecond) precision, because rounding it
+// to the second could put a token issued just after 'before' on the wrong side of the
+// cutoff.
+func (m TokenModel) DeleteAllForUserBefore(scope string, userID int64, before time.Time) error {
+	query := `
+		DELETE FROM tokens
+		WHERE scope = $1 AND user_id = $2 AND created_at < $3`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, scope, userID, before)
+	return err
+}
+
+// DeleteAllForUserAllScopes deletes every token the user has, whatever its scope, so
+// that existing sessions (and any outstanding activation tokens) stop working straight
+// away. It returns the number of tokens deleted, for the audit log. Suspending or
+// erasing a user revokes their tokens in the same way, but within the transaction that
+// changes the user (see deleteAllTokensForUser).
+func (m TokenModel) DeleteAllForUserAllScopes(userID int64) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return deleteAllTokensForUser(ctx, m.DB, userID)
+}
+
+// deleteAllTokensForUser implements DeleteAllForUserAllScopes, inside or outside a
+// transaction.
+func deleteAllTokensForUser(ctx context.Context, db execer, userID int64) (int64, error) {
+	query := `
+		DELETE FROM tokens
+		WHERE user_id = $1`
+
+	result, err := db.ExecContext(ctx, query, userID)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+// DeleteAllForUsers deletes the tokens for the scope belonging to any of the given
+// users in one statement, e.g. to sign out a whole group being offboarded, and returns
+// the number deleted. The list should be checked with ValidateUserIDs first; an empty
+// list deletes nothing, and more than MaxBulkTokenUsers users fails with
+// ErrTooManyUsers.
+func (m TokenModel) DeleteAllForUsers(scope string, userIDs []int64) (int64, error) {
+	if len(userIDs) == 0 {
+		return 0, nil
+	}
+
+	if len(userIDs) > MaxBulkTokenUsers {
+		return 0, ErrTooManyUsers
+	}
+
+	query := `
+		DELETE FROM tokens
+		WHERE scope = $1 AND user_id = ANY($2)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, scope, pq.Array(userIDs))
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+// DeleteByIssuedBefore deletes every token issued before cutoff, for every user and
+// scope. It's a blunt instrument for incident response (e.g. after a suspected key
+// compromise), forcing everyone to authenticate again, and should only ever be run
+// deliberately by an administrator. It returns the number of tokens deleted.
+func (m TokenModel) DeleteByIssuedBefore(cutoff time.Time) (int64, error) {
+	query := `
+		DELETE FROM tokens
+		WHERE created_at < $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, cutoff)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+// DeleteExpired deletes every token which expired before the given time, including
+// used ones (which keep their original expiry), and returns the number deleted. Tokens
+// are kept for a while after they expire so that using one can still be reported as
+// "expired" or "already used" rather than "invalid".
+func (m TokenModel) DeleteExpired(before time.Time) (int64, error) {
+	query := `
+		DELETE FROM tokens
+		WHERE expiry < $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, before)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+// MarkUsed records that a token has been consumed, instead of deleting it, so that a
+// later attempt to use it again fails with ErrTokenUsed. If there's no unused token
+// with the plaintext, ErrTokenNotFound is returned.
+func (m TokenModel) MarkUsed(tokenPlainText string) error {
+	query := `
+		UPDATE tokens
+		SET used_at = NOW()
+		WHERE hash = ANY($1) AND used_at IS NULL`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, pq.Array(tokenLookupHashes(m.HashKey, tokenPlainText)))
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrTokenNotFound
+	}
+
+	return nil
+}
+
+// MarkAllUsedForUser marks all of the user's tokens for the scope as used, e.g. to
+// supersede old activation links when a new one is sent.
+func (m TokenModel) MarkAllUsedForUser(scope string, userID int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return markTokensUsed(ctx, m.DB, scope, userID)
+}
+
+// RotateForUser signs a user out of their other sessions, by deleting all of their
+// authentication tokens except the one matching keepPlainText (normally the token used
+// for the current request). If keepPlainText is empty, every authentication token for
+// the user is deleted. It returns the number of tokens revoked.
+func (m TokenModel) RotateForUser(userID int64, keepPlainText string) (int64, error) {
+	// Leave keepHashes as a nil interface{} (rather than a nil slice) when there's no
+	// token to keep, so that it's sent to PostgreSQL as NULL. The token to keep might
+	// not have been re-hashed yet, so we keep it whichever algorithm it's hashed with.
+	var keepHashes interface{}
+	if keepPlainText != "" {
+		keepHashes = pq.Array(tokenLookupHashes(m.HashKey, keepPlainText))
+	}
+
+	query := `
+		DELETE FROM tokens
+		WHERE scope = $1 AND user_id = $2 AND ($3::bytea[] IS NULL OR hash <> ALL($3))`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, ScopeAuthentication, userID, keepHashes)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+// LastIssuedForUser returns when the user's most recent token for the scope was
+// created, so that callers can throttle how often new tokens are issued. If the user
+// has no tokens for the scope, the zero time is returned.
+func (m TokenModel) LastIssuedForUser(scope string, userID int64) (time.Time, error) {
+	query := `
+		SELECT MAX(created_at)
+		FROM tokens
+		WHERE scope = $1 AND user_id = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	// MAX() returns NULL when there are no matching rows, which leaves the NullTime
+	// invalid and its Time field as the zero time.
+	var lastIssued sql.NullTime
+
+	err := m.DB.QueryRowContext(ctx, query, scope, userID).Scan(&lastIssued)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return lastIssued.Time, nil
+}
+
+// ThrottleIssue checks that at least interval has passed since the user was last issued
+// a token for the scope, returning an *ErrRateLimited saying how much longer they have
+// to wait if it hasn't.
+func (m TokenModel) ThrottleIssue(scope string, userID int64, interval time.Duration) error {
+	lastIssued, err := m.LastIssuedForUser(scope, userID)
+	if err != nil {
+		return err
+	}
+
+	return throttle(lastIssued, interval, time.Now())
+}
+
+// Verify checks that a token exists for the scope and hasn't expired, without
+// consuming it, so that a client can check a token before asking the user for the rest
+// of a form. If the token can't be used, false is returned along with ErrTokenNotFound,
+// ErrTokenScopeMismatch, ErrTokenUsed or ErrTokenExpired.
+func (m TokenModel) Verify(scope, tokenPlainText string) (bool, error) {
+	query := `
+		SELECT scope, expiry, used_at
+		FROM tokens
+		WHERE hash = ANY($1)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var (
+		tokenScope string
+		expiry     time.Time
+		usedAt     sql.NullTime
+	)
+
+	err := m.DB.QueryRowContext(ctx, query, pq.Array(tokenLookupHashes(m.HashKey, tokenPlainText))).Scan(&tokenScope, &expiry, &usedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return false, ErrTokenNotFound
+		default:
+			return false, err
+		}
+	}
+
+	err = checkToken(scope, tokenScope, expiry, usedAt, tokenExpiryCutoff(m.ExpiryGracePeriod))
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// expiringSoonWindow returns the range of expiry times that GetExpiringSoon looks for:
+// tokens which are still accepted (allowing for the grace period), and which expire
+// no more than within from now. The grace period only moves the start of the window,
+// so it doesn't stretch how far ahead we look.
+func expiringSoonWindow(now time.Time, grace, within time.Duration) (from, to time.Time) {
+	return now.Add(-grace), now.Add(within)
+}
+
+// GetExpiringSoon returns the unexpired tokens for the scope which will expire within
+// the given window, soonest first, so that their users can be warned. Only the hash,
+// user ID, expiry and scope are known; the plaintext is never stored.
+func (m TokenModel) GetExpiringSoon(scope string, within time.Duration) ([]*Token, error) {
+	from, to := expiringSoonWindow(time.Now(), m.ExpiryGracePeriod, within)
+
+	query := `
+		SELECT hash, user_id, expiry, scope
+		FROM tokens
+		WHERE scope = $1 AND expiry > $2 AND expiry <= $3 AND used_at IS NULL
+		ORDER BY expiry`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, scope, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := []*Token{}
+
+	for rows.Next() {
+		var token Token
+
+		err := rows.Scan(&token.Hash, &token.UserID, &token.Expiry, &token.Scope)
+		if err != nil {
+			return nil, err
+		}
+
+		tokens = append(tokens, &token)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return tokens, nil
+}
+
+// ExistsForUser reports whether the user has an unexpired token for the scope.
+func (m TokenModel) ExistsForUser(scope string, userID int64) (bool, error) {
+	query := `
+		SELECT EXISTS(
+			SELECT 1 FROM tokens WHERE scope = $1 AND user_id = $2 AND expiry > $3 AND used_at IS NULL
+		)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var exists bool
+
+	err := m.DB.QueryRowContext(ctx, query, scope, userID, tokenExpiryCutoff(m.ExpiryGracePeriod)).Scan(&exists)
+	return exists, err
+}
+
+// CountActive returns the number of unexpired tokens the user has for the scope, e.g.
+// the number of devices they're signed in on.
+func (m TokenModel) CountActive(scope string, userID int64) (int, error) {
+	query := `
+		SELECT count(*)
+		FROM tokens
+		WHERE scope = $1 AND user_id = $2 AND expiry > $3 AND used_at IS NULL`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var count int
+
+	err := m.DB.QueryRowContext(ctx, query, scope, userID, tokenExpiryCutoff(m.ExpiryGracePeriod)).Scan(&count)
+	return count, err
+}
@@ -0,0 +1,187 @@
+package data
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/bal3000/greenlight/internal/validator"
+)
+
+// sequentialBytes returns the bytes 0, 1, 2, ... n-1.
+func sequentialBytes(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i)
+	}
+	return b
+}
+
+func TestGenerateTokenDeterministic(t *testing.T) {
+	tests := []struct {
+		encoding TokenEncoding
+		want     string
+	}{
+		{encoding: TokenEncodingBase32, want: "AAAQEAYEAUDAOCAJBIFQYDIOB4"},
+		{encoding: TokenEncodingBase58, want: "12drXXUifSrRnXLGbXg8E"},
+		{encoding: TokenEncodingBase64URL, want: "AAECAwQFBgcICQoLDA0ODw"},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.encoding), func(t *testing.T) {
+			token, err := generateToken(42, time.Hour, ScopeActivation, tt.encoding, nil, bytes.NewReader(sequentialBytes(16)))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if token.PlainText != tt.want {
+				t.Errorf("got plaintext %q; want %q", token.PlainText, tt.want)
+			}
+
+			if token.UserID != 42 || token.Scope != ScopeActivation {
+				t.Errorf("got user %d, scope %q; want 42, %q", token.UserID, token.Scope, ScopeActivation)
+			}
+		})
+	}
+}
+
+func TestGenerateTokenHash(t *testing.T) {
+	token, err := generateToken(1, time.Hour, ScopeAuthentication, TokenEncodingBase32, nil, bytes.NewReader(sequentialBytes(16)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The SHA-256 of "AAAQEAYEAUDAOCAJBIFQYDIOB4".
+	want := "b3f0010fec117d12f0a1d428855f4e1b64bcc4ab28c8cfc4b168d4b677a37578"
+
+	if got := hex.EncodeToString(token.Hash); got != want {
+		t.Errorf("got hash %s; want %s", got, want)
+	}
+
+	if token.HashAlgorithm != TokenHashSHA256 {
+		t.Errorf("got algorithm %q; want %q", token.HashAlgorithm, TokenHashSHA256)
+	}
+}
+
+func TestGenerateTokenHashWithKey(t *testing.T) {
+	key := []byte("token-hash-key")
+
+	token, err := generateToken(1, time.Hour, ScopeAuthentication, TokenEncodingBase32, key, bytes.NewReader(sequentialBytes(16)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(token.PlainText))
+
+	if !bytes.Equal(token.Hash, mac.Sum(nil)) {
+		t.Errorf("got hash %x; want the HMAC-SHA256 of the plaintext", token.Hash)
+	}
+
+	if token.HashAlgorithm != TokenHashHMACSHA256 {
+		t.Errorf("got algorithm %q; want %q", token.HashAlgorithm, TokenHashHMACSHA256)
+	}
+
+	// Tokens issued before the key was set must still be found.
+	hashes := tokenLookupHashes(key, token.PlainText)
+	if len(hashes) != 2 || !bytes.Equal(hashes[0], token.Hash) || !bytes.Equal(hashes[1], legacyTokenHash(token.PlainText)) {
+		t.Errorf("got lookup hashes %x; want the keyed and the legacy hash", hashes)
+	}
+
+	if hashes := tokenLookupHashes(nil, token.PlainText); len(hashes) != 1 {
+		t.Errorf("got %d lookup hashes without a key; want 1", len(hashes))
+	}
+}
+
+func TestGenerateTokenShortRead(t *testing.T) {
+	_, err := generateToken(1, time.Hour, ScopeAuthentication, TokenEncodingBase32, nil, bytes.NewReader(sequentialBytes(15)))
+	if err == nil {
+		t.Fatal("expected an error when the reader runs out of bytes")
+	}
+}
+
+func TestGenerateTokenDefaultsToCryptoRand(t *testing.T) {
+	a, err := generateToken(1, time.Hour, ScopeAuthentication, TokenEncodingBase32, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := generateToken(1, time.Hour, ScopeAuthentication, TokenEncodingBase32, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if a.PlainText == b.PlainText {
+		t.Errorf("got the same token twice: %q", a.PlainText)
+	}
+}
+
+func TestValidateUserIDsLength(t *testing.T) {
+	ids := func(n int) []int64 {
+		s := make([]int64, n)
+		for i := range s {
+			s[i] = int64(i + 1)
+		}
+		return s
+	}
+
+	tests := []struct {
+		n     int
+		valid bool
+	}{
+		{n: 0},
+		{n: 1, valid: true},
+		{n: MaxBulkTokenUsers, valid: true},
+		{n: MaxBulkTokenUsers + 1},
+	}
+
+	for _, tt := range tests {
+		v := validator.New()
+		ValidateUserIDs(v, ids(tt.n))
+
+		if v.Valid() != tt.valid {
+			t.Errorf("%d users: got valid %t; want %t (errors %v)", tt.n, v.Valid(), tt.valid, v.Errors)
+		}
+	}
+}
+
+func TestExpiringSoonWindow(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		grace    time.Duration
+		within   time.Duration
+		wantFrom time.Time
+		wantTo   time.Time
+	}{
+		{
+			name:     "no grace period",
+			within:   time.Hour,
+			wantFrom: now,
+			wantTo:   now.Add(time.Hour),
+		},
+		{
+			name:     "with a grace period",
+			grace:    5 * time.Minute,
+			within:   time.Hour,
+			wantFrom: now.Add(-5 * time.Minute),
+			wantTo:   now.Add(time.Hour),
+		},
+	}
+
+	for _, tt := range tests {
+		from, to := expiringSoonWindow(now, tt.grace, tt.within)
+
+		if !from.Equal(tt.wantFrom) {
+			t.Errorf("%s: got from %s; want %s", tt.name, from, tt.wantFrom)
+		}
+
+		if !to.Equal(tt.wantTo) {
+			t.Errorf("%s: got to %s; want %s", tt.name, to, tt.wantTo)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package data
+
+import (
+	"container/list"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CachedUserModel is a UserModeler which caches the results of GetByEmail and
+// GetByEmailForTenant for a short time, to save a database round trip on every login.
+// Every other method goes straight to the wrapped model, and the ones which change a
+// user evict it from the cache. Note that the cache is per process, so with several
+// instances a user can be stale for up to the TTL after they're changed elsewhere;
+// keep the TTL short.
+type CachedUserModel struct {
+	UserModeler
+
+	ttl  time.Duration
+	size int
+
+	mu      sync.Mutex
+	lru     *list.List               // of *userCacheEntry, most recently used first
+	byEmail map[string]*list.Element // keyed by userCacheKey
+	byID    map[int64]*list.Element
+}
+
+type userCacheEntry struct {
+	user    *User
+	expires time.Time
+}
+
+// userCacheKey returns the byEmail key for the user with the email address in the
+// tenant. Email addresses are only unique within a tenant, so the key needs both.
+func userCacheKey(tenantID int64, email string) string {
+	return strconv.FormatInt(tenantID, 10) + ":" + strings.ToLower(email)
+}
+
+// NewCachedUserModel wraps next with a cache holding up to size users for ttl.
+func NewCachedUserModel(next UserModeler, ttl time.Duration, size int) *CachedUserModel {
+	return &CachedUserModel{
+		UserModeler: next,
+		ttl:         ttl,
+		size:        size,
+		lru:         list.New(),
+		byEmail:     make(map[string]*list.Element),
+		byID:        make(map[int64]*list.Element),
+	}
+}
+
+// copyUser returns a copy of the user which shares no mutable state with the original,
+// and never holds the plaintext password.
+func copyUser(user *User) *User {
+	c := *user
+	c.Password = password{hash: append([]byte(nil), user.Password.hash...)}
+
+	if user.Metadata != nil {
+		c.Metadata = make(UserMetadata, len(user.Metadata))
+		for k, v := range user.Metadata {
+			c.Metadata[k] = v
+		}
+	}
+
+	return &c
+}
+
+func (m *CachedUserModel) GetByEmail(email string) (*User, error) {
+	return m.GetByEmailForTenant(DefaultTenantID, email)
+}
+
+func (m *CachedUserModel) GetByEmailForTenant(tenantID int64, email string) (*User, error) {
+	key := userCacheKey(tenantID, email)
+
+	m.mu.Lock()
+	if el, ok := m.byEmail[key]; ok {
+		entry := el.Value.(*userCacheEntry)
+		if time.Now().Before(entry.expires) {
+			m.lru.MoveToFront(el)
+			user := copyUser(entry.user)
+			m.mu.Unlock()
+			return user, nil
+		}
+
+		m.remove(el)
+	}
+	m.mu.Unlock()
+
+	user, err := m.UserModeler.GetByEmailForTenant(tenantID, email)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Another request may have cached the user while we were querying.
+	if el, ok := m.byID[user.ID]; ok {
+		m.remove(el)
+	}
+
+	el := m.lru.PushFront(&userCacheEntry{user: copyUser(user), expires: time.Now().Add(m.ttl)})
+	m.byEmail[key] = el
+	m.byID[user.ID] = el
+
+	for m.lru.Len() > m.size {
+		m.remove(m.lru.Back())
+	}
+
+	return user, nil
+}
+
+// remove evicts an entry. The mutex must be held.
+func (m *CachedUserModel) remove(el *list.Element) {
+	entry := m.lru.Remove(el).(*userCacheEntry)
+	delete(m.byEmail, userCacheKey(entry.user.TenantID, entry.user.Email))
+	delete(m.byID, entry.user.ID)
+}
+
+// invalidate evicts the users with the given ids.
+func (m *CachedUserModel) invalidate(ids ...int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, id := range ids {
+		if el, ok := m.byID[id]; ok {
+			m.remove(el)
+		}
+	}
+}
+
+func (m *CachedUserModel) Update(user *User) error {
+	defer m.invalidate(user.ID)
+	return m.UserModeler.Update(user)
+}
+
+func (m *CachedUserModel) Erase(id int64) error {
+	defer m.invalidate(id)
+	return m.UserModeler.Erase(id)
+}
+
+func (m *CachedUserModel) TouchPasswordChanged(id int64) error {
+	defer m.invalidate(id)
+	return m.UserModeler.TouchPasswordChanged(id)
+}
+
+func (m *CachedUserModel) Activate(user *User) error {
+	m.invalidate(user.ID)
+	return m.UserModeler.Activate(user)
+}
+
+func (m *CachedUserModel) SetStatus(user *User, status Status) (int64, error) {
+	m.invalidate(user.ID)
+	return m.UserModeler.SetStatus(user, status)
+}
+
+func (m *CachedUserModel) ActivateByToken(tokenPlainText string) (*User, error) {
+	user, err := m.UserModeler.ActivateByToken(tokenPlainText)
+	if err != nil {
+		return nil, err
+	}
+
+	m.invalidate(user.ID)
+	return user, nil
+}
+
+func (m *CachedUserModel) Merge(sourceID, targetID int64) error {
+	defer m.invalidate(sourceID, targetID)
+	return m.UserModeler.Merge(sourceID, targetID)
+}
+
+func (m *CachedUserModel) RehashPassword(id int64, plaintext string) error {
+	defer m.invalidate(id)
+	return m.UserModeler.RehashPassword(id, plaintext)
+}
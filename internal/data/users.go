@@ -2,18 +2,34 @@ package data
 
 import (
 	"context"
-	"crypto/sha256"
+	"crypto/rand"
 	"database/sql"
+	"database/sql/driver"
+	"encoding/base32"
+	"encoding/csv"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"strings"
 	"time"
 
 	"github.com/bal3000/greenlight/internal/validator"
+	"github.com/lib/pq"
 	"golang.org/x/crypto/bcrypt"
 )
 
 var (
-	ErrDuplicateEmail = errors.New("duplicate email")
-	AnonymousUser     = &User{}
+	ErrDuplicateEmail        = errors.New("duplicate email")
+	ErrMergeSameUser         = errors.New("cannot merge a user into themselves")
+	ErrPasswordAlreadyHashed = errors.New("password is already a bcrypt hash")
+	ErrPasswordMismatch      = errors.New("password does not match")
+
+	// AnonymousUser represents a request with no authenticated user. The authenticate
+	// middleware adds it to the request context when there is no Authorization header.
+	// It is compared by pointer, so always use IsAnonymous() rather than checking its
+	// fields.
+	AnonymousUser = &User{}
 )
 
 type User struct {
@@ -24,21 +40,102 @@ type User struct {
 	Password  password  `json:"-"`
 	Activated bool      `json:"activated"`
 	Version   int       `json:"-"`
+
+	// DisplayName is the name shown to other users. Unlike Name it's freely editable
+	// and needn't be unique. If it isn't set it defaults to Name.
+	DisplayName string `json:"display_name"`
+
+	Metadata UserMetadata `json:"metadata,omitempty"`
+	Locale   string       `json:"locale"`
+
+	// Timezone is the user's IANA time zone (e.g. "Europe/London"), used to schedule
+	// emails for a local time of day.
+	Timezone string `json:"timezone"`
+
+	// IsService marks a system or service account, which is never sent marketing email
+	// and is left out of user lists unless asked for.
+	IsService bool `json:"is_service"`
+
+	// TenantID is the tenant the user belongs to in a multi-tenant deployment. Email
+	// addresses are unique per tenant, so the same address can sign up once for each.
+	// Single-tenant deployments leave it as DefaultTenantID.
+	TenantID int64 `json:"tenant_id,omitempty"`
+
+	// Status is the account's lifecycle state. Activated is kept alongside it for the
+	// existing checks, and activating a pending account sets both.
+	Status Status `json:"status"`
+
+	PasswordChangedAt time.Time `json:"-"`
 }
 
+// defaultDisplayName sets the user's DisplayName to their Name if it hasn't been set.
+func (u *User) defaultDisplayName() {
+	if u.DisplayName == "" {
+		u.DisplayName = u.Name
+	}
+}
+
+// IsAnonymous reports whether the User is the AnonymousUser sentinel.
 func (u *User) IsAnonymous() bool {
 	return u == AnonymousUser
 }
 
+// PasswordExpired reports whether the user's password is older than maxAge. A maxAge
+// of 0 means that passwords never expire.
+func (u *User) PasswordExpired(maxAge time.Duration) bool {
+	if maxAge <= 0 {
+		return false
+	}
+
+	return time.Since(u.PasswordChangedAt) > maxAge
+}
+
+// The maximum size of a user's metadata once it has been serialized to JSON.
+const maxUserMetadataBytes = 16_384
+
+// UserMetadata holds arbitrary profile data for a user, stored in a JSONB column.
+type UserMetadata map[string]interface{}
+
+// Value implements the driver.Valuer interface, marshalling the metadata to JSON for
+// storage. A nil map is stored as an empty JSON object.
+func (um UserMetadata) Value() (driver.Value, error) {
+	if um == nil {
+		return []byte("{}"), nil
+	}
+
+	return json.Marshal(um)
+}
+
+// Scan implements the sql.Scanner interface, unmarshalling the JSONB column.
+func (um *UserMetadata) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case nil:
+		*um = nil
+		return nil
+	case []byte:
+		return json.Unmarshal(v, um)
+	case string:
+		return json.Unmarshal([]byte(v), um)
+	default:
+		return fmt.Errorf("unsupported type for user metadata: %T", src)
+	}
+}
+
 type password struct {
 	plaintext *string
 	hash      []byte
 }
 
-// The Set() method calculates the bcrypt hash of a plaintext password, and stores both
-// the hash and the plaintext versions in the struct.
-func (p *password) Set(ptPassword string) error {
-	hash, err := bcrypt.GenerateFromPassword([]byte(ptPassword), 12)
+// The Set() method calculates the hash of a plaintext password using the hasher, and
+// stores both the hash and the plaintext versions in the struct. If the "plaintext" is
+// actually already a bcrypt hash, ErrPasswordAlreadyHashed is returned instead, because
+// hashing it again would leave the account impossible to log in to.
+func (p *password) Set(hasher PasswordHasher, ptPassword string) error {
+	if isBcryptHash(ptPassword) {
+		return ErrPasswordAlreadyHashed
+	}
+
+	hash, err := hasher.Hash(ptPassword)
 	if err != nil {
 		return err
 	}
@@ -49,21 +146,32 @@ func (p *password) Set(ptPassword string) error {
 	return nil
 }
 
+// isBcryptHash reports whether s looks like a bcrypt hash, i.e. it's 60 bytes long, has
+// a $2a$, $2b$ or $2y$ prefix and a cost that bcrypt can parse.
+func isBcryptHash(s string) bool {
+	if len(s) != 60 {
+		return false
+	}
+
+	if !strings.HasPrefix(s, "$2a$") && !strings.HasPrefix(s, "$2b$") && !strings.HasPrefix(s, "$2y$") {
+		return false
+	}
+
+	_, err := bcrypt.Cost([]byte(s))
+	return err == nil
+}
+
 // The Matches() method checks whether the provided plaintext password matches the
 // hashed password stored in the struct, returning true if it matches and false
 // otherwise.
-func (p *password) Matches(ptPassword string) (bool, error) {
-	err := bcrypt.CompareHashAndPassword(p.hash, []byte(ptPassword))
-	if err != nil {
-		switch {
-		case errors.Is(err, bcrypt.ErrMismatchedHashAndPassword):
-			return false, nil
-		default:
-			return false, err
-		}
-	}
+func (p *password) Matches(hasher PasswordHasher, ptPassword string) (bool, error) {
+	return hasher.Compare(p.hash, ptPassword)
+}
 
-	return true, nil
+// NeedsRehash reports whether the stored hash should be replaced with one made by the
+// hasher the next time we have the plaintext.
+func (p *password) NeedsRehash(hasher PasswordHasher) bool {
+	return hasher.NeedsRehash(p.hash)
 }
 
 func ValidateEmail(v *validator.Validator, email string) {
@@ -71,20 +179,95 @@ func ValidateEmail(v *validator.Validator, email string) {
 	v.Check(validator.Matches(email, validator.EmailRX), "email", "must be a valid email address")
 }
 
-func ValidatePasswordPlainText(v *validator.Validator, password string) {
+func ValidatePhone(v *validator.Validator, phone string) {
+	v.Check(phone != "", "phone", "must be provided")
+	v.Check(strings.HasPrefix(phone, "+"), "phone", "must include a country code starting with +")
+	v.Check(validator.IsE164(phone), "phone", "must be a valid E.164 phone number")
+}
+
+// ValidateURL checks an optional URL field, such as a profile link. Empty values are
+// allowed.
+func ValidateURL(v *validator.Validator, key, value string) {
+	if value == "" {
+		return
+	}
+
+	v.Check(len(value) <= 2048, key, "must not be more than 2048 bytes long")
+	v.Check(validator.IsURL(value), key, "must be a valid http or https URL")
+}
+
+// ValidateTimezone checks that the time zone is a name from the IANA time zone
+// database, such as "America/New_York".
+func ValidateTimezone(v *validator.Validator, timezone string) {
+	v.Check(timezone != "", "timezone", "must be provided")
+
+	if timezone != "" {
+		_, err := time.LoadLocation(timezone)
+		v.Check(err == nil && timezone != "Local", "timezone", "must be a valid IANA time zone")
+	}
+}
+
+func ValidateLocale(v *validator.Validator, locale string) {
+	v.Check(locale != "", "locale", "must be provided")
+	v.Check(validator.Matches(locale, validator.LocaleRX), "locale", "must be a valid language tag, e.g. en or pt-BR")
+}
+
+func ValidatePasswordPlainText(v *validator.Validator, password string, hasher PasswordHasher) {
 	v.Check(password != "", "password", "must be provided")
 	v.Check(len(password) >= 8, "password", "must be at least 8 bytes long")
-	v.Check(len(password) <= 72, "password", "must not be more than 72 bytes long")
+	// The maximum depends on the hashing algorithm (72 bytes for bcrypt), as anything
+	// past its limit would be silently ignored.
+	maxLength := hasher.MaxLength()
+	v.Check(len(password) <= maxLength, "password", fmt.Sprintf("must not be more than %d bytes long", maxLength))
+}
+
+// ValidatePasswordForUser rejects passwords which contain the user's name or the local
+// part of their email address (ignoring case). Very short values are skipped, as they
+// would reject too many reasonable passwords.
+func ValidatePasswordForUser(v *validator.Validator, password string, user *User) {
+	password = strings.ToLower(password)
+
+	localPart := user.Email
+	if i := strings.LastIndex(localPart, "@"); i >= 0 {
+		localPart = localPart[:i]
+	}
+
+	for _, personal := range []string{user.Name, localPart} {
+		personal = strings.ToLower(strings.TrimSpace(personal))
+		if len(personal) < 3 {
+			continue
+		}
+
+		if strings.Contains(password, personal) {
+			v.AddError("password", "must not contain your name or email address")
+			return
+		}
+	}
 }
 
-func ValidateUser(v *validator.Validator, user *User) {
+// ValidateUserProfile validates the profile fields of a user (name, email and
+// metadata), without looking at the password. Use this for updates which don't touch
+// the password, where there is no need to have the hash loaded.
+func ValidateUserProfile(v *validator.Validator, user *User) {
 	v.Check(user.Name != "", "name", "must be provided")
 	v.Check(len(user.Name) <= 500, "name", "must not be more than 500 bytes long")
+	v.Check(len(user.DisplayName) <= 500, "display_name", "must not be more than 500 bytes long")
 
 	ValidateEmail(v, user.Email)
 
+	if user.Metadata != nil {
+		js, err := json.Marshal(user.Metadata)
+		v.Check(err == nil, "metadata", "must be valid JSON")
+		v.Check(len(js) <= maxUserMetadataBytes, "metadata", fmt.Sprintf("must not be more than %d bytes long", maxUserMetadataBytes))
+	}
+}
+
+func ValidateUser(v *validator.Validator, user *User, hasher PasswordHasher) {
+	ValidateUserProfile(v, user)
+
 	if user.Password.plaintext != nil {
-		ValidatePasswordPlainText(v, *user.Password.plaintext)
+		ValidatePasswordPlainText(v, *user.Password.plaintext, hasher)
+		ValidatePasswordForUser(v, *user.Password.plaintext, user)
 	}
 
 	// If the password hash is ever nil, this will be due to a logic error in our
@@ -98,58 +281,168 @@ func ValidateUser(v *validator.Validator, user *User) {
 }
 
 type UserModel struct {
-	DB *sql.DB
+	DB                     *sql.DB
+	Hasher                 PasswordHasher
+	PasswordHistory        int
+	TokenExpiryGracePeriod time.Duration
+	TokenEncoding          TokenEncoding
+	AutoActivate           bool
+	Metrics                ModelMetrics
+	// The secret key tokens are hashed with. See Config.TokenHashKey.
+	TokenHashKey []byte
+	// The source of randomness for activation tokens created by Register. Leave nil
+	// to use crypto/rand.
+	TokenRandom io.Reader
+}
+
+func (m UserModel) tokenExpiryCutoff() time.Time {
+	return tokenExpiryCutoff(m.TokenExpiryGracePeriod)
 }
 
 type UserModeler interface {
 	Insert(user *User) error
+	Get(id int64) (*User, error)
 	GetByEmail(email string) (*User, error)
+	GetByEmailForTenant(tenantID int64, email string) (*User, error)
 	Update(user *User) error
 	GetForToken(tokenScope, tokenPlainText string) (*User, error)
+	GetForTokenWithPermissions(tokenScope, tokenPlainText string) (*User, Permissions, error)
+	Import(r io.Reader, stopOnError bool) ([]ImportResult, error)
+	ExportData(id int64) ([]byte, error)
+	Erase(id int64) error
+	EmailExists(email string) (bool, error)
+	CheckPasswordReuse(userID int64, newPlaintext string) (bool, error)
+	AddPasswordHistory(user *User) error
+	TouchPasswordChanged(id int64) error
+	SetPhone(id int64, phone string) error
+	ActivateByToken(tokenPlainText string) (*User, error)
+	Activate(user *User) error
+	SetStatus(user *User, status Status) (int64, error)
+	GetForTokens(tokenScope string, tokenPlainTexts []string) (map[string]*User, error)
+	Register(user *User, permissionCodes []string, activationTTL, codeTTL time.Duration, templateFile string, templateData func(token *Token, code *ActivationCode) map[string]interface{}) error
+	SearchByEmail(prefix string, limit int, includeService bool) ([]*User, error)
+	Merge(sourceID, targetID int64) error
+	GetEmailPreferences(id int64) (EmailPreferences, error)
+	SetEmailPreferences(id int64, prefs EmailPreferences) error
+	HashCostHistogram() (map[int]int, error)
+	RehashPassword(id int64, plaintext string) error
+	StreamAll(fn func(*User) error) error
+	CancelEmailChange(id int64) error
+	GetAllWithPermission(code string, filters Filters) ([]*User, Metadata, error)
+	VerifyPassword(id int64, plaintext string) (bool, error)
+	GetRecent(limit int, includeService bool) ([]*User, error)
+	GetStaleUnactivated(olderThan time.Duration) ([]*User, error)
+	CreateServiceAccount(user *User, permissionCodes ...string) error
 }
 
+// DefaultTenantID is the tenant that users belong to unless they're given another one.
+// In a single-tenant deployment every user is in it.
+const DefaultTenantID int64 = 0
+
+// The most users that GetRecent returns at once.
+const MaxRecentUsers = 100
+
 // Insert a new record in the database for the user. Note that the id, created_at and
 // version fields are all automatically generated by our database, so we use the
-// RETURNING clause to read them into the User struct after the insert
+// RETURNING clause to read them into the User struct after the insert. If
+// m.AutoActivate is set, the user is inserted already activated.
 func (m UserModel) Insert(user *User) error {
+	if m.AutoActivate {
+		user.Activated = true
+	}
+
+	user.defaultDisplayName()
+	user.Status = StatusOf(user)
+
 	query := `
-		INSERT INTO users (name, email, password_hash, activated)
-		VALUES ($1, $2, $3, $4)
-		RETURNING id, created_at, version`
+		INSERT INTO users (name, email, password_hash, activated, metadata, is_service, display_name, tenant_id, status)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		RETURNING id, created_at, version, locale, timezone`
 
-	args := []interface{}{user.Name, user.Email, user.Password.hash, user.Activated}
+	args := []interface{}{user.Name, user.Email, user.Password.hash, user.Activated, user.Metadata, user.IsService, user.DisplayName, user.TenantID, user.Status}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&user.ID, &user.CreatedAt, &user.Version)
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&user.ID, &user.CreatedAt, &user.Version, &user.Locale, &user.Timezone)
 	if err != nil {
 		switch {
-		case err.Error() == `pq: duplicate key value violates unique constraint "users_email_key"`:
+		case err.Error() == `pq: duplicate key value violates unique constraint "users_tenant_id_email_key"`:
+			m.Metrics.DuplicateEmails.Add(1)
 			return ErrDuplicateEmail
 		default:
 			return err
 		}
 	}
 
+	m.Metrics.Inserts.Add(1)
 	return nil
 }
 
-// Retrieve the User details from the database based on the user's email address.
-// Because we have a UNIQUE constraint on the email column, this SQL query will only
-// return one record (or none at all, in which case we return a ErrRecordNotFound error).
+// Get retrieves a user by their ID, returning ErrRecordNotFound if there is no such
+// user.
+func (m UserModel) Get(id int64) (*User, error) {
+	query := `
+		SELECT id, created_at, name, email, password_hash, activated, version, password_changed_at, metadata, locale, timezone, display_name, is_service, tenant_id, status
+		FROM users
+		WHERE id = $1`
+
+	var user User
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Version,
+		&user.PasswordChangedAt,
+		&user.Metadata,
+		&user.Locale,
+		&user.Timezone,
+		&user.DisplayName,
+		&user.IsService,
+		&user.TenantID,
+		&user.Status,
+	)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &user, nil
+}
+
+// Retrieve the User details from the database based on the user's email address, in
+// the default tenant. Single-tenant deployments only ever need this.
 func (m UserModel) GetByEmail(email string) (*User, error) {
+	return m.GetByEmailForTenant(DefaultTenantID, email)
+}
+
+// GetByEmailForTenant retrieves a user by email address within a tenant. Because we
+// have a UNIQUE constraint on the (tenant_id, email) columns, this SQL query will only
+// return one record (or none at all, in which case we return a ErrRecordNotFound error).
+func (m UserModel) GetByEmailForTenant(tenantID int64, email string) (*User, error) {
 	query := `
-		SELECT id, created_at, name, email, password_hash, activated, version
+		SELECT id, created_at, name, email, password_hash, activated, version, password_changed_at, metadata, locale, timezone, display_name, is_service, tenant_id, status
 		FROM users
-		WHERE email = $1`
+		WHERE tenant_id = $1 AND email = $2`
 
 	var user User
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	err := m.DB.QueryRowContext(ctx, query, email).Scan(
+	err := m.DB.QueryRowContext(ctx, query, tenantID, email).Scan(
 		&user.ID,
 		&user.CreatedAt,
 		&user.Name,
@@ -157,6 +450,14 @@ func (m UserModel) GetByEmail(email string) (*User, error) {
 		&user.Password.hash,
 		&user.Activated,
 		&user.Version,
+		&user.PasswordChangedAt,
+		&user.Metadata,
+		&user.Locale,
+		&user.Timezone,
+		&user.DisplayName,
+		&user.IsService,
+		&user.TenantID,
+		&user.Status,
 	)
 
 	if err != nil {
@@ -173,14 +474,16 @@ func (m UserModel) GetByEmail(email string) (*User, error) {
 
 // Update the details for a specific user. Notice that we check against the version
 // field to help prevent any race conditions during the request cycle, just like we did
-// when updating a movie. And we also check for a violation of the "users_email_key"
-// constraint when performing the update, just like we did when inserting the user
-// record originally.
+// when updating a movie. And we also check for a violation of the
+// "users_tenant_id_email_key" constraint when performing the update, just like we did
+// when inserting the user record originally.
 func (m UserModel) Update(user *User) error {
+	user.defaultDisplayName()
+
 	query := `
 		UPDATE users
-		SET name = $1, email = $2, password_hash = $3, activated = $4, version = version + 1
-		WHERE id = $5 AND version = $6
+		SET name = $1, email = $2, password_hash = $3, activated = $4, metadata = $5, locale = $6, timezone = $7, display_name = $8, version = version + 1
+		WHERE id = $9 AND version = $10
 		RETURNING version`
 
 	args := []interface{}{
@@ -188,6 +491,10 @@ func (m UserModel) Update(user *User) error {
 		user.Email,
 		user.Password.hash,
 		user.Activated,
+		user.Metadata,
+		user.Locale,
+		user.Timezone,
+		user.DisplayName,
 		user.ID,
 		user.Version,
 	}
@@ -198,44 +505,78 @@ func (m UserModel) Update(user *User) error {
 	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&user.Version)
 	if err != nil {
 		switch {
-		case err.Error() == `pq: duplicate key value violates unique constraint "users_email_key"`:
+		case err.Error() == `pq: duplicate key value violates unique constraint "users_tenant_id_email_key"`:
+			m.Metrics.DuplicateEmails.Add(1)
 			return ErrDuplicateEmail
 		case errors.Is(err, sql.ErrNoRows):
+			m.Metrics.EditConflicts.Add(1)
 			return ErrEditConflict
 		default:
 			return err
 		}
 	}
 
+	m.Metrics.Updates.Add(1)
 	return nil
 }
 
 func (m UserModel) GetForToken(tokenScope, tokenPlainText string) (*User, error) {
-	// Calculate the SHA-256 hash of the plaintext token provided by the client.
-	// Remember that this returns a byte *array* with length 32, not a slice.
-	tokenHash := sha256.Sum256([]byte(tokenPlainText))
+	user, _, err := m.getForToken(tokenScope, tokenPlainText, false)
+	return user, err
+}
 
-	query := `
-		SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.version
+// GetForTokenWithPermissions is GetForToken, but also returns the user's unexpired
+// permissions, fetched by the same query to save a round trip on every authenticated
+// request. A user with no permissions gets an empty (not nil) Permissions.
+func (m UserModel) GetForTokenWithPermissions(tokenScope, tokenPlainText string) (*User, Permissions, error) {
+	return m.getForToken(tokenScope, tokenPlainText, true)
+}
+
+// getForToken implements GetForToken and GetForTokenWithPermissions. The permissions
+// are only looked up if withPermissions is true.
+func (m UserModel) getForToken(tokenScope, tokenPlainText string, withPermissions bool) (*User, Permissions, error) {
+	// Hash the plaintext token provided by the client with the current algorithm. If
+	// that's not the one the token was stored with, we also look for its legacy
+	// SHA-256 hash, and upgrade the stored hash once the token has been checked.
+	tokenHash, algorithm := hashToken(m.TokenHashKey, tokenPlainText)
+	legacyHash := legacyTokenHash(tokenPlainText)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	permissionsColumn := ""
+	if withPermissions {
+		permissionsColumn = `, ARRAY(
+			SELECT permissions.code
+			FROM permissions
+			INNER JOIN users_permissions ON users_permissions.permission_id = permissions.id
+			WHERE users_permissions.user_id = users.id
+			AND (users_permissions.expires_at IS NULL OR users_permissions.expires_at > NOW())
+		)`
+	}
+
+	// We look the token up by its hash alone, and then check the scope and expiry
+	// ourselves, so that we can tell the caller exactly why a token was rejected.
+	query := fmt.Sprintf(`
+		SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.version, users.password_changed_at, users.metadata, users.locale, users.timezone, users.display_name, users.is_service, users.tenant_id, users.status, tokens.scope, tokens.expiry, tokens.used_at, tokens.hash_algorithm%s
 		FROM users
 		INNER JOIN tokens
 		ON users.id = tokens.user_id
-		WHERE tokens.hash = $1
-		AND tokens.scope = $2
-		AND tokens.expiry > $3`
+		WHERE (tokens.hash = $1 AND tokens.hash_algorithm = $2)
+		OR (tokens.hash = $3 AND tokens.hash_algorithm = $4)`, permissionsColumn)
 
-	// Create a slice containing the query arguments. Notice how we use the [:] operator
-	// to get a slice containing the token hash, rather than passing in the array (which
-	// is not supported by the pq driver), and that we pass the current time as the
-	// value to check against the token expiry.
-	args := []interface{}{tokenHash[:], tokenScope, time.Now()}
+	args := []interface{}{tokenHash, algorithm, legacyHash, TokenHashSHA256}
 
-	var user User
-
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
+	var (
+		user            User
+		scope           string
+		expiry          time.Time
+		usedAt          sql.NullTime
+		storedAlgorithm string
+		codes           pq.StringArray
+	)
 
-	err := m.DB.QueryRowContext(ctx, query, args...).Scan(
+	dest := []interface{}{
 		&user.ID,
 		&user.CreatedAt,
 		&user.Name,
@@ -243,6 +584,261 @@ func (m UserModel) GetForToken(tokenScope, tokenPlainText string) (*User, error)
 		&user.Password.hash,
 		&user.Activated,
 		&user.Version,
+		&user.PasswordChangedAt,
+		&user.Metadata,
+		&user.Locale,
+		&user.Timezone,
+		&user.DisplayName,
+		&user.IsService,
+		&user.TenantID,
+		&user.Status,
+		&scope,
+		&expiry,
+		&usedAt,
+		&storedAlgorithm,
+	}
+
+	if withPermissions {
+		dest = append(dest, &codes)
+	}
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(dest...)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, nil, ErrTokenNotFound
+		default:
+			return nil, nil, err
+		}
+	}
+
+	if err := m.checkToken(tokenScope, scope, expiry, usedAt); err != nil {
+		return nil, nil, err
+	}
+
+	// Upgrade a legacy hash now that the token has been checked. This doesn't need a
+	// transaction or a lock: if two requests race to re-hash the same token, the second
+	// UPDATE matches no rows (the legacy hash is gone) and does nothing.
+	if storedAlgorithm != algorithm {
+		query = `
+			UPDATE tokens
+			SET hash = $1, hash_algorithm = $2
+			WHERE hash = $3 AND hash_algorithm = $4`
+
+		_, err = m.DB.ExecContext(ctx, query, args...)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var permissions Permissions
+	if withPermissions {
+		permissions = Permissions(codes)
+		if permissions == nil {
+			permissions = Permissions{}
+		}
+	}
+
+	return &user, permissions, nil
+}
+
+// checkToken checks a token with the model's expiry grace period.
+func (m UserModel) checkToken(wantScope, scope string, expiry time.Time, usedAt sql.NullTime) error {
+	return checkToken(wantScope, scope, expiry, usedAt, m.tokenExpiryCutoff())
+}
+
+// ImportResult holds the outcome of importing a single CSV row. Line is the 1-based
+// line number in the source, and TemporaryPassword is only set when the user was
+// created successfully.
+type ImportResult struct {
+	Line              int
+	User              *User
+	TemporaryPassword string
+	Err               error
+}
+
+// generateTemporaryPassword returns a random 26 character password, using the same
+// approach that we use for generating tokens.
+func generateTemporaryPassword() (string, error) {
+	randomBytes := make([]byte, 16)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return "", err
+	}
+
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes), nil
+}
+
+// Import reads name,email rows from r and inserts a new (unactivated) user for each one
+// with a random temporary password. All of the inserts happen within a single
+// transaction. Each row is wrapped in a savepoint, so that if stopOnError is false an
+// invalid row (or a duplicate email) is recorded in its ImportResult and the rest of the
+// batch carries on. If stopOnError is true, the first failing row rolls back the whole
+// import and its error is returned. An optional "name,email" header row is skipped.
+func (m UserModel) Import(r io.Reader, stopOnError bool) ([]ImportResult, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	// Bulk imports can take a lot longer than a single insert, so we give the whole
+	// transaction a more generous timeout.
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	query := `
+		INSERT INTO users (name, email, password_hash, activated, display_name)
+		VALUES ($1, $2, $3, $4, $1)
+		RETURNING id, created_at, version, locale, timezone`
+
+	var results []ImportResult
+
+	for line := 1; ; line++ {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return results, err
+		}
+
+		if line == 1 && len(record) == 2 && strings.EqualFold(record[0], "name") && strings.EqualFold(record[1], "email") {
+			continue
+		}
+
+		result := ImportResult{Line: line}
+		result.Err = func() error {
+			if len(record) != 2 {
+				return fmt.Errorf("expected 2 fields, got %d", len(record))
+			}
+
+			user := &User{
+				Name:      strings.TrimSpace(record[0]),
+				Email:     strings.TrimSpace(record[1]),
+				Activated: false,
+			}
+			user.defaultDisplayName()
+
+			tempPassword, err := generateTemporaryPassword()
+			if err != nil {
+				return err
+			}
+
+			err = user.Password.Set(m.Hasher, tempPassword)
+			if err != nil {
+				return err
+			}
+
+			v := validator.New()
+			if ValidateUser(v, user, m.Hasher); !v.Valid() {
+				return v.Err()
+			}
+
+			// Use a savepoint so that a failed insert doesn't leave the whole
+			// transaction in an aborted state.
+			_, err = tx.ExecContext(ctx, "SAVEPOINT import_row")
+			if err != nil {
+				return err
+			}
+
+			args := []interface{}{user.Name, user.Email, user.Password.hash, user.Activated}
+
+			err = tx.QueryRowContext(ctx, query, args...).Scan(&user.ID, &user.CreatedAt, &user.Version, &user.Locale, &user.Timezone)
+			if err != nil {
+				if _, rbErr := tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT import_row"); rbErr != nil {
+					return rbErr
+				}
+
+				switch {
+				case err.Error() == `pq: duplicate key value violates unique constraint "users_tenant_id_email_key"`:
+					return ErrDuplicateEmail
+				default:
+					return err
+				}
+			}
+
+			_, err = tx.ExecContext(ctx, "RELEASE SAVEPOINT import_row")
+			if err != nil {
+				return err
+			}
+
+			result.User = user
+			result.TemporaryPassword = tempPassword
+			return nil
+		}()
+
+		results = append(results, result)
+
+		if result.Err != nil && stopOnError {
+			return results, fmt.Errorf("line %d: %w", line, result.Err)
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return results, err
+	}
+
+	return results, nil
+}
+
+// userExport is the document returned by ExportData.
+type userExport struct {
+	User              User             `json:"user"`
+	Phone             string           `json:"phone,omitempty"`
+	PendingEmail      string           `json:"pending_email,omitempty"`
+	EmailPreferences  EmailPreferences `json:"email_preferences"`
+	PasswordChangedAt time.Time        `json:"password_changed_at"`
+	Tokens            []exportedToken  `json:"tokens"`
+	Permissions       Permissions      `json:"permissions"`
+}
+
+type exportedToken struct {
+	Scope  string    `json:"scope"`
+	Expiry time.Time `json:"expiry"`
+}
+
+// ExportData gathers everything we hold about a user (for a GDPR data-subject access
+// request) and returns it as a JSON document. Every column of the user's row is
+// exported apart from the password hash (we do include when it was last changed) and
+// the version, and for tokens we only export the scope and expiry, not the hash.
+func (m UserModel) ExportData(id int64) ([]byte, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	var export userExport
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `
+		SELECT id, created_at, name, email, activated, metadata, locale, timezone, display_name, is_service, tenant_id, status, COALESCE(phone, ''), COALESCE(pending_email, ''), email_preferences, password_changed_at
+		FROM users
+		WHERE id = $1`
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&export.User.ID,
+		&export.User.CreatedAt,
+		&export.User.Name,
+		&export.User.Email,
+		&export.User.Activated,
+		&export.User.Metadata,
+		&export.User.Locale,
+		&export.User.Timezone,
+		&export.User.DisplayName,
+		&export.User.IsService,
+		&export.User.TenantID,
+		&export.User.Status,
+		&export.Phone,
+		&export.PendingEmail,
+		&export.EmailPreferences,
+		&export.PasswordChangedAt,
 	)
 	if err != nil {
 		switch {
@@ -253,5 +849,1356 @@ func (m UserModel) GetForToken(tokenScope, tokenPlainText string) (*User, error)
 		}
 	}
 
-	return &user, nil
+	query = `
+		SELECT scope, expiry
+		FROM tokens
+		WHERE user_id = $1
+		ORDER BY expiry`
+
+	rows, err := m.DB.QueryContext(ctx, query, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var token exportedToken
+
+		err := rows.Scan(&token.Scope, &token.Expiry)
+		if err != nil {
+			return nil, err
+		}
+
+		export.Tokens = append(export.Tokens, token)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	query = `
+		SELECT permissions.code
+		FROM permissions
+		INNER JOIN users_permissions ON users_permissions.permission_id = permissions.id
+		WHERE users_permissions.user_id = $1`
+
+	rows, err = m.DB.QueryContext(ctx, query, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var code string
+
+		err := rows.Scan(&code)
+		if err != nil {
+			return nil, err
+		}
+
+		export.Permissions = append(export.Permissions, code)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return json.MarshalIndent(export, "", "\t")
+}
+
+// eraseQueries delete the rows which belong to a user, other than their tokens, before
+// the user's own row is deleted by Erase or Merge. Each takes the user's ID as $1.
+var eraseQueries = []string{
+	"DELETE FROM users_permissions WHERE user_id = $1",
+	"DELETE FROM password_history WHERE user_id = $1",
+	"DELETE FROM sms_codes WHERE user_id = $1",
+	"DELETE FROM activation_codes WHERE user_id = $1",
+	"DELETE FROM idempotency_keys WHERE user_id = $1",
+}
+
+// eraseEmailQueries delete the emails still waiting to be sent to a user, who is
+// found by their address, so they must run before the user's row is deleted. Each
+// takes the user's ID as $1.
+var eraseEmailQueries = []string{
+	"DELETE FROM email_outbox WHERE recipient::citext = (SELECT email FROM users WHERE id = $1)",
+	"DELETE FROM scheduled_emails WHERE recipient::citext = (SELECT email FROM users WHERE id = $1)",
+}
+
+// mergeEmailQueries re-address the emails still waiting to be sent to the source user
+// ($2) to the target user ($1), for Merge. There's one for each of eraseEmailQueries.
+var mergeEmailQueries = []string{
+	"UPDATE email_outbox SET recipient = (SELECT email FROM users WHERE id = $1) WHERE recipient::citext = (SELECT email FROM users WHERE id = $2)",
+	"UPDATE scheduled_emails SET recipient = (SELECT email FROM users WHERE id = $1) WHERE recipient::citext = (SELECT email FROM users WHERE id = $2)",
+}
+
+// Erase permanently removes a user along with their tokens, permissions, password
+// history, SMS codes, activation codes, stored idempotent responses (which contain
+// their name and email address) and any emails still waiting to be sent to them (for
+// a GDPR erasure request). The foreign keys would cascade some of these for us anyway,
+// but we delete them explicitly within the same transaction so that the erasure
+// doesn't depend on the schema's ON DELETE behaviour. The address is left on the
+// suppression list, if it's there, so that we keep honouring a bounce or complaint. If
+// the user doesn't exist ErrRecordNotFound is returned and nothing is deleted.
+func (m UserModel) Erase(id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Revoke every token first, so that the user's sessions stop working in the same
+	// transaction that removes them.
+	_, err = deleteAllTokensForUser(ctx, tx, id)
+	if err != nil {
+		return err
+	}
+
+	for _, query := range append(eraseQueries, eraseEmailQueries...) {
+		_, err = tx.ExecContext(ctx, query, id)
+		if err != nil {
+			return err
+		}
+	}
+
+	result, err := tx.ExecContext(ctx, "DELETE FROM users WHERE id = $1", id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return tx.Commit()
+}
+
+// EmailExists reports whether a user with the given email address is already
+// registered in the default tenant. Note that exposing this to clients makes it
+// trivial to enumerate registered addresses, so it should only be called from handlers
+// that require an authenticated admin, or from routes that are covered by the rate
+// limiter.
+func (m UserModel) EmailExists(email string) (bool, error) {
+	query := `SELECT EXISTS(SELECT 1 FROM users WHERE tenant_id = $1 AND email = $2)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var exists bool
+
+	err := m.DB.QueryRowContext(ctx, query, DefaultTenantID, email).Scan(&exists)
+	return exists, err
+}
+
+// CheckPasswordReuse reports whether newPlaintext matches any of the last
+// m.PasswordHistory passwords recorded for the user.
+func (m UserModel) CheckPasswordReuse(userID int64, newPlaintext string) (bool, error) {
+	if m.PasswordHistory <= 0 {
+		return false, nil
+	}
+
+	query := `
+		SELECT password_hash
+		FROM password_history
+		WHERE user_id = $1
+		ORDER BY created_at DESC, id DESC
+		LIMIT $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID, m.PasswordHistory)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	var hashes [][]byte
+
+	for rows.Next() {
+		var hash []byte
+
+		err := rows.Scan(&hash)
+		if err != nil {
+			return false, err
+		}
+
+		hashes = append(hashes, hash)
+	}
+
+	if err = rows.Err(); err != nil {
+		return false, err
+	}
+
+	// Do the (slow) hash comparisons after the rows have been read, so that we're not
+	// holding the connection open while we hash.
+	for _, hash := range hashes {
+		p := password{hash: hash}
+
+		match, err := p.Matches(m.Hasher, newPlaintext)
+		if err != nil {
+			return false, err
+		}
+
+		if match {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// AddPasswordHistory records the user's current password hash in their password
+// history, and then trims the history so that only the most recent m.PasswordHistory
+// entries are kept. This should be called whenever a user's password is changed.
+func (m UserModel) AddPasswordHistory(user *User) error {
+	if m.PasswordHistory <= 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+		INSERT INTO password_history (user_id, password_hash)
+		VALUES ($1, $2)`
+
+	_, err = tx.ExecContext(ctx, query, user.ID, user.Password.hash)
+	if err != nil {
+		return err
+	}
+
+	query = `
+		DELETE FROM password_history
+		WHERE user_id = $1 AND id NOT IN (
+			SELECT id FROM password_history
+			WHERE user_id = $1
+			ORDER BY created_at DESC, id DESC
+			LIMIT $2
+		)`
+
+	_, err = tx.ExecContext(ctx, query, user.ID, m.PasswordHistory)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// TouchPasswordChanged sets the password_changed_at timestamp for a user to the current
+// time. This should be called whenever a user's password is changed, to restart the
+// password expiry clock.
+func (m UserModel) TouchPasswordChanged(id int64) error {
+	query := `
+		UPDATE users
+		SET password_changed_at = NOW()
+		WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// SetPhone records a phone number (in E.164 format) which the user has proved they
+// own, by entering a code sent to it by SMS.
+func (m UserModel) SetPhone(id int64, phone string) error {
+	query := `
+		UPDATE users
+		SET phone = $1
+		WHERE id = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, phone, id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// Activate marks the user as activated and marks all of their activation tokens as
+// used, in a single transaction, for when they've activated some other way (such as
+// with an activation code). Like Update, it checks the user's version, returning
+// ErrEditConflict if it has changed.
+func (m UserModel) Activate(user *User) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+		UPDATE users
+		SET activated = true, status = CASE WHEN status = 'pending' THEN 'active' ELSE status END, version = version + 1
+		WHERE id = $1 AND version = $2
+		RETURNING activated, status, version`
+
+	err = tx.QueryRowContext(ctx, query, user.ID, user.Version).Scan(&user.Activated, &user.Status, &user.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			m.Metrics.EditConflicts.Add(1)
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+
+	err = markTokensUsed(ctx, tx, ScopeActivation, user.ID)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	m.Metrics.Updates.Add(1)
+	return nil
+}
+
+// SetStatus changes the user's status, checking their version like Update does. If the
+// user is suspended or deleted, all of their tokens are revoked in the same
+// transaction, so that they're signed out everywhere the moment the change commits.
+// It returns the number of tokens that were revoked. Callers should check the change
+// with ValidateStatusTransition first.
+func (m UserModel) SetStatus(user *User, status Status) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	query := `
+		UPDATE users
+		SET status = $1, version = version + 1
+		WHERE id = $2 AND version = $3
+		RETURNING status, version`
+
+	err = tx.QueryRowContext(ctx, query, status, user.ID, user.Version).Scan(&user.Status, &user.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			m.Metrics.EditConflicts.Add(1)
+			return 0, ErrEditConflict
+		default:
+			return 0, err
+		}
+	}
+
+	var revoked int64
+	if status == StatusSuspended || status == StatusDeleted {
+		revoked, err = deleteAllTokensForUser(ctx, tx, user.ID)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, err
+	}
+
+	m.Metrics.Updates.Add(1)
+	return revoked, nil
+}
+
+// ActivateByToken looks up the user for an activation token, marks them as activated
+// and marks all of their activation tokens as used, all within a single transaction.
+// This avoids the race where the same token is used twice between the lookup and the
+// update. If the token can't be used, ErrTokenNotFound, ErrTokenScopeMismatch,
+// ErrTokenUsed or ErrTokenExpired is returned.
+func (m UserModel) ActivateByToken(tokenPlainText string) (*User, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Lock the user's row so that concurrent activations for the same user wait for
+	// this one to finish (at which point the token will have been marked as used).
+	query := `
+		SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.version, users.password_changed_at, users.metadata, users.locale, users.timezone, users.display_name, users.is_service, users.tenant_id, users.status, tokens.scope, tokens.expiry, tokens.used_at
+		FROM users
+		INNER JOIN tokens
+		ON users.id = tokens.user_id
+		WHERE tokens.hash = ANY($1)
+		FOR UPDATE OF users`
+
+	var (
+		user   User
+		scope  string
+		expiry time.Time
+		usedAt sql.NullTime
+	)
+
+	err = tx.QueryRowContext(ctx, query, pq.Array(tokenLookupHashes(m.TokenHashKey, tokenPlainText))).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Version,
+		&user.PasswordChangedAt,
+		&user.Metadata,
+		&user.Locale,
+		&user.Timezone,
+		&user.DisplayName,
+		&user.IsService,
+		&user.TenantID,
+		&user.Status,
+		&scope,
+		&expiry,
+		&usedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrTokenNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	if err := m.checkToken(ScopeActivation, scope, expiry, usedAt); err != nil {
+		return nil, err
+	}
+
+	query = `
+		UPDATE users
+		SET activated = true, status = CASE WHEN status = 'pending' THEN 'active' ELSE status END, version = version + 1
+		WHERE id = $1
+		RETURNING activated, status, version`
+
+	err = tx.QueryRowContext(ctx, query, user.ID).Scan(&user.Activated, &user.Status, &user.Version)
+	if err != nil {
+		return nil, err
+	}
+
+	err = markTokensUsed(ctx, tx, ScopeActivation, user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+// GetForTokens is a batch version of GetForToken. It resolves many plaintext tokens in
+// a single query, and returns a map of plaintext token to user containing only the
+// tokens that matched (unknown or expired tokens are simply left out).
+func (m UserModel) GetForTokens(tokenScope string, tokenPlainTexts []string) (map[string]*User, error) {
+	users := make(map[string]*User)
+
+	if len(tokenPlainTexts) == 0 {
+		return users, nil
+	}
+
+	// Hash each of the plaintext tokens, remembering which plaintext each hash came from
+	// so that we can key the results by plaintext.
+	plainTexts := make(map[string]string, len(tokenPlainTexts))
+	hashes := make([][]byte, 0, len(tokenPlainTexts))
+
+	for _, plainText := range tokenPlainTexts {
+		for _, hash := range tokenLookupHashes(m.TokenHashKey, plainText) {
+			if _, exists := plainTexts[string(hash)]; exists {
+				continue
+			}
+
+			plainTexts[string(hash)] = plainText
+			hashes = append(hashes, hash)
+		}
+	}
+
+	query := `
+		SELECT tokens.hash, users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.version, users.password_changed_at, users.metadata, users.locale, users.timezone, users.display_name, users.is_service, users.tenant_id, users.status
+		FROM users
+		INNER JOIN tokens
+		ON users.id = tokens.user_id
+		WHERE tokens.hash = ANY($1)
+		AND tokens.scope = $2
+		AND tokens.expiry > $3
+		AND tokens.used_at IS NULL`
+
+	args := []interface{}{pq.Array(hashes), tokenScope, m.tokenExpiryCutoff()}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			hash []byte
+			user User
+		)
+
+		err := rows.Scan(
+			&hash,
+			&user.ID,
+			&user.CreatedAt,
+			&user.Name,
+			&user.Email,
+			&user.Password.hash,
+			&user.Activated,
+			&user.Version,
+			&user.PasswordChangedAt,
+			&user.Metadata,
+			&user.Locale,
+			&user.Timezone,
+			&user.DisplayName,
+			&user.IsService,
+			&user.TenantID,
+			&user.Status,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		users[plainTexts[string(hash)]] = &user
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return users, nil
+}
+
+// defaultWelcomeData is the data for Register's welcome email when the caller doesn't
+// supply any: the activation token, the user's ID and, if there is one, the activation
+// code.
+func defaultWelcomeData(token *Token, code *ActivationCode) map[string]interface{} {
+	data := map[string]interface{}{
+		"activationToken": token.PlainText,
+		"userID":          token.UserID,
+	}
+
+	if code != nil {
+		data["activationCode"] = code.PlainText
+	}
+
+	return data
+}
+
+// Register inserts a new user, grants them the given permissions, creates an
+// activation token and writes the welcome email (containing the token) to the outbox,
+// all within a single transaction. The outbox relay delivers the email after the
+// transaction has committed, so we never end up with a user who wasn't sent an email,
+// or an email for a user that was rolled back. Note that this means the plaintext
+// activation token sits in the outbox until the email has been sent.
+//
+// If codeTTL isn't zero, a 6-digit activation code is issued in the same transaction
+// and sent alongside the token. templateData builds the data for the email from the
+// activation token and code (which is nil if there isn't one), once the user has been
+// inserted. If it is nil, the data is the token, the code and the user's ID.
+//
+// If m.AutoActivate is set, the user is inserted already activated, and no activation
+// token, code or email is created.
+func (m UserModel) Register(user *User, permissionCodes []string, activationTTL, codeTTL time.Duration, templateFile string, templateData func(token *Token, code *ActivationCode) map[string]interface{}) error {
+	if m.AutoActivate {
+		user.Activated = true
+	}
+
+	user.defaultDisplayName()
+	user.Status = StatusOf(user)
+
+	token, err := generateToken(0, activationTTL, ScopeActivation, m.TokenEncoding, m.TokenHashKey, m.TokenRandom)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+		INSERT INTO users (name, email, password_hash, activated, metadata, display_name, tenant_id, status)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		RETURNING id, created_at, version, locale, timezone`
+
+	args := []interface{}{user.Name, user.Email, user.Password.hash, user.Activated, user.Metadata, user.DisplayName, user.TenantID, user.Status}
+
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&user.ID, &user.CreatedAt, &user.Version, &user.Locale, &user.Timezone)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "users_tenant_id_email_key"`:
+			m.Metrics.DuplicateEmails.Add(1)
+			return ErrDuplicateEmail
+		default:
+			return err
+		}
+	}
+
+	query = `
+		INSERT INTO users_permissions
+		SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)`
+
+	_, err = tx.ExecContext(ctx, query, user.ID, pq.Array(permissionCodes))
+	if err != nil {
+		return err
+	}
+
+	if user.Activated {
+		err = tx.Commit()
+		if err != nil {
+			return err
+		}
+
+		m.Metrics.Inserts.Add(1)
+		return nil
+	}
+
+	token.UserID = user.ID
+
+	query = `
+		INSERT INTO tokens (hash, user_id, expiry, scope, hash_algorithm)
+		VALUES ($1, $2, $3, $4, $5)`
+
+	_, err = tx.ExecContext(ctx, query, token.Hash, token.UserID, token.Expiry, token.Scope, token.HashAlgorithm)
+	if err != nil {
+		return err
+	}
+
+	var code *ActivationCode
+	if codeTTL != 0 {
+		code, err = insertActivationCode(ctx, tx, user.ID, codeTTL)
+		if err != nil {
+			return err
+		}
+	}
+
+	if templateData == nil {
+		templateData = defaultWelcomeData
+	}
+
+	err = insertOutboxEmail(ctx, tx, &OutboxEmail{
+		Recipient: user.Email,
+		Template:  templateFile,
+		Data:      templateData(token, code),
+	})
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	m.Metrics.Inserts.Add(1)
+	return nil
+}
+
+// SearchByEmail returns up to limit users whose email address starts with prefix
+// (case-insensitively), ordered by email, for admin typeahead. Only the prefix is
+// matched so that the pattern is anchored. The password hashes are not loaded. Service
+// accounts are left out unless includeService is true.
+func (m UserModel) SearchByEmail(prefix string, limit int, includeService bool) ([]*User, error) {
+	// Escape any LIKE wildcards in the prefix, so that they are matched literally.
+	pattern := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(prefix) + "%"
+
+	query := `
+		SELECT id, created_at, name, email, activated, version, metadata, locale, timezone, display_name, is_service, tenant_id, status
+		FROM users
+		WHERE email ILIKE $1
+		AND (NOT is_service OR $3)
+		ORDER BY email
+		LIMIT $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, pattern, limit, includeService)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []*User{}
+
+	for rows.Next() {
+		var user User
+
+		err := rows.Scan(
+			&user.ID,
+			&user.CreatedAt,
+			&user.Name,
+			&user.Email,
+			&user.Activated,
+			&user.Version,
+			&user.Metadata,
+			&user.Locale,
+			&user.Timezone,
+			&user.DisplayName,
+			&user.IsService,
+			&user.TenantID,
+			&user.Status,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		users = append(users, &user)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return users, nil
+}
+
+// Merge folds the source user into the target user, for when someone has accidentally
+// created two accounts. In a single transaction the source's authentication tokens and
+// permissions are moved to the target (permissions the target already has are skipped),
+// and any emails still waiting to be sent to the source are re-addressed to the
+// target. Then the source user is deleted, along with everything else of theirs, in
+// the same way as Erase. ErrRecordNotFound is returned if either user doesn't exist.
+func (m UserModel) Merge(sourceID, targetID int64) error {
+	if sourceID < 1 || targetID < 1 {
+		return ErrRecordNotFound
+	}
+
+	if sourceID == targetID {
+		return ErrMergeSameUser
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Lock both users, in id order so two concurrent merges can't deadlock, and check
+	// that they both exist.
+	rows, err := tx.QueryContext(ctx, "SELECT id FROM users WHERE id = ANY($1) ORDER BY id FOR UPDATE", pq.Array([]int64{sourceID, targetID}))
+	if err != nil {
+		return err
+	}
+
+	found := 0
+	for rows.Next() {
+		found++
+	}
+
+	if err = rows.Err(); err != nil {
+		rows.Close()
+		return err
+	}
+	rows.Close()
+
+	if found != 2 {
+		return ErrRecordNotFound
+	}
+
+	// Only sessions are moved across. An activation token for the source would
+	// otherwise activate the target, so those are deleted with the source below.
+	_, err = tx.ExecContext(ctx, "UPDATE tokens SET user_id = $1 WHERE user_id = $2 AND scope = $3", targetID, sourceID, ScopeAuthentication)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		INSERT INTO users_permissions (user_id, permission_id, expires_at)
+		SELECT $1, permission_id, expires_at FROM users_permissions WHERE user_id = $2
+		ON CONFLICT DO NOTHING`
+
+	_, err = tx.ExecContext(ctx, query, targetID, sourceID)
+	if err != nil {
+		return err
+	}
+
+	for _, query := range mergeEmailQueries {
+		_, err = tx.ExecContext(ctx, query, targetID, sourceID)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Bump the target's version, so that anyone holding a copy of it from before the
+	// merge gets an edit conflict.
+	_, err = tx.ExecContext(ctx, "UPDATE users SET version = version + 1 WHERE id = $1", targetID)
+	if err != nil {
+		return err
+	}
+
+	// Delete the rest of the source's rows explicitly, as Erase does, rather than
+	// relying on ON DELETE CASCADE. Its emails have already been moved, so there are
+	// none of those left to delete.
+	_, err = deleteAllTokensForUser(ctx, tx, sourceID)
+	if err != nil {
+		return err
+	}
+
+	for _, query := range eraseQueries {
+		_, err = tx.ExecContext(ctx, query, sourceID)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM users WHERE id = $1", sourceID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// The number of password hashes read per query by HashCostHistogram.
+const hashCostBatchSize = 1000
+
+// HashCostHistogram counts the users' password hashes by bcrypt cost, to help decide
+// whether a cost upgrade is needed. Hashes which bcrypt can't parse are counted under
+// a cost of 0. The users are read in batches (each with its own timeout), so that
+// memory use stays bounded however big the table is.
+func (m UserModel) HashCostHistogram() (map[int]int, error) {
+	query := `
+		SELECT id, password_hash
+		FROM users
+		WHERE id > $1
+		ORDER BY id
+		LIMIT $2`
+
+	histogram := make(map[int]int)
+	var lastID int64
+
+	for {
+		n, err := func() (int, error) {
+			ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+			defer cancel()
+
+			rows, err := m.DB.QueryContext(ctx, query, lastID, hashCostBatchSize)
+			if err != nil {
+				return 0, err
+			}
+			defer rows.Close()
+
+			n := 0
+			for rows.Next() {
+				var hash []byte
+
+				err := rows.Scan(&lastID, &hash)
+				if err != nil {
+					return 0, err
+				}
+
+				cost, err := bcrypt.Cost(hash)
+				if err != nil {
+					cost = 0
+				}
+
+				histogram[cost]++
+				n++
+			}
+
+			return n, rows.Err()
+		}()
+		if err != nil {
+			return nil, err
+		}
+
+		if n < hashCostBatchSize {
+			return histogram, nil
+		}
+	}
+}
+
+// RehashPassword replaces the user's password hash with a new one from m.Hasher, for
+// upgrading the hash (e.g. to a higher bcrypt cost) transparently when a user logs in.
+// It only goes ahead if the plaintext matches the current hash (returning
+// ErrPasswordMismatch otherwise), and does nothing if the hasher says that the current
+// hash doesn't need replacing (e.g. because another login got there first). The update
+// is guarded by the version check, so it returns ErrEditConflict if the user was
+// changed in the meantime (e.g. by a password change). The password_changed_at time is
+// left alone, as the password itself hasn't changed.
+func (m UserModel) RehashPassword(id int64, plaintext string) error {
+	query := `
+		SELECT password_hash, version
+		FROM users
+		WHERE id = $1`
+
+	var (
+		current password
+		version int
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(&current.hash, &version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+
+	match, err := current.Matches(m.Hasher, plaintext)
+	if err != nil {
+		return err
+	}
+
+	if !match {
+		return ErrPasswordMismatch
+	}
+
+	if !current.NeedsRehash(m.Hasher) {
+		return nil
+	}
+
+	hash, err := m.Hasher.Hash(plaintext)
+	if err != nil {
+		return err
+	}
+
+	query = `
+		UPDATE users
+		SET password_hash = $1, version = version + 1
+		WHERE id = $2 AND version = $3`
+
+	result, err := m.DB.ExecContext(ctx, query, hash, id, version)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrEditConflict
+	}
+
+	return nil
+}
+
+// How long StreamAll can run for. This is much longer than our usual query timeout, as
+// the callback may be writing each user out to a slow client.
+const streamAllTimeout = 10 * time.Minute
+
+// StreamAll calls fn for every user, in id order, reading the rows one at a time so
+// that memory use doesn't grow with the size of the table. The password hashes are not
+// loaded. If fn returns an error, streaming stops and that error is returned. Note that
+// fn is called while the query is still open, so it shouldn't use the database itself.
+func (m UserModel) StreamAll(fn func(*User) error) error {
+	query := `
+		SELECT id, created_at, name, email, activated, version, password_changed_at, metadata, locale, timezone, display_name, is_service, tenant_id, status
+		FROM users
+		ORDER BY id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), streamAllTimeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var user User
+
+		err := rows.Scan(
+			&user.ID,
+			&user.CreatedAt,
+			&user.Name,
+			&user.Email,
+			&user.Activated,
+			&user.Version,
+			&user.PasswordChangedAt,
+			&user.Metadata,
+			&user.Locale,
+			&user.Timezone,
+			&user.DisplayName,
+			&user.IsService,
+			&user.TenantID,
+			&user.Status,
+		)
+		if err != nil {
+			return err
+		}
+
+		err = fn(&user)
+		if err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// CancelEmailChange abandons the user's pending email change: the pending address is
+// cleared and any outstanding email change tokens are deleted, so the confirmation link
+// stops working. The user's current email address is untouched. If the user has no
+// pending change (or doesn't exist), ErrRecordNotFound is returned.
+func (m UserModel) CancelEmailChange(id int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+		UPDATE users
+		SET pending_email = NULL
+		WHERE id = $1 AND pending_email IS NOT NULL`
+
+	result, err := tx.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	query = `
+		DELETE FROM tokens
+		WHERE scope = $1 AND user_id = $2`
+
+	_, err = tx.ExecContext(ctx, query, ScopeEmailChange, id)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// GetAllWithPermission returns a page of the users who have been granted the
+// permission with the given code (and whose grant hasn't expired), for reporting on who
+// can do what. The password hashes are not loaded. The sort column is qualified with
+// the users table, as id is ambiguous in the join.
+func (m UserModel) GetAllWithPermission(code string, filters Filters) ([]*User, Metadata, error) {
+	query := fmt.Sprintf(`
+		SELECT count(*) OVER(), users.id, users.created_at, users.name, users.email, users.activated, users.version, users.metadata, users.locale, users.timezone, users.display_name, users.is_service, users.tenant_id, users.status
+		FROM users
+		INNER JOIN users_permissions ON users_permissions.user_id = users.id
+		INNER JOIN permissions ON users_permissions.permission_id = permissions.id
+		WHERE permissions.code = $1
+		AND (users_permissions.expires_at IS NULL OR users_permissions.expires_at > NOW())
+		ORDER BY users.%s %s, users.id ASC
+		LIMIT $2 OFFSET $3`, filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, code, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	users := []*User{}
+
+	for rows.Next() {
+		var user User
+
+		err := rows.Scan(
+			&totalRecords,
+			&user.ID,
+			&user.CreatedAt,
+			&user.Name,
+			&user.Email,
+			&user.Activated,
+			&user.Version,
+			&user.Metadata,
+			&user.Locale,
+			&user.Timezone,
+			&user.DisplayName,
+			&user.IsService,
+			&user.TenantID,
+			&user.Status,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		users = append(users, &user)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return users, metadata, nil
+}
+
+// VerifyPassword checks a plaintext password against the user's current hash, for
+// re-authenticating before a sensitive action. Only the hash is loaded, and it never
+// leaves the model. The comparison is done by the model's Hasher (bcrypt), which is
+// constant time. It returns false if the password doesn't match, and ErrRecordNotFound
+// if there is no such user.
+func (m UserModel) VerifyPassword(id int64, plaintext string) (bool, error) {
+	query := `
+		SELECT password_hash
+		FROM users
+		WHERE id = $1`
+
+	var current password
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(&current.hash)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return false, ErrRecordNotFound
+		default:
+			return false, err
+		}
+	}
+
+	return current.Matches(m.Hasher, plaintext)
+}
+
+// GetRecent returns the most recently created users, newest first, for a moderation
+// queue of new signups. The limit is capped at MaxRecentUsers, and the password hashes
+// are not loaded. Service accounts are left out unless includeService is true.
+func (m UserModel) GetRecent(limit int, includeService bool) ([]*User, error) {
+	if limit > MaxRecentUsers {
+		limit = MaxRecentUsers
+	}
+
+	query := `
+		SELECT id, created_at, name, email, activated, version, metadata, locale, timezone, display_name, is_service, tenant_id, status
+		FROM users
+		WHERE NOT is_service OR $2
+		ORDER BY created_at DESC, id DESC
+		LIMIT $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, limit, includeService)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []*User{}
+
+	for rows.Next() {
+		var user User
+
+		err := rows.Scan(
+			&user.ID,
+			&user.CreatedAt,
+			&user.Name,
+			&user.Email,
+			&user.Activated,
+			&user.Version,
+			&user.Metadata,
+			&user.Locale,
+			&user.Timezone,
+			&user.DisplayName,
+			&user.IsService,
+			&user.TenantID,
+			&user.Status,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		users = append(users, &user)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return users, nil
+}
+
+// GetStaleUnactivated returns the users who still haven't activated their account
+// more than olderThan after signing up, oldest first, so that a job can send them a
+// final reminder or delete them. The password hashes are not loaded.
+func (m UserModel) GetStaleUnactivated(olderThan time.Duration) ([]*User, error) {
+	query := `
+		SELECT id, created_at, name, email, activated, version, metadata, locale, timezone, display_name, is_service, tenant_id, status
+		FROM users
+		WHERE NOT activated AND created_at < $1
+		ORDER BY created_at, id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, time.Now().Add(-olderThan))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []*User{}
+
+	for rows.Next() {
+		var user User
+
+		err := rows.Scan(
+			&user.ID,
+			&user.CreatedAt,
+			&user.Name,
+			&user.Email,
+			&user.Activated,
+			&user.Version,
+			&user.Metadata,
+			&user.Locale,
+			&user.Timezone,
+			&user.DisplayName,
+			&user.IsService,
+			&user.TenantID,
+			&user.Status,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		users = append(users, &user)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return users, nil
+}
+
+// CreateServiceAccount inserts a service account, which is activated straight away
+// (there's no one to verify the email address), and grants it the given permissions,
+// in one transaction.
+func (m UserModel) CreateServiceAccount(user *User, permissionCodes ...string) error {
+	user.Activated = true
+	user.IsService = true
+	user.defaultDisplayName()
+	user.Status = StatusOf(user)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+		INSERT INTO users (name, email, password_hash, activated, metadata, is_service, display_name, tenant_id, status)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		RETURNING id, created_at, version, locale, timezone`
+
+	args := []interface{}{user.Name, user.Email, user.Password.hash, user.Activated, user.Metadata, user.IsService, user.DisplayName, user.TenantID, user.Status}
+
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&user.ID, &user.CreatedAt, &user.Version, &user.Locale, &user.Timezone)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "users_tenant_id_email_key"`:
+			m.Metrics.DuplicateEmails.Add(1)
+			return ErrDuplicateEmail
+		default:
+			return err
+		}
+	}
+
+	query = `
+		INSERT INTO users_permissions
+		SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)`
+
+	_, err = tx.ExecContext(ctx, query, user.ID, pq.Array(permissionCodes))
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	m.Metrics.Inserts.Add(1)
+	return nil
 }
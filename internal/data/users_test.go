@@ -0,0 +1,226 @@
+package data
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/bal3000/greenlight/internal/validator"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestValidatePhone(t *testing.T) {
+	tests := []struct {
+		phone   string
+		wantErr string
+	}{
+		{phone: "+447911123456"},
+		{phone: "+14155552671"},
+		{phone: "", wantErr: "must be provided"},
+		{phone: "07911123456", wantErr: "must include a country code starting with +"},
+		{phone: "+44 7911 123456", wantErr: "must be a valid E.164 phone number"},
+		{phone: "+1234567890123456", wantErr: "must be a valid E.164 phone number"},
+	}
+
+	for _, tt := range tests {
+		v := validator.New()
+		ValidatePhone(v, tt.phone)
+
+		if got := v.Errors["phone"]; got != tt.wantErr {
+			t.Errorf("ValidatePhone(%q): got error %q; want %q", tt.phone, got, tt.wantErr)
+		}
+	}
+}
+
+func TestPasswordSetRejectsBcryptHash(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("pa55word1234"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var p password
+
+	err = p.Set(defaultHasher, string(hash))
+	if !errors.Is(err, ErrPasswordAlreadyHashed) {
+		t.Fatalf("got error %v; want ErrPasswordAlreadyHashed", err)
+	}
+
+	if p.hash != nil || p.plaintext != nil {
+		t.Error("expected the password to be left unset")
+	}
+}
+
+func TestIsBcryptHash(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("pa55word1234"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		s    string
+		want bool
+	}{
+		{name: "$2a$ hash", s: string(hash), want: true},
+		{name: "$2b$ hash", s: "$2b$" + string(hash[4:]), want: true},
+		{name: "$2y$ hash", s: "$2y$" + string(hash[4:]), want: true},
+		{name: "unknown version", s: "$2x$" + string(hash[4:])},
+		{name: "bad cost", s: "$2a$xx" + string(hash[6:])},
+		{name: "truncated", s: string(hash[:59])},
+		{name: "60 byte password", s: strings.Repeat("a", 60)},
+		{name: "short password", s: "pa55word1234"},
+	}
+
+	for _, tt := range tests {
+		if got := isBcryptHash(tt.s); got != tt.want {
+			t.Errorf("%s: isBcryptHash(%q) = %t; want %t", tt.name, tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestValidatePasswordForUser(t *testing.T) {
+	user := &User{Name: "Alice Smith", Email: "alice.smith@example.com"}
+
+	tests := []struct {
+		name     string
+		password string
+		wantErr  bool
+	}{
+		{name: "unrelated", password: "correct horse battery"},
+		{name: "equals name", password: "Alice Smith", wantErr: true},
+		{name: "contains name", password: "alice smith 1234", wantErr: true},
+		{name: "name in another case", password: "xxALICE SMITHxx", wantErr: true},
+		{name: "equals local part", password: "alice.smith", wantErr: true},
+		{name: "contains local part", password: "my-alice.smith-pw", wantErr: true},
+		{name: "local part in another case", password: "ALICE.SMITH!!", wantErr: true},
+		{name: "only the first name", password: "alice in wonderland"},
+		{name: "only the domain", password: "example.com rocks"},
+	}
+
+	for _, tt := range tests {
+		v := validator.New()
+		ValidatePasswordForUser(v, tt.password, user)
+
+		_, gotErr := v.Errors["password"]
+		if gotErr != tt.wantErr {
+			t.Errorf("%s: got error %t; want %t (errors %v)", tt.name, gotErr, tt.wantErr, v.Errors)
+		}
+	}
+}
+
+func TestValidatePasswordForUserShortValues(t *testing.T) {
+	// A name or local part shorter than 3 characters would reject far too many
+	// passwords, so it's ignored.
+	user := &User{Name: "Al", Email: "al@example.com"}
+
+	v := validator.New()
+	ValidatePasswordForUser(v, "always remember", user)
+
+	if !v.Valid() {
+		t.Errorf("expected a short name to be ignored, got %v", v.Errors)
+	}
+}
+
+func TestValidateURL(t *testing.T) {
+	tests := []struct {
+		value   string
+		wantErr string
+	}{
+		{value: ""}, // optional
+		{value: "https://alice.example.com"},
+		{value: "https://example.com/" + strings.Repeat("a", 2028)}, // exactly 2048 bytes
+		{value: "https://example.com/" + strings.Repeat("a", 2029), wantErr: "must not be more than 2048 bytes long"},
+		{value: "javascript:alert(1)", wantErr: "must be a valid http or https URL"},
+		{value: "data:text/html,<script>alert(1)</script>", wantErr: "must be a valid http or https URL"},
+		{value: "alice.example.com", wantErr: "must be a valid http or https URL"},
+	}
+
+	for _, tt := range tests {
+		v := validator.New()
+		ValidateURL(v, "website", tt.value)
+
+		if got := v.Errors["website"]; got != tt.wantErr {
+			t.Errorf("ValidateURL(%.40q): got error %q; want %q", tt.value, got, tt.wantErr)
+		}
+	}
+}
+
+// TestEraseCoversUserData checks that Erase deletes from every table which holds a
+// user's ID or email address, and that Merge moves every email that Erase would
+// delete, so that adding such a table without updating them is caught.
+func TestEraseCoversUserData(t *testing.T) {
+	files, err := filepath.Glob("../../migrations/*.up.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatal("no migrations found")
+	}
+
+	createTable := regexp.MustCompile(`(?s)CREATE TABLE IF NOT EXISTS (\w+) \((.*?)\);`)
+	addColumn := regexp.MustCompile(`ALTER TABLE (\w+) ADD COLUMN IF NOT EXISTS (\w+)`)
+	personal := map[string]bool{"user_id": true, "recipient": true}
+
+	tables := map[string]bool{}
+
+	for _, file := range files {
+		sql, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, m := range createTable.FindAllStringSubmatch(string(sql), -1) {
+			for _, line := range strings.Split(m[2], "\n") {
+				if fields := strings.Fields(line); len(fields) > 0 && personal[fields[0]] {
+					tables[m[1]] = true
+				}
+			}
+		}
+
+		for _, m := range addColumn.FindAllStringSubmatch(string(sql), -1) {
+			if personal[m[2]] {
+				tables[m[1]] = true
+			}
+		}
+	}
+
+	for _, table := range []string{"email_outbox", "scheduled_emails", "idempotency_keys"} {
+		if !tables[table] {
+			t.Errorf("expected the migrations to give %s a user_id or recipient column", table)
+		}
+	}
+
+	// Tokens are deleted separately, by deleteAllTokensForUser.
+	delete(tables, "tokens")
+
+	hasQuery := func(queries []string, prefix string) bool {
+		for _, query := range queries {
+			if strings.HasPrefix(query, prefix) {
+				return true
+			}
+		}
+		return false
+	}
+
+	for table := range tables {
+		if !hasQuery(append(eraseQueries, eraseEmailQueries...), "DELETE FROM "+table+" ") {
+			t.Errorf("Erase doesn't delete from %s", table)
+		}
+	}
+
+	for _, query := range eraseEmailQueries {
+		table := strings.Fields(query)[2]
+		if !hasQuery(mergeEmailQueries, "UPDATE "+table+" ") {
+			t.Errorf("Merge doesn't move the emails in %s", table)
+		}
+	}
+
+	for _, query := range append(eraseQueries, eraseEmailQueries...) {
+		if strings.Contains(query, "$2") {
+			t.Errorf("erase query %q must only take the user's ID", query)
+		}
+	}
+}
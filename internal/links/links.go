@@ -0,0 +1,57 @@
+package links
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+
+	"github.com/bal3000/greenlight/internal/validator"
+)
+
+var ErrInvalidBaseURL = errors.New("base URL must be an absolute http or https URL")
+
+// Builder builds the links that go in emails, all relative to the base URL of the
+// frontend for the current environment, so that they're consistent everywhere.
+type Builder struct {
+	base *url.URL
+}
+
+// New returns a Builder for the given base URL, e.g. "https://greenlight.example.com".
+// The base URL may include a path prefix.
+func New(baseURL string) (*Builder, error) {
+	if !validator.IsURL(baseURL) {
+		return nil, ErrInvalidBaseURL
+	}
+
+	base, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, ErrInvalidBaseURL
+	}
+
+	base.Path = strings.TrimSuffix(base.Path, "/")
+	base.RawQuery = ""
+	base.Fragment = ""
+
+	return &Builder{base: base}, nil
+}
+
+// build returns the URL for the path, with the token as a query parameter.
+func (b *Builder) build(path, token string) string {
+	u := *b.base
+	u.Path += path
+	u.RawQuery = url.Values{"token": {token}}.Encode()
+
+	return u.String()
+}
+
+func (b *Builder) BuildActivationURL(token string) string {
+	return b.build("/users/activate", token)
+}
+
+func (b *Builder) BuildPasswordResetURL(token string) string {
+	return b.build("/users/password-reset", token)
+}
+
+func (b *Builder) BuildEmailChangeURL(token string) string {
+	return b.build("/users/email-change", token)
+}
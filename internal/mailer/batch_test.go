@@ -0,0 +1,91 @@
+package mailer
+
+import (
+	"context"
+	netmail "net/mail"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// toHeader parses the To header of a message received by the stub server.
+func toHeader(t *testing.T, msg stubMessage) []string {
+	t.Helper()
+
+	parsed, err := netmail.ReadMessage(strings.NewReader(msg.data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	list, err := parsed.Header.AddressList("To")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addresses := make([]string, 0, len(list))
+	for _, addr := range list {
+		addresses = append(addresses, addr.Address)
+	}
+
+	return addresses
+}
+
+func TestSendBatchIndividual(t *testing.T) {
+	s := newStubSMTP(t, nil)
+	m := s.mailer()
+
+	recipients := []string{"alice@example.com", "bob@example.com", "carol@example.com"}
+
+	err := m.SendBatch(context.Background(), recipients, "user_welcome.tmpl", nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := s.received()
+	if len(got) != len(recipients) {
+		t.Fatalf("server received %d messages; want one per recipient", len(got))
+	}
+
+	for i, msg := range got {
+		want := []string{recipients[i]}
+
+		if to := toHeader(t, msg); !reflect.DeepEqual(to, want) {
+			t.Errorf("message %d: To header lists %q; want only %q", i, to, want)
+		}
+
+		if len(msg.to) != 1 || !strings.Contains(msg.to[0], recipients[i]) {
+			t.Errorf("message %d: sent to %q; want only %q", i, msg.to, recipients[i])
+		}
+
+		for _, other := range recipients {
+			if other != recipients[i] && strings.Contains(msg.data, other) {
+				t.Errorf("message %d: leaks the address %q", i, other)
+			}
+		}
+	}
+}
+
+func TestSendBatchShared(t *testing.T) {
+	s := newStubSMTP(t, nil)
+	m := s.mailer()
+
+	recipients := []string{"alice@example.com", "bob@example.com", "carol@example.com"}
+
+	err := m.SendBatch(context.Background(), recipients, "user_welcome.tmpl", nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := s.received()
+	if len(got) != 1 {
+		t.Fatalf("server received %d messages; want 1", len(got))
+	}
+
+	if to := toHeader(t, got[0]); !reflect.DeepEqual(to, recipients) {
+		t.Errorf("To header lists %q; want %q", to, recipients)
+	}
+
+	if len(got[0].to) != len(recipients) {
+		t.Errorf("sent to %d recipients; want %d", len(got[0].to), len(recipients))
+	}
+}
@@ -2,9 +2,22 @@ package mailer
 
 import (
 	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
 	"embed"
+	"errors"
 	"fmt"
 	"html/template"
+	"io"
+	"io/fs"
+	"net"
+	netmail "net/mail"
+	"net/textproto"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-mail/mail/v2"
@@ -13,76 +26,1079 @@ import (
 //go:embed "templates"
 var templateFS embed.FS
 
+var (
+	ErrTemplateNotFound = errors.New("template not found")
+	ErrSuppressed       = errors.New("recipient is on the suppression list")
+	ErrInvalidHeader    = errors.New("invalid custom header")
+
+	// ErrMailDeliveryFailed is matched (via errors.Is) by the error returned when every
+	// attempt to send a message has failed.
+	ErrMailDeliveryFailed = errors.New("mail delivery failed")
+
+	// ErrBodyTooLarge is matched (via errors.Is) by the error returned when a rendered
+	// email is bigger than the mailer's maximum body size.
+	ErrBodyTooLarge = errors.New("email body too large")
+
+	// ErrTooManyRecipients is matched (via errors.Is) by the error returned when a batch
+	// has more recipients than the mailer's limit.
+	ErrTooManyRecipients = errors.New("too many recipients")
+
+	// ErrSpam is matched (via errors.Is) by the error returned when the spam checker
+	// scores a rendered email above the threshold.
+	ErrSpam = errors.New("email looks like spam")
+
+	// Errors returned by Verify, so that a bad password can be told apart from a server
+	// which can't be reached.
+	ErrSMTPAuth        = errors.New("smtp authentication failed")
+	ErrSMTPUnreachable = errors.New("smtp server unreachable")
+)
+
+// DefaultMaxBodySize is the default limit on the combined size of the rendered bodies
+// of an email. It's far bigger than any real email should be, and is only there to
+// catch templates that have gone wrong.
+const DefaultMaxBodySize = 1 << 20
+
+// BodySizeError is returned when the rendered bodies of an email add up to more than
+// the maximum body size. It matches ErrBodyTooLarge with errors.Is.
+type BodySizeError struct {
+	Size  int
+	Limit int
+}
+
+func (e *BodySizeError) Error() string {
+	return fmt.Sprintf("%s: %d bytes exceeds the limit of %d bytes", ErrBodyTooLarge, e.Size, e.Limit)
+}
+
+func (e *BodySizeError) Is(target error) bool {
+	return target == ErrBodyTooLarge
+}
+
+// SpamChecker scores a rendered email (subject and all of the bodies) for how likely it
+// is to be treated as spam, where higher is worse. The scale is up to the
+// implementation; the threshold passed to WithSpamChecker must use the same one.
+type SpamChecker interface {
+	Score(ctx context.Context, rendered *Rendered) (float64, error)
+}
+
+// NopSpamChecker is the default SpamChecker. It scores everything 0.
+type NopSpamChecker struct{}
+
+func (NopSpamChecker) Score(ctx context.Context, rendered *Rendered) (float64, error) {
+	return 0, nil
+}
+
+// SpamError is returned when a rendered email scores above the spam threshold. It
+// matches ErrSpam with errors.Is.
+type SpamError struct {
+	Score     float64
+	Threshold float64
+}
+
+func (e *SpamError) Error() string {
+	return fmt.Sprintf("%s: score %g exceeds the threshold of %g", ErrSpam, e.Score, e.Threshold)
+}
+
+func (e *SpamError) Is(target error) bool {
+	return target == ErrSpam
+}
+
+// DefaultMaxRecipients is the default limit on the number of recipients in one call to
+// SendBatch.
+const DefaultMaxRecipients = 50
+
+// RecipientLimitError is returned when a batch has more recipients than the limit. It
+// matches ErrTooManyRecipients with errors.Is.
+type RecipientLimitError struct {
+	Count int
+	Limit int
+}
+
+func (e *RecipientLimitError) Error() string {
+	return fmt.Sprintf("%s: %d recipients exceeds the limit of %d", ErrTooManyRecipients, e.Count, e.Limit)
+}
+
+func (e *RecipientLimitError) Is(target error) bool {
+	return target == ErrTooManyRecipients
+}
+
+// DeliveryError is returned when every attempt to send a message fails. It matches
+// ErrMailDeliveryFailed with errors.Is, and unwraps to the error from the last attempt,
+// so callers can check for both.
+type DeliveryError struct {
+	Attempts int
+	Err      error
+}
+
+func (e *DeliveryError) Error() string {
+	return fmt.Sprintf("%s after %d attempts: %v", ErrMailDeliveryFailed, e.Attempts, e.Err)
+}
+
+func (e *DeliveryError) Unwrap() error {
+	return e.Err
+}
+
+func (e *DeliveryError) Is(target error) bool {
+	return target == ErrMailDeliveryFailed
+}
+
+// SuppressionList reports whether an address has bounced or complained, and so
+// shouldn't be sent any more email. data.SuppressionModel satisfies it.
+type SuppressionList interface {
+	IsSuppressed(email string) (bool, error)
+}
+
+// Rendered holds the output of executing the subject, plainBody and htmlBody blocks of
+// an email template, plus the optional ampBody block.
+type Rendered struct {
+	Subject   string
+	PlainBody string
+	HTMLBody  string
+	AMPBody   string
+}
+
+// Mailer sends emails rendered from the embedded templates. It is safe for concurrent
+// use once New has returned: everything except the send health and the override cache
+// is only written by the options during New (templates are parsed afresh for each send,
+// and each send dials its own connection), and those two are guarded by their own
+// mutexes.
 type Mailer struct {
-	dialer *mail.Dialer
-	sender string
+	dialer         *mail.Dialer
+	sender         string
+	replyTo        string
+	envelopeSender string
+	charset        string
+	encoding       TransferEncoding
+	images         []string
+	subjectPrefix  string
+	subjects       map[string]string
+	suppressions   SuppressionList
+	maxBodySize    int
+	maxRecipients  int
+	spamChecker    SpamChecker
+	spamThreshold  float64
+	mjmlCompiler   MJMLCompiler
+	funcs          template.FuncMap
+	health         *health
+	overrides      *overrideCache
+
+	// templates holds the templates directory. It's always the embedded templateFS
+	// outside of tests.
+	templates fs.FS
+}
+
+// overrideCache remembers which template Override resolved for each template and
+// override key. The templates are embedded, so a resolution never goes stale.
+type overrideCache struct {
+	mu    sync.RWMutex
+	names map[string]string
+}
+
+// TransferEncoding is the Content-Transfer-Encoding used for the message bodies.
+type TransferEncoding string
+
+const (
+	QuotedPrintable TransferEncoding = "quoted-printable" // the default
+	Base64          TransferEncoding = "base64"
+	Unencoded       TransferEncoding = "8bit"
+)
+
+// ParseTransferEncoding converts a config value into a TransferEncoding, returning an
+// error if the encoding isn't supported.
+func ParseTransferEncoding(s string) (TransferEncoding, error) {
+	switch e := TransferEncoding(s); e {
+	case QuotedPrintable, Base64, Unencoded:
+		return e, nil
+	default:
+		return "", fmt.Errorf("unsupported transfer encoding %q", s)
+	}
+}
+
+// health records the outcome of recent sends. Mailer is passed around by value, so it
+// holds a pointer to this to share it between copies, and the mutex is needed because
+// the queue's workers send concurrently.
+type health struct {
+	mu          sync.Mutex
+	lastSuccess time.Time
+	lastError   error
+}
+
+// An Option configures optional behaviour of the Mailer.
+type Option func(*Mailer)
+
+// WithReplyTo sets a Reply-To header on every email, so that replies to our no-reply
+// sender address are routed somewhere useful (e.g. support@). The address should be
+// checked with net/mail.ParseAddress before it's passed in.
+func WithReplyTo(address string) Option {
+	return func(m *Mailer) {
+		m.replyTo = address
+	}
+}
+
+// WithEnvelopeSender sets the SMTP envelope sender (MAIL FROM), which is where bounces
+// are delivered, separately from the From header that recipients see. If the address
+// contains "{recipient}" it is replaced with the recipient's address in VERP form
+// (e.g. "bounces+{recipient}@example.com" becomes "bounces+alice=example.org@example.com"),
+// so that bounces can be matched back to the address that failed. Messages with more
+// than one recipient use "batch" in place of the recipient.
+func WithEnvelopeSender(address string) Option {
+	return func(m *Mailer) {
+		m.envelopeSender = address
+	}
+}
+
+// WithMinTLSVersion sets the lowest TLS version (e.g. tls.VersionTLS13) that the
+// dialer will accept from the SMTP server, for both implicit TLS and STARTTLS. The
+// default is TLS 1.2.
+func WithMinTLSVersion(version uint16) Option {
+	return func(m *Mailer) {
+		m.dialer.TLSConfig.MinVersion = version
+	}
+}
+
+// ParseTLSVersion converts a version such as "1.2" into its crypto/tls constant.
+func ParseTLSVersion(s string) (uint16, error) {
+	switch s {
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	default:
+		return 0, fmt.Errorf("unsupported TLS version %q", s)
+	}
+}
+
+// WithCharset sets the charset of the message headers and bodies. The default is UTF-8.
+// Note that the templates are still rendered as UTF-8, so this should only be changed
+// for relays which insist on another label.
+func WithCharset(charset string) Option {
+	return func(m *Mailer) {
+		m.charset = charset
+	}
+}
+
+// WithTransferEncoding sets how the message bodies are encoded. The default is
+// quoted-printable.
+func WithTransferEncoding(encoding TransferEncoding) Option {
+	return func(m *Mailer) {
+		m.encoding = encoding
+	}
+}
+
+// WithEmbedImages lists images (in the templates/images directory) which can be used
+// in the HTML body of any template. Each one is referenced by its file name without the
+// extension, e.g. <img src="cid:logo"> for "logo.png", and is only attached to the
+// messages which reference it.
+func WithEmbedImages(files ...string) Option {
+	return func(m *Mailer) {
+		m.images = append(m.images, files...)
+	}
+}
+
+// WithSubjectPrefix prepends a prefix to every subject, e.g. "[STAGING] ", so that
+// emails from test environments are obvious. Include any separating space in the
+// prefix.
+func WithSubjectPrefix(prefix string) Option {
+	return func(m *Mailer) {
+		m.subjectPrefix = prefix
+	}
+}
+
+// WithSubjects overrides the subject line of individual templates, keyed by template
+// file name (e.g. "token_activation.tmpl"), so that subjects can be branded without
+// editing the templates. Each subject is itself a template, executed with the same data
+// and functions as the subject block it replaces, and the subject prefix is still added
+// in front. Localized templates are separate files, so they need their own entries.
+// Call CheckSubjects once the Mailer has been created to validate them.
+func WithSubjects(subjects map[string]string) Option {
+	return func(m *Mailer) {
+		m.subjects = subjects
+	}
+}
+
+// WithSuppressionList makes the mailer check every recipient against the list before
+// sending. Suppressed recipients are skipped, and a message to a single suppressed
+// recipient fails with ErrSuppressed.
+func WithSuppressionList(list SuppressionList) Option {
+	return func(m *Mailer) {
+		m.suppressions = list
+	}
+}
+
+// WithMaxBodySize changes the limit on the combined size, in bytes, of the rendered
+// plain text, HTML and AMP bodies (DefaultMaxBodySize if not set). Messages over the
+// limit fail with a *BodySizeError before anything is sent. Zero disables the check.
+func WithMaxBodySize(size int) Option {
+	return func(m *Mailer) {
+		m.maxBodySize = size
+	}
 }
 
-func New(host string, port int, username, password, sender string) Mailer {
+// WithMaxRecipients changes the limit on the number of recipients that SendBatch
+// accepts (DefaultMaxRecipients if not set). Batches over the limit fail with a
+// *RecipientLimitError before anything is sent. Zero disables the check, for
+// legitimate bulk mailing.
+func WithMaxRecipients(max int) Option {
+	return func(m *Mailer) {
+		m.maxRecipients = max
+	}
+}
+
+// WithSpamChecker runs every rendered email through the checker before it is sent, and
+// refuses to send (with a *SpamError) any that score above the threshold. The email is
+// only rendered once for a batch, so it is only checked once too.
+func WithSpamChecker(checker SpamChecker, threshold float64) Option {
+	return func(m *Mailer) {
+		m.spamChecker = checker
+		m.spamThreshold = threshold
+	}
+}
+
+// WithMJMLCompiler compiles the "mjmlBody" block of templates which define one, and
+// uses the result as the HTML body in place of the "htmlBody" block. Templates without
+// an "mjmlBody" block are unaffected.
+func WithMJMLCompiler(compiler MJMLCompiler) Option {
+	return func(m *Mailer) {
+		m.mjmlCompiler = compiler
+	}
+}
+
+// defaultFuncs are the helpers available to every template, on top of the built-ins.
+var defaultFuncs = template.FuncMap{
+	"upper": strings.ToUpper,
+	"lower": strings.ToLower,
+	// formatDate formats a time with a Go layout, e.g. {{formatDate .expiry "2 Jan 2006"}}.
+	"formatDate": func(t time.Time, layout string) string {
+		return t.Format(layout)
+	},
+	// humanDuration formats a duration as a whole number of days, hours or minutes,
+	// e.g. "3 days".
+	"humanDuration": humanDuration,
+}
+
+func humanDuration(d time.Duration) string {
+	plural := func(n int, unit string) string {
+		if n == 1 {
+			return fmt.Sprintf("1 %s", unit)
+		}
+		return fmt.Sprintf("%d %ss", n, unit)
+	}
+
+	switch {
+	case d >= 24*time.Hour:
+		return plural(int(d/(24*time.Hour)), "day")
+	case d >= time.Hour:
+		return plural(int(d/time.Hour), "hour")
+	default:
+		return plural(int(d/time.Minute), "minute")
+	}
+}
+
+// WithFuncs adds functions which templates can call. They are added to the default
+// helpers (upper, lower, formatDate and humanDuration), replacing any with the same
+// name.
+func WithFuncs(funcs template.FuncMap) Option {
+	return func(m *Mailer) {
+		for name, fn := range funcs {
+			m.funcs[name] = fn
+		}
+	}
+}
+
+func New(host string, port int, username, password, sender string, opts ...Option) Mailer {
 	// Initialize a new mail.Dialer instance with the given SMTP server settings. We
 	// also configure this to use a 5-second timeout whenever we send an email.
 	dialer := mail.NewDialer(host, port, username, password)
 	dialer.Timeout = 5 * time.Second
 
-	return Mailer{
-		dialer: dialer,
-		sender: sender,
+	// Refuse to negotiate anything older than TLS 1.2 unless told otherwise. The
+	// ServerName matches what the dialer would have used if we'd left TLSConfig nil.
+	dialer.TLSConfig = &tls.Config{
+		ServerName: host,
+		MinVersion: tls.VersionTLS12,
+	}
+
+	m := Mailer{
+		dialer:        dialer,
+		sender:        sender,
+		charset:       "UTF-8",
+		encoding:      QuotedPrintable,
+		maxBodySize:   DefaultMaxBodySize,
+		maxRecipients: DefaultMaxRecipients,
+		spamChecker:   NopSpamChecker{},
+		funcs:         make(template.FuncMap, len(defaultFuncs)),
+		health:        &health{},
+		overrides:     &overrideCache{names: make(map[string]string)},
+		templates:     templateFS,
 	}
+
+	for name, fn := range defaultFuncs {
+		m.funcs[name] = fn
+	}
+
+	for _, opt := range opts {
+		opt(&m)
+	}
+
+	return m
 }
 
 // Send takes the recipient email address
 // as the first parameter, the name of the file containing the templates, and any
 // dynamic data for the templates as an interface{} parameter. TODO: Generics
 func (m Mailer) Send(recipient, templateFile string, data interface{}) error {
-	tmpl, err := template.New("email").ParseFS(templateFS, fmt.Sprintf("templates/%s", templateFile))
+	return m.Notify(context.Background(), recipient, templateFile, data)
+}
+
+// Notify implements the notifier.Notifier interface. It behaves exactly like Send, but
+// stops retrying if the context is cancelled.
+func (m Mailer) Notify(ctx context.Context, recipient, templateFile string, data interface{}) error {
+	_, err := m.SendDetailed(ctx, recipient, templateFile, data)
+	return err
+}
+
+// SendResult describes how a message was sent.
+type SendResult struct {
+	MessageID string        // the Message-ID header of the message
+	Server    string        // the SMTP server, as host:port
+	Attempts  int           // the number of attempts made, including the last one
+	Duration  time.Duration // the total time spent sending, including retries
+}
+
+// A SendOption configures a single call to SendDetailed.
+type SendOption func(*sendOptions)
+
+type sendOptions struct {
+	headers  map[string]string
+	override string
+}
+
+// WithOverride renders the message from the template override for the given key (such
+// as a tenant or user ID), if there is one, rather than the default template. See
+// Mailer.Override.
+func WithOverride(key string) SendOption {
+	return func(o *sendOptions) {
+		o.override = key
+	}
+}
+
+// WithHeaders adds custom headers (e.g. X-Entity-Ref-ID) to the message. The headers
+// which the mailer sets itself, such as To, From and Subject, can't be overridden, and
+// SendDetailed returns ErrInvalidHeader if any of them are given.
+func WithHeaders(headers map[string]string) SendOption {
+	return func(o *sendOptions) {
+		o.headers = headers
+	}
+}
+
+// The headers which are set by the mailer, or by go-mail when it writes the message.
+var reservedHeaders = map[string]bool{
+	"To":                        true,
+	"Cc":                        true,
+	"Bcc":                       true,
+	"From":                      true,
+	"Sender":                    true,
+	"Reply-To":                  true,
+	"Subject":                   true,
+	"Message-Id":                true,
+	"Date":                      true,
+	"Mime-Version":              true,
+	"Content-Type":              true,
+	"Content-Transfer-Encoding": true,
+}
+
+// setCustomHeaders adds the headers to the message, after checking that they are
+// well-formed and don't clash with the reserved ones.
+func setCustomHeaders(msg *mail.Message, headers map[string]string) error {
+	for name, value := range headers {
+		canonical := textproto.CanonicalMIMEHeaderKey(name)
+
+		if reservedHeaders[canonical] {
+			return fmt.Errorf("%w: %s is set by the mailer", ErrInvalidHeader, name)
+		}
+
+		// Header names are printable ASCII without colons or spaces, and neither the
+		// name nor the value may contain line breaks (which would allow header
+		// injection).
+		if name == "" || strings.ContainsAny(name, ": \t\r\n") || strings.ContainsAny(value, "\r\n") {
+			return fmt.Errorf("%w: %q", ErrInvalidHeader, name)
+		}
+
+		msg.SetHeader(canonical, value)
+	}
+
+	return nil
+}
+
+// SendDetailed behaves like Notify, but also returns a SendResult for metrics and
+// debugging. The result is nil if the message was never built (for example, because
+// the template doesn't exist or the recipient is suppressed).
+func (m Mailer) SendDetailed(ctx context.Context, recipient, templateFile string, data interface{}, opts ...SendOption) (*SendResult, error) {
+	var options sendOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	allowed, err := m.filterSuppressed([]string{recipient})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(allowed) == 0 {
+		return nil, ErrSuppressed
+	}
+
+	if options.override != "" {
+		templateFile = m.Override(templateFile, options.override)
+	}
+
+	rendered, err := m.RenderOnly(templateFile, data)
+	if err != nil {
+		return nil, err
+	}
+
+	err = m.checkSpam(ctx, rendered)
+	if err != nil {
+		return nil, err
+	}
+
+	msg, err := m.newMessage(rendered, recipient)
+	if err != nil {
+		return nil, err
+	}
+
+	err = setCustomHeaders(msg, options.headers)
+	if err != nil {
+		return nil, err
+	}
+
+	return m.deliver(ctx, msg)
+}
+
+// SendBatch sends the same email to several recipients. If individual is true, each
+// recipient is sent their own copy with only their own address in the To header, so
+// that the recipient list isn't leaked. Otherwise a single message is sent with all of
+// the recipients in the To header. The template is only rendered once either way.
+// The recipient limit is checked before any suppressed recipients are filtered out.
+func (m Mailer) SendBatch(ctx context.Context, recipients []string, templateFile string, data interface{}, individual bool) error {
+	if m.maxRecipients > 0 && len(recipients) > m.maxRecipients {
+		return &RecipientLimitError{Count: len(recipients), Limit: m.maxRecipients}
+	}
+
+	recipients, err := m.filterSuppressed(recipients)
 	if err != nil {
 		return err
 	}
 
-	// Execute the named template "subject", passing in the dynamic data and storing the
-	// result in a bytes.Buffer variable.
-	var subject bytes.Buffer
-	err = tmpl.ExecuteTemplate(&subject, "subject", data)
+	if len(recipients) == 0 {
+		return nil
+	}
+
+	rendered, err := m.RenderOnly(templateFile, data)
 	if err != nil {
 		return err
 	}
 
-	var plainBody bytes.Buffer
-	err = tmpl.ExecuteTemplate(&plainBody, "plainBody", data)
+	err = m.checkSpam(ctx, rendered)
 	if err != nil {
 		return err
 	}
 
-	var htmlBody bytes.Buffer
-	err = tmpl.ExecuteTemplate(&htmlBody, "htmlBody", data)
+	if !individual {
+		msg, err := m.newMessage(rendered, recipients...)
+		if err != nil {
+			return err
+		}
+
+		_, err = m.deliver(ctx, msg)
+		return err
+	}
+
+	// Send each message separately (each with its own retries), so that a failure for
+	// one recipient doesn't cause the others to be sent duplicates on retry.
+	var (
+		failed   int
+		firstErr error
+	)
+
+	for _, recipient := range recipients {
+		msg, err := m.newMessage(rendered, recipient)
+		if err != nil {
+			return err
+		}
+
+		_, err = m.deliver(ctx, msg)
+		if err != nil {
+			failed++
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+
+	if firstErr != nil {
+		return fmt.Errorf("failed to send to %d of %d recipients: %w", failed, len(recipients), firstErr)
+	}
+
+	return nil
+}
+
+// checkSpam scores the rendered email with the spam checker, returning a *SpamError if
+// the score is over the threshold.
+func (m Mailer) checkSpam(ctx context.Context, rendered *Rendered) error {
+	score, err := m.spamChecker.Score(ctx, rendered)
 	if err != nil {
 		return err
 	}
 
-	msg := mail.NewMessage()
-	msg.SetHeader("To", recipient)
+	if score > m.spamThreshold {
+		return &SpamError{Score: score, Threshold: m.spamThreshold}
+	}
+
+	return nil
+}
+
+// newMessageID generates a unique Message-ID, using the domain of the sender address.
+func (m Mailer) newMessageID() string {
+	domain := "localhost"
+	if addr, err := netmail.ParseAddress(m.sender); err == nil {
+		if i := strings.LastIndex(addr.Address, "@"); i >= 0 {
+			domain = addr.Address[i+1:]
+		}
+	}
+
+	b := make([]byte, 16)
+	// crypto/rand only fails if the OS's CSPRNG is broken, in which case fall back on
+	// the time so that we still have a reasonably unique ID.
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("<%d@%s>", time.Now().UnixNano(), domain)
+	}
+
+	return fmt.Sprintf("<%x@%s>", b, domain)
+}
+
+// filterSuppressed returns the recipients which aren't on the suppression list (or all
+// of them, if there isn't a list).
+func (m Mailer) filterSuppressed(recipients []string) ([]string, error) {
+	if m.suppressions == nil {
+		return recipients, nil
+	}
+
+	allowed := make([]string, 0, len(recipients))
+
+	for _, recipient := range recipients {
+		suppressed, err := m.suppressions.IsSuppressed(recipient)
+		if err != nil {
+			return nil, err
+		}
+
+		if !suppressed {
+			allowed = append(allowed, recipient)
+		}
+	}
+
+	return allowed, nil
+}
+
+// newMessage builds the message for the rendered template, addressed to the given
+// recipients. Every send path goes through here, so this is where the body size is
+// checked.
+func (m Mailer) newMessage(rendered *Rendered, recipients ...string) (*mail.Message, error) {
+	if size := len(rendered.PlainBody) + len(rendered.HTMLBody) + len(rendered.AMPBody); m.maxBodySize > 0 && size > m.maxBodySize {
+		return nil, &BodySizeError{Size: size, Limit: m.maxBodySize}
+	}
+
+	msg := mail.NewMessage(mail.SetCharset(m.charset), mail.SetEncoding(mail.Encoding(m.encoding)))
+	msg.SetHeader("To", recipients...)
 	msg.SetHeader("From", m.sender)
-	msg.SetHeader("Subject", subject.String())
+	msg.SetHeader("Subject", rendered.Subject)
+	msg.SetHeader("Message-ID", m.newMessageID())
+
+	if m.replyTo != "" {
+		msg.SetHeader("Reply-To", m.replyTo)
+	}
 
 	// It's important to note that AddAlternative() should
 	// always be called *after* SetBody().
-	msg.SetBody("text/plain", plainBody.String())
-	msg.AddAlternative("text/html", htmlBody.String())
+	msg.SetBody("text/plain", rendered.PlainBody)
+
+	// The AMP part has to come before the HTML one, so that clients which don't support
+	// AMP fall back to the HTML (the last alternative they understand).
+	if rendered.AMPBody != "" {
+		msg.AddAlternative("text/x-amp-html", rendered.AMPBody)
+	}
+
+	msg.AddAlternative("text/html", rendered.HTMLBody)
+
+	err := m.embedImages(msg, rendered.HTMLBody)
+	if err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+// embedImages attaches each configured image that the HTML body references by CID.
+// go-mail puts embedded files in a multipart/related part alongside the
+// multipart/alternative bodies, which is what mail clients need to resolve cid: URLs.
+func (m Mailer) embedImages(msg *mail.Message, htmlBody string) error {
+	for _, file := range m.images {
+		cid := strings.TrimSuffix(file, path.Ext(file))
+		if !strings.Contains(htmlBody, "cid:"+cid) {
+			continue
+		}
+
+		name := path.Join("templates", "images", file)
+		if _, err := fs.Stat(m.templates, name); err != nil {
+			return fmt.Errorf("embedded image %q: %w", file, err)
+		}
+
+		// Read the image from the embedded FS each time the message is written, rather
+		// than from a reader, so that it's still there when a send is retried.
+		copyFunc := func(w io.Writer) error {
+			f, err := m.templates.Open(name)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+
+			_, err = io.Copy(w, f)
+			return err
+		}
+
+		msg.Embed(file,
+			mail.SetCopyFunc(copyFunc),
+			mail.SetHeader(map[string][]string{"Content-ID": {"<" + cid + ">"}}),
+		)
+	}
+
+	return nil
+}
+
+// deliver sends the message, retrying on failure.
+func (m Mailer) deliver(ctx context.Context, msg *mail.Message) (*SendResult, error) {
+	result := &SendResult{
+		Server: net.JoinHostPort(m.dialer.Host, strconv.Itoa(m.dialer.Port)),
+	}
+
+	if ids := msg.GetHeader("Message-ID"); len(ids) > 0 {
+		result.MessageID = ids[0]
+	}
+
+	start := time.Now()
+
+	var lastErr error
 
 	// Try sending the email up to three times before aborting and returning the final
 	// error. We sleep for 500 milliseconds between each attempt.
 	for i := 1; i <= 3; i++ {
-		// Call the DialAndSend() method on the dialer, passing in the message to send. This
-		// opens a connection to the SMTP server, sends the message, then closes the
+		if err := ctx.Err(); err != nil {
+			result.Duration = time.Since(start)
+			return result, err
+		}
+
+		// Open a connection to the SMTP server, send the message, then close the
 		// connection. If there is a timeout, it will return a "dial tcp: i/o timeout"
 		// error.
-		err = m.dialer.DialAndSend(msg)
+		result.Attempts = i
+		err := m.send(msg)
+		m.recordAttempt(err)
 		if err == nil {
-			return nil
+			result.Duration = time.Since(start)
+			return result, nil
+		}
+
+		lastErr = err
+
+		// Don't sleep after the final attempt.
+		if i == 3 {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			result.Duration = time.Since(start)
+			return result, ctx.Err()
+		case <-time.After(500 * time.Millisecond):
+		}
+	}
+
+	result.Duration = time.Since(start)
+	return result, &DeliveryError{Attempts: result.Attempts, Err: lastErr}
+}
+
+// recordAttempt updates the health of the mailer after an attempt to send a message.
+// A successful send clears the last error.
+func (m Mailer) recordAttempt(err error) {
+	m.health.mu.Lock()
+	defer m.health.mu.Unlock()
+
+	if err != nil {
+		m.health.lastError = err
+		return
+	}
+
+	m.health.lastSuccess = time.Now()
+	m.health.lastError = nil
+}
+
+// LastSuccess returns when a message was last sent successfully, or the zero time if
+// nothing has been sent yet.
+func (m Mailer) LastSuccess() time.Time {
+	m.health.mu.Lock()
+	defer m.health.mu.Unlock()
+
+	return m.health.lastSuccess
+}
+
+// LastError returns the error from the most recent failed attempt to send a message, or
+// nil if the most recent attempt succeeded.
+func (m Mailer) LastError() error {
+	m.health.mu.Lock()
+	defer m.health.mu.Unlock()
+
+	return m.health.lastError
+}
+
+// RenderOnly executes the named template with the given data, exactly as Send would,
+// but returns the result instead of sending it. If there is no such template,
+// ErrTemplateNotFound is returned.
+func (m Mailer) RenderOnly(templateFile string, data interface{}) (*Rendered, error) {
+	name := path.Join("templates", templateFile)
+	if path.Dir(name) != "templates" {
+		return nil, ErrTemplateNotFound
+	}
+
+	if _, err := fs.Stat(m.templates, name); err != nil {
+		return nil, ErrTemplateNotFound
+	}
+
+	// The functions have to be registered before the templates are parsed.
+	tmpl, err := template.New("email").Funcs(m.funcs).ParseFS(m.templates, name)
+	if err != nil {
+		return nil, err
+	}
+
+	// If the subject has been overridden, redefine the subject block with it.
+	if subject, ok := m.subjects[templateFile]; ok {
+		_, err = tmpl.New("subject").Parse(subject)
+		if err != nil {
+			return nil, err
 		}
+	}
 
-		time.Sleep(500 * time.Millisecond)
+	// Execute the named template "subject", passing in the dynamic data and storing the
+	// result in a bytes.Buffer variable.
+	var subject bytes.Buffer
+	err = tmpl.ExecuteTemplate(&subject, "subject", data)
+	if err != nil {
+		return nil, err
+	}
+
+	var plainBody bytes.Buffer
+	err = tmpl.ExecuteTemplate(&plainBody, "plainBody", data)
+	if err != nil {
+		return nil, err
+	}
+
+	// If there's an MJML compiler and the template has MJML, compile it for the HTML
+	// body. Otherwise use the htmlBody block, which for MJML templates holds the
+	// pre-compiled output.
+	var htmlBody bytes.Buffer
+	if m.mjmlCompiler != nil && tmpl.Lookup("mjmlBody") != nil {
+		var mjmlBody bytes.Buffer
+		err = tmpl.ExecuteTemplate(&mjmlBody, "mjmlBody", data)
+		if err != nil {
+			return nil, err
+		}
+
+		html, err := m.mjmlCompiler.Compile(mjmlBody.String())
+		if err != nil {
+			return nil, err
+		}
+
+		htmlBody.WriteString(html)
+	} else {
+		err = tmpl.ExecuteTemplate(&htmlBody, "htmlBody", data)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// The ampBody block is optional, so only execute it if the template defines it.
+	var ampBody bytes.Buffer
+	if tmpl.Lookup("ampBody") != nil {
+		err = tmpl.ExecuteTemplate(&ampBody, "ampBody", data)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &Rendered{
+		Subject:   m.subjectPrefix + subject.String(),
+		PlainBody: plainBody.String(),
+		HTMLBody:  htmlBody.String(),
+		AMPBody:   ampBody.String(),
+	}, nil
+}
+
+// CheckSubjects validates the subjects set with WithSubjects. Every overridden
+// template must exist and still define its own (default) subject block, so that
+// removing an override never leaves a template without a subject, and every override
+// must be a non-empty template which parses.
+func (m Mailer) CheckSubjects() error {
+	for templateFile, subject := range m.subjects {
+		name := path.Join("templates", templateFile)
+		if path.Dir(name) != "templates" {
+			return fmt.Errorf("subject for %q: %w", templateFile, ErrTemplateNotFound)
+		}
+
+		if _, err := fs.Stat(m.templates, name); err != nil {
+			return fmt.Errorf("subject for %q: %w", templateFile, ErrTemplateNotFound)
+		}
+
+		tmpl, err := template.New("email").Funcs(m.funcs).ParseFS(m.templates, name)
+		if err != nil {
+			return err
+		}
+
+		if tmpl.Lookup("subject") == nil {
+			return fmt.Errorf("template %q has no default subject", templateFile)
+		}
+
+		if strings.TrimSpace(subject) == "" {
+			return fmt.Errorf("subject for %q must not be empty", templateFile)
+		}
+
+		_, err = tmpl.New("subject").Parse(subject)
+		if err != nil {
+			return fmt.Errorf("invalid subject for %q: %w", templateFile, err)
+		}
 	}
 
 	return nil
 }
+
+// Localize returns the name of the template to use for the given locale. Localized
+// templates sit alongside the default one with the locale before the extension, e.g.
+// "token_activation.fr.tmpl". If there is no template for the exact locale we fall
+// back to its base language ("pt-BR" to "pt"), and then to the default template.
+func (m Mailer) Localize(templateFile, locale string) string {
+	if locale == "" {
+		return templateFile
+	}
+
+	ext := path.Ext(templateFile)
+	base := strings.TrimSuffix(templateFile, ext)
+
+	candidates := []string{locale}
+	if i := strings.Index(locale, "-"); i > 0 {
+		candidates = append(candidates, locale[:i])
+	}
+
+	for _, candidate := range candidates {
+		name := base + "." + candidate + ext
+		if _, err := fs.Stat(m.templates, path.Join("templates", name)); err == nil {
+			return name
+		}
+	}
+
+	return templateFile
+}
+
+// Override returns the name of the template to use for an override key, such as a
+// tenant for white-label deployments. Overrides sit alongside the default template
+// with the key before the extension, e.g. "user_welcome.acme.tmpl", and if there isn't
+// one the default template is used. Keys containing anything other than letters,
+// digits, hyphens and underscores are ignored. The result is cached per template and
+// key, for as long as the mailer lives, so keys should come from a small set (such as
+// tenants) rather than being unbounded.
+func (m Mailer) Override(templateFile, key string) string {
+	if key == "" || strings.IndexFunc(key, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_')
+	}) >= 0 {
+		return templateFile
+	}
+
+	cacheKey := templateFile + "\x00" + key
+
+	m.overrides.mu.RLock()
+	name, ok := m.overrides.names[cacheKey]
+	m.overrides.mu.RUnlock()
+
+	if ok {
+		return name
+	}
+
+	ext := path.Ext(templateFile)
+	name = strings.TrimSuffix(templateFile, ext) + "." + key + ext
+
+	if _, err := fs.Stat(m.templates, path.Join("templates", name)); err != nil {
+		name = templateFile
+	}
+
+	m.overrides.mu.Lock()
+	m.overrides.names[cacheKey] = name
+	m.overrides.mu.Unlock()
+
+	return name
+}
+
+// Verify checks that the SMTP server can be reached and accepts our credentials, by
+// connecting (including STARTTLS and AUTH) and then closing the connection without
+// sending anything. It's meant to be called at startup, so that a misconfigured mailer
+// fails straight away rather than on the first email. Errors wrap ErrSMTPAuth if the
+// server rejected the credentials, or ErrSMTPUnreachable if we couldn't connect.
+func (m Mailer) Verify() error {
+	s, err := m.dialer.Dial()
+	if err != nil {
+		var (
+			protoErr *textproto.Error
+			netErr   net.Error
+		)
+
+		switch {
+		case errors.As(err, &protoErr) && (protoErr.Code == 530 || protoErr.Code == 534 || protoErr.Code == 535):
+			return fmt.Errorf("%w: %v", ErrSMTPAuth, err)
+		case errors.As(err, &netErr):
+			return fmt.Errorf("%w: %v", ErrSMTPUnreachable, err)
+		default:
+			return fmt.Errorf("smtp verification failed: %w", err)
+		}
+	}
+
+	return s.Close()
+}
+
+// send makes a single attempt at sending the message. If an envelope sender has been
+// configured we have to dial and send ourselves, as DialAndSend() always uses the
+// From (or Sender) header for MAIL FROM.
+func (m Mailer) send(msg *mail.Message) error {
+	if m.envelopeSender == "" {
+		return m.dialer.DialAndSend(msg)
+	}
+
+	to := msg.GetHeader("To")
+
+	s, err := m.dialer.Dial()
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	return s.Send(m.envelopeFrom(to), to, msg)
+}
+
+// envelopeFrom returns the envelope sender for a message to the given recipients,
+// substituting the VERP-encoded recipient into the configured address.
+func (m Mailer) envelopeFrom(to []string) string {
+	recipient := "batch"
+	if len(to) == 1 {
+		recipient = strings.Replace(to[0], "@", "=", 1)
+	}
+
+	return strings.ReplaceAll(m.envelopeSender, "{recipient}", recipient)
+}
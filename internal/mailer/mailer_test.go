@@ -0,0 +1,101 @@
+package mailer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bal3000/greenlight/internal/jsonlog"
+)
+
+// TestConcurrentSends fires many sends at once through a single Mailer, along with
+// the other methods that touch its shared state. Run it with -race.
+func TestConcurrentSends(t *testing.T) {
+	s := newStubSMTP(t, nil)
+	m := s.mailer()
+
+	const senders = 50
+
+	var wg sync.WaitGroup
+	errs := make(chan error, senders)
+
+	for i := 0; i < senders; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			recipient := fmt.Sprintf("user%d@example.com", i)
+
+			_, err := m.SendDetailed(context.Background(), recipient, "user_welcome.tmpl", nil, WithOverride(fmt.Sprintf("tenant%d", i%5)))
+			if err != nil {
+				errs <- err
+				return
+			}
+
+			m.LastSuccess()
+			m.LastError()
+		}(i)
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Errorf("SendDetailed: %v", err)
+	}
+
+	if got := len(s.received()); got != senders {
+		t.Errorf("server received %d messages; want %d", got, senders)
+	}
+
+	if m.LastSuccess().IsZero() || m.LastError() != nil {
+		t.Errorf("got last success %v, last error %v; want a success and no error", m.LastSuccess(), m.LastError())
+	}
+}
+
+// TestConcurrentQueue sends through the queue's workers from many goroutines, and
+// closes the queue while some of them are still notifying. Run it with -race.
+func TestConcurrentQueue(t *testing.T) {
+	s := newStubSMTP(t, nil)
+	q := NewQueue(s.mailer(), jsonlog.New(io.Discard, jsonlog.LevelFatal), 4, 100, time.Minute)
+
+	const senders = 50
+
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		queued int
+	)
+
+	for i := 0; i < senders; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			err := q.Notify(context.Background(), fmt.Sprintf("user%d@example.com", i), "user_welcome.tmpl", nil)
+			switch {
+			case err == nil:
+				mu.Lock()
+				queued++
+				mu.Unlock()
+			case !errors.Is(err, ErrQueueClosed) && !errors.Is(err, ErrQueueFull):
+				t.Errorf("Notify: %v", err)
+			}
+		}(i)
+
+		if i == senders/2 {
+			go q.Close()
+		}
+	}
+
+	wg.Wait()
+	q.Close()
+
+	if got := len(s.received()); got != queued {
+		t.Errorf("server received %d messages; want the %d that were queued", got, queued)
+	}
+}
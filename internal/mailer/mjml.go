@@ -0,0 +1,56 @@
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// MJMLCompiler compiles MJML markup into HTML. If one is set with WithMJMLCompiler,
+// templates which define an "mjmlBody" block have it rendered and compiled for the
+// HTML body. Without one, the template's "htmlBody" block is used as normal, so MJML
+// templates should also carry their pre-compiled HTML in an "htmlBody" block.
+type MJMLCompiler interface {
+	Compile(mjml string) (string, error)
+}
+
+// CommandMJMLCompiler compiles MJML with the mjml command line tool (installed with
+// "npm install -g mjml"), which reads the markup on stdin and writes the HTML to stdout.
+type CommandMJMLCompiler struct {
+	// Path is the mjml executable. Defaults to "mjml", looked up in the PATH.
+	Path string
+	// Timeout is how long to wait for the command. Defaults to 10 seconds.
+	Timeout time.Duration
+}
+
+func (c CommandMJMLCompiler) Compile(mjml string) (string, error) {
+	path := c.Path
+	if path == "" {
+		path = "mjml"
+	}
+
+	timeout := c.Timeout
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+
+	cmd := exec.CommandContext(ctx, path, "-i", "-s")
+	cmd.Stdin = strings.NewReader(mjml)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	if err != nil {
+		return "", fmt.Errorf("mjml: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	return stdout.String(), nil
+}
@@ -0,0 +1,113 @@
+package mailer
+
+import (
+	"context"
+	"io/fs"
+	"path"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"testing/fstest"
+)
+
+// recordingFS records the template files that the mailer looks for, in order. It only
+// implements Open, so that every lookup (fs.Stat included) goes through it.
+type recordingFS struct {
+	fsys fs.FS
+
+	mu     sync.Mutex
+	opened []string
+}
+
+func (r *recordingFS) Open(name string) (fs.File, error) {
+	if strings.HasSuffix(name, ".tmpl") {
+		r.mu.Lock()
+		r.opened = append(r.opened, path.Base(name))
+		r.mu.Unlock()
+	}
+
+	return r.fsys.Open(name)
+}
+
+func (r *recordingFS) take() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	opened := r.opened
+	r.opened = nil
+	return opened
+}
+
+func welcomeTemplate(subject string) *fstest.MapFile {
+	return &fstest.MapFile{Data: []byte(`{{define "subject"}}` + subject + `{{end}}` +
+		`{{define "plainBody"}}Hi{{end}}` +
+		`{{define "htmlBody"}}<p>Hi</p>{{end}}`)}
+}
+
+func TestOverrideResolutionOrder(t *testing.T) {
+	templates := &recordingFS{fsys: fstest.MapFS{
+		"templates/welcome.tmpl":      welcomeTemplate("Welcome"),
+		"templates/welcome.acme.tmpl": welcomeTemplate("Welcome to Acme"),
+	}}
+
+	m := New("localhost", 25, "", "", "no-reply@greenlight.test")
+	m.templates = templates
+
+	tests := []struct {
+		key        string
+		want       string
+		wantLookup []string
+	}{
+		// The override is tried first, and used if it exists.
+		{key: "acme", want: "welcome.acme.tmpl", wantLookup: []string{"welcome.acme.tmpl"}},
+		// Otherwise we fall back on the default, without looking it up.
+		{key: "globex", want: "welcome.tmpl", wantLookup: []string{"welcome.globex.tmpl"}},
+		// Invalid keys aren't looked up at all.
+		{key: "../acme", want: "welcome.tmpl", wantLookup: nil},
+		{key: "", want: "welcome.tmpl", wantLookup: nil},
+		// Resolutions are cached, so a repeated key isn't looked up again.
+		{key: "acme", want: "welcome.acme.tmpl", wantLookup: nil},
+		{key: "globex", want: "welcome.tmpl", wantLookup: nil},
+	}
+
+	for _, tt := range tests {
+		got := m.Override("welcome.tmpl", tt.key)
+		if got != tt.want {
+			t.Errorf("Override(%q) = %q; want %q", tt.key, got, tt.want)
+		}
+
+		if lookups := templates.take(); !reflect.DeepEqual(lookups, tt.wantLookup) {
+			t.Errorf("Override(%q) looked up %q; want %q", tt.key, lookups, tt.wantLookup)
+		}
+	}
+}
+
+func TestSendWithOverride(t *testing.T) {
+	s := newStubSMTP(t, nil)
+	m := s.mailer()
+	m.templates = fstest.MapFS{
+		"templates/welcome.tmpl":      welcomeTemplate("Welcome"),
+		"templates/welcome.acme.tmpl": welcomeTemplate("Welcome to Acme"),
+	}
+
+	for _, key := range []string{"acme", "globex"} {
+		_, err := m.SendDetailed(context.Background(), "alice@example.com", "welcome.tmpl", nil, WithOverride(key))
+		if err != nil {
+			t.Fatalf("SendDetailed(%q): %v", key, err)
+		}
+	}
+
+	got := s.received()
+	if len(got) != 2 {
+		t.Fatalf("server received %d messages; want 2", len(got))
+	}
+
+	if !strings.Contains(got[0].data, "Subject: Welcome to Acme\n") {
+		t.Errorf("expected the acme override to be sent, got:\n%s", got[0].data)
+	}
+
+	if !strings.Contains(got[1].data, "Subject: Welcome\n") {
+		t.Errorf("expected the default template to be sent, got:\n%s", got[1].data)
+	}
+}
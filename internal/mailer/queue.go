@@ -0,0 +1,157 @@
+package mailer
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/bal3000/greenlight/internal/jsonlog"
+	"github.com/bal3000/greenlight/internal/notifier"
+)
+
+var (
+	ErrQueueFull   = errors.New("mail queue is full")
+	ErrQueueClosed = errors.New("mail queue is closed")
+)
+
+// job is a single queued notification. Each job carries its own context, and if that
+// context has expired by the time a worker picks the job up, the job is dropped rather
+// than being delivered late.
+type job struct {
+	ctx          context.Context
+	cancel       context.CancelFunc
+	recipient    string
+	templateFile string
+	data         interface{}
+}
+
+// Queue delivers notifications asynchronously using a pool of worker goroutines. It
+// implements the notifier.Notifier interface, so it can wrap the Mailer (or any other
+// Notifier) transparently.
+type Queue struct {
+	next   notifier.Notifier
+	logger *jsonlog.Logger
+	maxAge time.Duration
+	redact func(string) string
+	jobs   chan job
+	wg     sync.WaitGroup
+
+	// closed is set by Close, under the write lock, before the jobs channel is closed.
+	// Notify holds the read lock while it sends, so it can never send on the closed
+	// channel.
+	mu     sync.RWMutex
+	closed bool
+}
+
+// QueueOption configures optional Queue behaviour.
+type QueueOption func(*Queue)
+
+// WithRecipientRedaction makes the queue pass recipient addresses through fn (for
+// example, data.EmailHasher.Hash) before they are written to the log, so that log
+// lines can still be correlated without recording the addresses themselves.
+func WithRecipientRedaction(fn func(string) string) QueueOption {
+	return func(q *Queue) {
+		q.redact = fn
+	}
+}
+
+// NewQueue starts a queue with the given number of workers and buffer size. Jobs that
+// are queued with a context that has no deadline are given a deadline of maxAge from
+// the time they were queued, so that mail queued during an SMTP outage isn't sent hours
+// late once the server recovers.
+func NewQueue(next notifier.Notifier, logger *jsonlog.Logger, workers, size int, maxAge time.Duration, opts ...QueueOption) *Queue {
+	q := &Queue{
+		next:   next,
+		logger: logger,
+		maxAge: maxAge,
+		redact: func(recipient string) string { return recipient },
+		jobs:   make(chan job, size),
+	}
+
+	for _, opt := range opts {
+		opt(q)
+	}
+
+	for i := 0; i < workers; i++ {
+		q.wg.Add(1)
+		go q.work()
+	}
+
+	return q
+}
+
+// Notify queues the notification for delivery, returning ErrQueueFull straight away if
+// there is no room in the queue, or ErrQueueClosed if the queue has been closed.
+func (q *Queue) Notify(ctx context.Context, recipient, templateFile string, data interface{}) error {
+	j := job{
+		ctx:          ctx,
+		cancel:       func() {},
+		recipient:    recipient,
+		templateFile: templateFile,
+		data:         data,
+	}
+
+	if _, ok := ctx.Deadline(); !ok && q.maxAge > 0 {
+		j.ctx, j.cancel = context.WithTimeout(ctx, q.maxAge)
+	}
+
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	if q.closed {
+		j.cancel()
+		return ErrQueueClosed
+	}
+
+	select {
+	case q.jobs <- j:
+		return nil
+	default:
+		j.cancel()
+		return ErrQueueFull
+	}
+}
+
+// Close stops accepting new jobs and waits for the workers to finish the jobs that are
+// already in the queue. Any later calls to Notify fail with ErrQueueClosed, so it's
+// safe to close the queue while background tasks might still be sending.
+func (q *Queue) Close() {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.jobs)
+	}
+	q.mu.Unlock()
+
+	q.wg.Wait()
+}
+
+func (q *Queue) work() {
+	defer q.wg.Done()
+
+	for j := range q.jobs {
+		q.process(j)
+	}
+}
+
+func (q *Queue) process(j job) {
+	defer j.cancel()
+
+	if err := j.ctx.Err(); err != nil {
+		q.logger.PrintInfo("dropped stale mail job", map[string]string{
+			"recipient": q.redact(j.recipient),
+			"template":  j.templateFile,
+			"reason":    err.Error(),
+		})
+		return
+	}
+
+	err := q.next.Notify(j.ctx, j.recipient, j.templateFile, j.data)
+	if err != nil {
+		q.logger.PrintError(err, map[string]string{
+			"recipient": q.redact(j.recipient),
+			"template":  j.templateFile,
+		})
+	}
+}
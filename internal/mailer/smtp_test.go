@@ -0,0 +1,298 @@
+package mailer
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"math/big"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-mail/mail/v2"
+)
+
+// stubMessage is a message received by the stub SMTP server.
+type stubMessage struct {
+	from string
+	to   []string
+	data string
+	tls  bool
+}
+
+// stubSMTP is a minimal SMTP server for tests. It advertises STARTTLS if it has a TLS
+// config, and records every message it's sent.
+type stubSMTP struct {
+	ln        net.Listener
+	tlsConfig *tls.Config
+
+	mu       sync.Mutex
+	messages []stubMessage
+}
+
+func newStubSMTP(t *testing.T, tlsConfig *tls.Config) *stubSMTP {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &stubSMTP{ln: ln, tlsConfig: tlsConfig}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+
+	return s
+}
+
+// mailer returns a Mailer which sends to the stub server.
+func (s *stubSMTP) mailer(opts ...Option) Mailer {
+	addr := s.ln.Addr().(*net.TCPAddr)
+	return New("127.0.0.1", addr.Port, "", "", "Greenlight <no-reply@greenlight.test>", opts...)
+}
+
+func (s *stubSMTP) received() []stubMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]stubMessage(nil), s.messages...)
+}
+
+func (s *stubSMTP) serve(conn net.Conn) {
+	defer conn.Close()
+
+	var (
+		tp       = textproto.NewConn(conn)
+		secure   bool
+		from     string
+		to       []string
+		writeErr error
+	)
+
+	reply := func(lines ...string) {
+		for _, line := range lines {
+			if writeErr == nil {
+				writeErr = tp.PrintfLine("%s", line)
+			}
+		}
+	}
+
+	reply("220 stub ESMTP")
+
+	for writeErr == nil {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+
+		verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+
+		switch verb {
+		case "EHLO":
+			if s.tlsConfig != nil && !secure {
+				reply("250-stub", "250-STARTTLS", "250 8BITMIME")
+			} else {
+				reply("250-stub", "250 8BITMIME")
+			}
+		case "HELO", "NOOP", "RSET":
+			reply("250 OK")
+		case "STARTTLS":
+			if s.tlsConfig == nil || secure {
+				reply("502 not supported")
+				continue
+			}
+
+			reply("220 ready to start TLS")
+
+			tlsConn := tls.Server(conn, s.tlsConfig)
+			if err := tlsConn.Handshake(); err != nil {
+				return
+			}
+
+			conn, tp, secure = tlsConn, textproto.NewConn(tlsConn), true
+		case "MAIL":
+			from, to = line, nil
+			reply("250 OK")
+		case "RCPT":
+			to = append(to, strings.TrimPrefix(line, "RCPT TO:"))
+			reply("250 OK")
+		case "DATA":
+			reply("354 go ahead")
+
+			data, err := tp.ReadDotBytes()
+			if err != nil {
+				return
+			}
+
+			s.mu.Lock()
+			s.messages = append(s.messages, stubMessage{from: from, to: to, data: string(data), tls: secure})
+			s.mu.Unlock()
+
+			reply("250 OK")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("502 not implemented")
+		}
+	}
+}
+
+// testCertificate returns a self-signed certificate for 127.0.0.1, and a pool which
+// trusts it.
+func testCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, pool
+}
+
+// stubTLS starts a stub server which offers STARTTLS, accepting TLS versions up to
+// maxVersion, and returns a mailer which trusts its certificate.
+func stubTLS(t *testing.T, maxVersion uint16, opts ...Option) (*stubSMTP, Mailer) {
+	t.Helper()
+
+	cert, pool := testCertificate(t)
+
+	s := newStubSMTP(t, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MaxVersion:   maxVersion,
+	})
+
+	m := s.mailer(opts...)
+	m.dialer.TLSConfig.RootCAs = pool
+
+	return s, m
+}
+
+func TestStartTLSRequired(t *testing.T) {
+	t.Run("server offers STARTTLS", func(t *testing.T) {
+		s, m := stubTLS(t, tls.VersionTLS13)
+		m.dialer.StartTLSPolicy = mail.MandatoryStartTLS
+
+		err := m.Send("alice@example.com", "user_welcome.tmpl", nil)
+		if err != nil {
+			t.Fatalf("Send: %v", err)
+		}
+
+		got := s.received()
+		if len(got) != 1 || !got[0].tls {
+			t.Fatalf("expected one message sent over TLS, got %+v", got)
+		}
+	})
+
+	t.Run("server doesn't offer STARTTLS", func(t *testing.T) {
+		s := newStubSMTP(t, nil)
+		m := s.mailer()
+		m.dialer.StartTLSPolicy = mail.MandatoryStartTLS
+
+		err := m.Verify()
+
+		var unsupported mail.StartTLSUnsupportedError
+		if !errors.As(err, &unsupported) {
+			t.Fatalf("expected StartTLSUnsupportedError, got %v", err)
+		}
+	})
+}
+
+func TestStartTLSOptional(t *testing.T) {
+	t.Run("server offers STARTTLS", func(t *testing.T) {
+		s, m := stubTLS(t, tls.VersionTLS13)
+
+		err := m.Send("alice@example.com", "user_welcome.tmpl", nil)
+		if err != nil {
+			t.Fatalf("Send: %v", err)
+		}
+
+		got := s.received()
+		if len(got) != 1 || !got[0].tls {
+			t.Fatalf("expected one message sent over TLS, got %+v", got)
+		}
+	})
+
+	t.Run("server doesn't offer STARTTLS", func(t *testing.T) {
+		s := newStubSMTP(t, nil)
+		m := s.mailer()
+
+		err := m.Send("alice@example.com", "user_welcome.tmpl", nil)
+		if err != nil {
+			t.Fatalf("Send: %v", err)
+		}
+
+		got := s.received()
+		if len(got) != 1 || got[0].tls {
+			t.Fatalf("expected one message sent in the clear, got %+v", got)
+		}
+	})
+}
+
+func TestMinTLSVersion(t *testing.T) {
+	tests := []struct {
+		name       string
+		opts       []Option
+		serverMax  uint16
+		wantFailed bool
+	}{
+		{name: "default accepts TLS 1.2", serverMax: tls.VersionTLS12},
+		{name: "default rejects TLS 1.1", serverMax: tls.VersionTLS11, wantFailed: true},
+		{name: "1.3 accepts TLS 1.3", opts: []Option{WithMinTLSVersion(tls.VersionTLS13)}, serverMax: tls.VersionTLS13},
+		{name: "1.3 rejects TLS 1.2", opts: []Option{WithMinTLSVersion(tls.VersionTLS13)}, serverMax: tls.VersionTLS12, wantFailed: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, m := stubTLS(t, tt.serverMax, tt.opts...)
+
+			err := m.Verify()
+			if tt.wantFailed && err == nil {
+				t.Fatal("expected the connection to be rejected")
+			}
+			if !tt.wantFailed && err != nil {
+				t.Fatalf("Verify: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,121 @@
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"mime/multipart"
+	"net/textproto"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultSpamThreshold is SpamAssassin's default required score, for use with
+// CommandSpamChecker.
+const DefaultSpamThreshold = 5.0
+
+// CommandSpamChecker scores emails with SpamAssassin's spamc client, which reads a
+// message on stdin and, with -c, prints "score/threshold" to stdout. It needs spamd
+// running somewhere spamc can reach. The scores are on SpamAssassin's scale, so
+// DefaultSpamThreshold is a sensible threshold.
+type CommandSpamChecker struct {
+	// Path is the spamc executable. Defaults to "spamc", looked up in the PATH.
+	Path string
+	// Timeout is how long to wait for the command. Defaults to 10 seconds.
+	Timeout time.Duration
+}
+
+func (c CommandSpamChecker) Score(ctx context.Context, rendered *Rendered) (float64, error) {
+	path := c.Path
+	if path == "" {
+		path = "spamc"
+	}
+
+	timeout := c.Timeout
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+
+	message, err := spamCheckMessage(rendered)
+	if err != nil {
+		return 0, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+
+	cmd := exec.CommandContext(ctx, path, "-c")
+	cmd.Stdin = bytes.NewReader(message)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	// spamc -c exits with 1 when the message is spam by spamd's own threshold, which
+	// isn't a failure; our threshold is applied to the score by the mailer.
+	err = cmd.Run()
+	var exitErr *exec.ExitError
+	if err != nil && !(errors.As(err, &exitErr) && exitErr.ExitCode() == 1) {
+		return 0, fmt.Errorf("spamc: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	score, _, _ := strings.Cut(strings.TrimSpace(stdout.String()), "/")
+
+	value, err := strconv.ParseFloat(score, 64)
+	if err != nil {
+		return 0, fmt.Errorf("spamc: unexpected output %q", stdout.String())
+	}
+
+	return value, nil
+}
+
+// spamCheckMessage builds a minimal MIME message from the rendered email, with the
+// subject and each of the bodies as a multipart/alternative part, for a spam checker
+// that expects a whole message.
+func spamCheckMessage(rendered *Rendered) ([]byte, error) {
+	var body bytes.Buffer
+
+	w := multipart.NewWriter(&body)
+
+	parts := []struct {
+		contentType string
+		content     string
+	}{
+		{"text/plain", rendered.PlainBody},
+		{"text/x-amp-html", rendered.AMPBody},
+		{"text/html", rendered.HTMLBody},
+	}
+
+	for _, part := range parts {
+		if part.content == "" {
+			continue
+		}
+
+		pw, err := w.CreatePart(textproto.MIMEHeader{"Content-Type": {part.contentType + "; charset=UTF-8"}})
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = pw.Write([]byte(part.content))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err := w.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	var message bytes.Buffer
+
+	fmt.Fprintf(&message, "Subject: %s\r\n", rendered.Subject)
+	fmt.Fprintf(&message, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&message, "Content-Type: multipart/alternative; boundary=%q\r\n\r\n", w.Boundary())
+	message.Write(body.Bytes())
+
+	return message.Bytes(), nil
+}
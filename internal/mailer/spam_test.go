@@ -0,0 +1,95 @@
+package mailer
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// fakeSpamc writes a script which stands in for spamc: it saves the message it's given
+// to a file, prints the output and exits with the code.
+func fakeSpamc(t *testing.T, output string, exitCode int) (path, messageFile string) {
+	t.Helper()
+
+	dir := t.TempDir()
+	path = filepath.Join(dir, "spamc")
+	messageFile = filepath.Join(dir, "message")
+
+	script := "#!/bin/sh\ncat > " + messageFile + "\necho '" + output + "'\nexit " + strconv.Itoa(exitCode) + "\n"
+
+	err := os.WriteFile(path, []byte(script), 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return path, messageFile
+}
+
+func TestCommandSpamChecker(t *testing.T) {
+	rendered := &Rendered{Subject: "Hello", PlainBody: "plain body", HTMLBody: "<p>html body</p>"}
+
+	tests := []struct {
+		name     string
+		output   string
+		exitCode int
+		want     float64
+		wantErr  bool
+	}{
+		{name: "ham", output: "1.2/5.0", want: 1.2},
+		{name: "spam", output: "8.5/5.0", exitCode: 1, want: 8.5},
+		{name: "garbage", output: "nope", wantErr: true},
+		{name: "failure", output: "0/0", exitCode: 2, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path, messageFile := fakeSpamc(t, tt.output, tt.exitCode)
+
+			score, err := CommandSpamChecker{Path: path}.Score(context.Background(), rendered)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got score %g", score)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if score != tt.want {
+				t.Errorf("got score %g; want %g", score, tt.want)
+			}
+
+			message, err := os.ReadFile(messageFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, want := range []string{"Subject: Hello\r\n", "plain body", "<p>html body</p>"} {
+				if !strings.Contains(string(message), want) {
+					t.Errorf("message sent to spamc doesn't contain %q:\n%s", want, message)
+				}
+			}
+		})
+	}
+}
+
+func TestSendRefusesSpam(t *testing.T) {
+	path, _ := fakeSpamc(t, "8.5/5.0", 1)
+
+	s := newStubSMTP(t, nil)
+	m := s.mailer(WithSpamChecker(CommandSpamChecker{Path: path}, DefaultSpamThreshold))
+
+	err := m.Send("alice@example.com", "user_welcome.tmpl", nil)
+	if !errors.Is(err, ErrSpam) {
+		t.Fatalf("got %v; want ErrSpam", err)
+	}
+
+	if got := s.received(); len(got) != 0 {
+		t.Errorf("expected nothing to be sent, got %d messages", len(got))
+	}
+}
@@ -0,0 +1,10 @@
+package notifier
+
+import "context"
+
+// Notifier is implemented by anything which can deliver a templated notification to a
+// recipient. The SMTP mailer is the default implementation, but this lets other
+// delivery channels (SMS, push, webhooks) be swapped in without changing the handlers.
+type Notifier interface {
+	Notify(ctx context.Context, recipient, templateFile string, data interface{}) error
+}
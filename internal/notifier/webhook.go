@@ -0,0 +1,98 @@
+package notifier
+
+import (
+	"bytes"
+	"context"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"text/template"
+	"time"
+)
+
+//go:embed "templates"
+var templateFS embed.FS
+
+// WebhookNotifier delivers notifications by POSTing a JSON payload to a webhook URL,
+// such as a Slack incoming webhook. The message text is rendered from the "text" block
+// of a template in the templates directory.
+type WebhookNotifier struct {
+	client *http.Client
+	url    string
+}
+
+// NewWebhook returns a WebhookNotifier which posts to the given URL. If client is nil,
+// a default client with a 5-second timeout is used (matching the mailer's dial
+// timeout).
+func NewWebhook(url string, client *http.Client) WebhookNotifier {
+	if client == nil {
+		client = &http.Client{Timeout: 5 * time.Second}
+	}
+
+	return WebhookNotifier{
+		client: client,
+		url:    url,
+	}
+}
+
+// Notify renders the template and posts it to the webhook. The recipient is sent as the
+// "channel" field, and can be left empty to use the webhook's default channel. Like
+// the mailer, we try up to three times, sleeping for 500 milliseconds between attempts.
+func (n WebhookNotifier) Notify(ctx context.Context, recipient, templateFile string, data interface{}) error {
+	tmpl, err := template.New("webhook").ParseFS(templateFS, fmt.Sprintf("templates/%s", templateFile))
+	if err != nil {
+		return err
+	}
+
+	var text bytes.Buffer
+	err = tmpl.ExecuteTemplate(&text, "text", data)
+	if err != nil {
+		return err
+	}
+
+	payload := map[string]string{"text": text.String()}
+	if recipient != "" {
+		payload["channel"] = recipient
+	}
+
+	js, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	for i := 1; i <= 3; i++ {
+		err = n.post(ctx, js)
+		if err == nil {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(500 * time.Millisecond):
+		}
+	}
+
+	return err
+}
+
+func (n WebhookNotifier) post(ctx context.Context, js []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.url, bytes.NewReader(js))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("webhook returned unexpected status: %s", res.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,148 @@
+package notifier
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// recordingTransport stands in for the network. It records the body of every request,
+// and answers each one with the next status code in the list.
+type recordingTransport struct {
+	mu       sync.Mutex
+	statuses []int
+	bodies   []string
+}
+
+func (rt *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	rt.bodies = append(rt.bodies, string(body))
+
+	status := http.StatusOK
+	if len(rt.statuses) > 0 {
+		status, rt.statuses = rt.statuses[0], rt.statuses[1:]
+	}
+
+	return &http.Response{
+		StatusCode: status,
+		Status:     http.StatusText(status),
+		Body:       io.NopCloser(strings.NewReader("")),
+		Header:     make(http.Header),
+		Request:    req,
+	}, nil
+}
+
+var loginFailuresData = map[string]interface{}{
+	"attempts": 10,
+	"email":    "alice@example.com",
+	"window":   "15 minutes",
+}
+
+func TestWebhookNotify(t *testing.T) {
+	rt := &recordingTransport{}
+	n := NewWebhook("https://hooks.example.com/alerts", &http.Client{Transport: rt})
+
+	err := n.Notify(context.Background(), "#ops", "login_failures.tmpl", loginFailuresData)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rt.bodies) != 1 {
+		t.Fatalf("got %d requests; want 1", len(rt.bodies))
+	}
+
+	var payload map[string]string
+	if err := json.Unmarshal([]byte(rt.bodies[0]), &payload); err != nil {
+		t.Fatal(err)
+	}
+
+	want := ":warning: 10 failed login attempts for alice@example.com in the last 15 minutes."
+	if payload["text"] != want {
+		t.Errorf("got text %q; want %q", payload["text"], want)
+	}
+
+	if payload["channel"] != "#ops" {
+		t.Errorf("got channel %q; want #ops", payload["channel"])
+	}
+}
+
+func TestWebhookNotifyDefaultChannel(t *testing.T) {
+	rt := &recordingTransport{}
+	n := NewWebhook("https://hooks.example.com/alerts", &http.Client{Transport: rt})
+
+	err := n.Notify(context.Background(), "", "login_failures.tmpl", loginFailuresData)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(rt.bodies[0], "channel") {
+		t.Errorf("expected no channel in the payload, got %s", rt.bodies[0])
+	}
+}
+
+func TestWebhookNotifyRetries(t *testing.T) {
+	rt := &recordingTransport{statuses: []int{http.StatusInternalServerError, http.StatusBadGateway, http.StatusOK}}
+	n := NewWebhook("https://hooks.example.com/alerts", &http.Client{Transport: rt})
+
+	err := n.Notify(context.Background(), "", "login_failures.tmpl", loginFailuresData)
+	if err != nil {
+		t.Fatalf("expected the third attempt to succeed, got %v", err)
+	}
+
+	if len(rt.bodies) != 3 {
+		t.Errorf("got %d requests; want 3", len(rt.bodies))
+	}
+}
+
+func TestWebhookNotifyGivesUp(t *testing.T) {
+	rt := &recordingTransport{statuses: []int{500, 500, 500, 500}}
+	n := NewWebhook("https://hooks.example.com/alerts", &http.Client{Transport: rt})
+
+	err := n.Notify(context.Background(), "", "login_failures.tmpl", loginFailuresData)
+	if err == nil || !strings.Contains(err.Error(), "unexpected status") {
+		t.Fatalf("got error %v; want an unexpected status error", err)
+	}
+
+	if len(rt.bodies) != 3 {
+		t.Errorf("got %d requests; want 3", len(rt.bodies))
+	}
+}
+
+func TestWebhookNotifyCancelled(t *testing.T) {
+	rt := &recordingTransport{statuses: []int{500, 500, 500}}
+	n := NewWebhook("https://hooks.example.com/alerts", &http.Client{Transport: rt})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := n.Notify(ctx, "", "login_failures.tmpl", loginFailuresData)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("got error %v; want context.Canceled", err)
+	}
+}
+
+func TestWebhookNotifyUnknownTemplate(t *testing.T) {
+	rt := &recordingTransport{}
+	n := NewWebhook("https://hooks.example.com/alerts", &http.Client{Transport: rt})
+
+	err := n.Notify(context.Background(), "", "missing.tmpl", nil)
+	if err == nil {
+		t.Fatal("expected an error for a missing template")
+	}
+
+	if len(rt.bodies) != 0 {
+		t.Errorf("got %d requests; want none", len(rt.bodies))
+	}
+}
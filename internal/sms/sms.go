@@ -0,0 +1,8 @@
+package sms
+
+// SMSSender is implemented by anything which can deliver a text message to a phone
+// number (Twilio, AWS SNS, etc.). The application only depends on this interface so
+// that a provider can be wired in at startup without coupling to its SDK.
+type SMSSender interface {
+	SendSMS(phone, message string) error
+}
@@ -0,0 +1,68 @@
+package sms
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// TwilioSender sends text messages through Twilio's REST API.
+type TwilioSender struct {
+	client     *http.Client
+	baseURL    string
+	accountSID string
+	authToken  string
+	from       string
+}
+
+// NewTwilio returns a TwilioSender for the given account, sending from the given phone
+// number (in E.164 format). If client is nil, a default client with a 5-second timeout
+// is used.
+func NewTwilio(accountSID, authToken, from string, client *http.Client) TwilioSender {
+	if client == nil {
+		client = &http.Client{Timeout: 5 * time.Second}
+	}
+
+	return TwilioSender{
+		client:     client,
+		baseURL:    "https://api.twilio.com",
+		accountSID: accountSID,
+		authToken:  authToken,
+		from:       from,
+	}
+}
+
+func (s TwilioSender) SendSMS(phone, message string) error {
+	form := url.Values{
+		"To":   {phone},
+		"From": {s.from},
+		"Body": {message},
+	}
+
+	endpoint := fmt.Sprintf("%s/2010-04-01/Accounts/%s/Messages.json", s.baseURL, url.PathEscape(s.accountSID))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(s.accountSID, s.authToken)
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("twilio returned unexpected status: %s", res.Status)
+	}
+
+	return nil
+}
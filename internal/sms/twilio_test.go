@@ -0,0 +1,77 @@
+package sms
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+type transportFunc func(*http.Request) (*http.Response, error)
+
+func (f transportFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func response(status int) *http.Response {
+	return &http.Response{
+		StatusCode: status,
+		Status:     http.StatusText(status),
+		Body:       io.NopCloser(strings.NewReader("")),
+		Header:     make(http.Header),
+	}
+}
+
+func TestTwilioSendSMS(t *testing.T) {
+	var got *http.Request
+	var form url.Values
+
+	client := &http.Client{Transport: transportFunc(func(req *http.Request) (*http.Response, error) {
+		got = req
+
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			return nil, err
+		}
+
+		form, err = url.ParseQuery(string(body))
+		if err != nil {
+			return nil, err
+		}
+
+		return response(http.StatusCreated), nil
+	})}
+
+	s := NewTwilio("AC123", "secret", "+15005550006", client)
+
+	err := s.SendSMS("+447911123456", "Your code is 123456")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := "https://api.twilio.com/2010-04-01/Accounts/AC123/Messages.json"; got.URL.String() != want {
+		t.Errorf("posted to %s; want %s", got.URL, want)
+	}
+
+	if user, pass, ok := got.BasicAuth(); !ok || user != "AC123" || pass != "secret" {
+		t.Errorf("got basic auth %q, %q; want the account SID and auth token", user, pass)
+	}
+
+	if form.Get("To") != "+447911123456" || form.Get("From") != "+15005550006" || form.Get("Body") != "Your code is 123456" {
+		t.Errorf("got form %v", form)
+	}
+}
+
+func TestTwilioSendSMSError(t *testing.T) {
+	client := &http.Client{Transport: transportFunc(func(req *http.Request) (*http.Response, error) {
+		return response(http.StatusBadRequest), nil
+	})}
+
+	s := NewTwilio("AC123", "secret", "+15005550006", client)
+
+	err := s.SendSMS("+447911123456", "Your code is 123456")
+	if err == nil {
+		t.Fatal("expected an error for a 400 response")
+	}
+}
@@ -0,0 +1,70 @@
+package tasks
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/bal3000/greenlight/internal/jsonlog"
+)
+
+// BackgroundTasks keeps track of goroutines doing background work (sending email,
+// cleaning up, and so on), so that the server can wait for them to finish before it
+// exits.
+type BackgroundTasks struct {
+	wg      sync.WaitGroup
+	pending int64
+	logger  *jsonlog.Logger
+}
+
+func New(logger *jsonlog.Logger) *BackgroundTasks {
+	return &BackgroundTasks{logger: logger}
+}
+
+// Go runs fn in a new goroutine. If fn panics the panic is recovered and logged, rather
+// than bringing down the whole application.
+func (t *BackgroundTasks) Go(fn func()) {
+	t.wg.Add(1)
+	atomic.AddInt64(&t.pending, 1)
+
+	go func() {
+		defer t.wg.Done()
+		defer atomic.AddInt64(&t.pending, -1)
+
+		defer func() {
+			if err := recover(); err != nil {
+				t.logger.PrintError(fmt.Errorf("%s", err), nil)
+			}
+		}()
+
+		fn()
+	}()
+}
+
+// Pending returns the number of tasks which haven't finished yet.
+func (t *BackgroundTasks) Pending() int {
+	return int(atomic.LoadInt64(&t.pending))
+}
+
+// Wait blocks until every task has finished, or the context is done. In the latter
+// case it returns the context's error, and the tasks are left running.
+func (t *BackgroundTasks) Wait(ctx context.Context) error {
+	t.logger.PrintInfo("waiting for background tasks", map[string]string{
+		"pending": strconv.Itoa(t.Pending()),
+	})
+
+	done := make(chan struct{})
+	go func() {
+		t.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("%d background tasks still running: %w", t.Pending(), ctx.Err())
+	}
+}
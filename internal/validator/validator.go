@@ -1,17 +1,36 @@
 package validator
 
-import "regexp"
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
 
 // Declare a regular expression for sanity checking the format of email addresses.
 // If you're interested, this regular expression pattern is
 // taken from https://html.spec.whatwg.org/#valid-e-mail-address.
 var (
 	EmailRX = regexp.MustCompile("^[a-zA-Z0-9.!#$%&'*+\\/=?^_`{|}~-]+@[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?(?:\\.[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*$")
+
+	// PhoneRX matches a phone number in E.164 format: a leading "+", a country code
+	// which can't start with 0, and no more than 15 digits in total.
+	PhoneRX = regexp.MustCompile(`^\+[1-9][0-9]{6,14}$`)
+
+	// LocaleRX matches a simple BCP 47 language tag: a lowercase language code,
+	// optionally followed by an uppercase region (e.g. "fr" or "pt-BR").
+	LocaleRX = regexp.MustCompile(`^[a-z]{2,3}(-[A-Z]{2})?$`)
 )
 
 // Define a new Validator type which contains a map of validation errors.
 type Validator struct {
 	Errors map[string]string
+
+	// prefix is prepended to every key added through this Validator. It's only set on
+	// the children returned by WithPrefix.
+	prefix string
 }
 
 // New is a helper which creates a new Validator instance with an empty errors map.
@@ -24,14 +43,99 @@ func (v *Validator) Valid() bool {
 	return len(v.Errors) == 0
 }
 
+// ValidationError is returned by Err() when validation fails. It carries a copy of the
+// errors map, so callers further up the stack can get at the individual field errors
+// with errors.As().
+type ValidationError struct {
+	Errors map[string]string
+}
+
+// Error aggregates the field errors into one message, sorted by key so the message is
+// stable, e.g. "validation failed: email must be provided; name must be provided".
+func (e *ValidationError) Error() string {
+	keys := make([]string, 0, len(e.Errors))
+	for key := range e.Errors {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	messages := make([]string, 0, len(keys))
+	for _, key := range keys {
+		messages = append(messages, key+" "+e.Errors[key])
+	}
+
+	return "validation failed: " + strings.Join(messages, "; ")
+}
+
+// Error implements the error interface, so that an invalid Validator can be returned
+// as an error directly. It has the same message as the ValidationError from Err().
+func (v *Validator) Error() string {
+	return (&ValidationError{Errors: v.Errors}).Error()
+}
+
+// Err returns nil if there are no errors, and otherwise a *ValidationError holding a
+// copy of the errors map. Use this rather than returning the Validator itself when the
+// result needs to be compared with nil.
+func (v *Validator) Err() error {
+	if v.Valid() {
+		return nil
+	}
+
+	return &ValidationError{Errors: v.Clone().Errors}
+}
+
+// Reset clears all of the errors, so that the Validator can be reused (for example, to
+// validate each item in a collection in turn).
+func (v *Validator) Reset() {
+	v.Errors = make(map[string]string)
+}
+
+// Clone returns a new Validator containing a copy of the errors. Changes to the clone
+// don't affect the original.
+func (v *Validator) Clone() *Validator {
+	clone := New()
+
+	for key, message := range v.Errors {
+		clone.Errors[key] = message
+	}
+
+	return clone
+}
+
+// WithPrefix returns a child Validator for a nested object, which adds its errors to
+// the parent's map with the path prepended to the key. For example, a "postcode" error
+// added through v.WithPrefix("user").WithPrefix("address") is stored under
+// "user.address.postcode". The child shares the parent's errors, so Valid() on either
+// reports errors added through both.
+func (v *Validator) WithPrefix(path string) *Validator {
+	return &Validator{Errors: v.Errors, prefix: v.key(path)}
+}
+
+// key returns the full key for an error, including the Validator's prefix.
+func (v *Validator) key(key string) string {
+	if v.prefix == "" {
+		return key
+	}
+
+	return v.prefix + "." + key
+}
+
 // AddError adds an error message to the map (so long as no entry already exists for
 // the given key).
 func (v *Validator) AddError(key, message string) {
+	key = v.key(key)
+
 	if _, exists := v.Errors[key]; !exists {
 		v.Errors[key] = message
 	}
 }
 
+// AddErrorf is like AddError, but builds the message with fmt.Sprintf, for messages
+// which include values (e.g. "must be between 8 and 72 bytes long, got 5").
+func (v *Validator) AddErrorf(key, format string, args ...interface{}) {
+	v.AddError(key, fmt.Sprintf(format, args...))
+}
+
 // Check adds an error message to the map only if a validation check is not 'ok'.
 func (v *Validator) Check(ok bool, key, message string) {
 	if !ok {
@@ -39,6 +143,14 @@ func (v *Validator) Check(ok bool, key, message string) {
 	}
 }
 
+// ValidFilterSort adds an error if a client-provided sort value doesn't exactly match
+// one of the entries in the endpoint's safelist. Sort values end up interpolated into
+// an ORDER BY clause, so anything that isn't explicitly allowed must be rejected (and
+// an empty safelist allows nothing).
+func (v *Validator) ValidFilterSort(key, value string, safelist []string) {
+	v.Check(len(safelist) > 0 && In(value, safelist...), key, "invalid sort value")
+}
+
 // In returns true if a specific value is in a list of strings.
 func In(value string, list ...string) bool {
 	for i := range list {
@@ -64,3 +176,80 @@ func Unique(values []string) bool {
 
 	return len(values) == len(uniqueValues)
 }
+
+// IsE164 returns true if a phone number is in E.164 format (e.g. "+447911123456").
+func IsE164(phone string) bool {
+	return PhoneRX.MatchString(phone)
+}
+
+// IsURL returns true if s is an absolute http or https URL with a host. Any other
+// scheme (such as javascript: or data:) is rejected, as are URLs with credentials in
+// them.
+func IsURL(s string) bool {
+	u, err := url.Parse(s)
+	if err != nil {
+		return false
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return false
+	}
+
+	return u.Host != "" && u.Hostname() != "" && u.User == nil
+}
+
+// The earliest and latest times (relative to now) accepted by ValidDateRange. Anything
+// outside these is almost certainly a client bug rather than a real filter.
+var (
+	minRangeTime      = time.Date(1900, time.January, 1, 0, 0, 0, 0, time.UTC)
+	maxRangeFromToday = 100 * 365 * 24 * time.Hour
+)
+
+// ValidDateRange checks a time range from a filter (such as created_after and
+// created_before): that from isn't after to, and that neither is absurdly far in the
+// past or future. A zero time means that end of the range is open, and isn't checked.
+// Any error is added under the given field key.
+func ValidDateRange(v *Validator, from, to time.Time, field string) {
+	maxTime := time.Now().Add(maxRangeFromToday)
+
+	for _, t := range []time.Time{from, to} {
+		if t.IsZero() {
+			continue
+		}
+
+		v.Check(!t.Before(minRangeTime), field, "must not be before 1900")
+		v.Check(!t.After(maxTime), field, "must not be more than 100 years in the future")
+	}
+
+	if !from.IsZero() && !to.IsZero() {
+		v.Check(!from.After(to), field, "start must not be after the end")
+	}
+}
+
+// SliceLength returns true if a slice has between min and max elements (inclusive).
+func SliceLength[T any](s []T, min, max int) bool {
+	return len(s) >= min && len(s) <= max
+}
+
+// Ordered is a constraint that permits any ordered numeric type. It matches the
+// numeric part of golang.org/x/exp/constraints.Ordered, without the extra dependency.
+type Ordered interface {
+	~int | ~int8 | ~int16 | ~int32 | ~int64 |
+		~uint | ~uint8 | ~uint16 | ~uint32 | ~uint64 | ~uintptr |
+		~float32 | ~float64
+}
+
+// Between returns true if a value is within the inclusive range lo to hi.
+func Between[T Ordered](value, lo, hi T) bool {
+	return value >= lo && value <= hi
+}
+
+// AtLeast returns true if a value is greater than or equal to min.
+func AtLeast[T Ordered](value, min T) bool {
+	return value >= min
+}
+
+// AtMost returns true if a value is less than or equal to max.
+func AtMost[T Ordered](value, max T) bool {
+	return value <= max
+}
@@ -0,0 +1 @@
+ALTER TABLE users ADD COLUMN IF NOT EXISTS password_changed_at timestamp(0) with time zone NOT NULL DEFAULT NOW();
\ No newline at end of file
@@ -0,0 +1 @@
+DROP TABLE IF EXISTS sms_codes;
\ No newline at end of file
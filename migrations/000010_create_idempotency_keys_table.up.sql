@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+    key text PRIMARY KEY,
+    status_code integer NOT NULL DEFAULT 0,
+    response bytea,
+    expiry timestamp(0) with time zone NOT NULL
+);
\ No newline at end of file
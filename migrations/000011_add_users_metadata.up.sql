@@ -0,0 +1 @@
+ALTER TABLE users ADD COLUMN IF NOT EXISTS metadata jsonb NOT NULL DEFAULT '{}';
\ No newline at end of file
@@ -0,0 +1 @@
+DROP TABLE IF EXISTS scheduled_emails;
\ No newline at end of file
@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS scheduled_emails (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    recipient text NOT NULL,
+    template text NOT NULL,
+    data jsonb NOT NULL DEFAULT '{}',
+    send_at timestamp(0) with time zone NOT NULL,
+    status text NOT NULL DEFAULT 'pending',
+    attempts integer NOT NULL DEFAULT 0,
+    last_error text NOT NULL DEFAULT ''
+);
+
+CREATE INDEX IF NOT EXISTS scheduled_emails_status_send_at_idx ON scheduled_emails (status, send_at);
\ No newline at end of file
@@ -0,0 +1 @@
+ALTER TABLE users ADD COLUMN IF NOT EXISTS email_preferences jsonb NOT NULL DEFAULT '{}';
\ No newline at end of file
@@ -0,0 +1,5 @@
+CREATE TABLE IF NOT EXISTS suppressed_emails (
+    email citext PRIMARY KEY,
+    reason text NOT NULL,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
\ No newline at end of file
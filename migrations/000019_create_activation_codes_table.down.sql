@@ -0,0 +1 @@
+DROP TABLE IF EXISTS activation_codes;
\ No newline at end of file
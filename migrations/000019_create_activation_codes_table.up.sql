@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS activation_codes (
+    user_id bigint PRIMARY KEY REFERENCES users ON DELETE CASCADE,
+    hash bytea NOT NULL,
+    expiry timestamp(0) with time zone NOT NULL,
+    attempts integer NOT NULL DEFAULT 0
+);
\ No newline at end of file
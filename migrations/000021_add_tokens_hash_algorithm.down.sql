@@ -0,0 +1 @@
+ALTER TABLE tokens DROP COLUMN IF EXISTS hash_algorithm;
\ No newline at end of file
@@ -0,0 +1 @@
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS hash_algorithm text NOT NULL DEFAULT 'sha256';
\ No newline at end of file
@@ -0,0 +1 @@
+ALTER TABLE users_permissions DROP COLUMN IF EXISTS expires_at;
\ No newline at end of file
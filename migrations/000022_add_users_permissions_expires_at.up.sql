@@ -0,0 +1 @@
+ALTER TABLE users_permissions ADD COLUMN IF NOT EXISTS expires_at timestamp(0) with time zone;
\ No newline at end of file
@@ -0,0 +1 @@
+CREATE INDEX IF NOT EXISTS users_created_at_idx ON users (created_at DESC, id DESC);
\ No newline at end of file
@@ -0,0 +1 @@
+ALTER TABLE users ADD COLUMN IF NOT EXISTS is_service boolean NOT NULL DEFAULT false;
\ No newline at end of file
@@ -0,0 +1 @@
+ALTER TABLE users ADD COLUMN IF NOT EXISTS timezone text NOT NULL DEFAULT 'UTC';
\ No newline at end of file
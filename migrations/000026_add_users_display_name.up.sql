@@ -0,0 +1,3 @@
+ALTER TABLE users ADD COLUMN IF NOT EXISTS display_name text NOT NULL DEFAULT '';
+
+UPDATE users SET display_name = name WHERE display_name = '';
\ No newline at end of file
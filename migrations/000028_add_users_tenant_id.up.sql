@@ -0,0 +1,5 @@
+ALTER TABLE users ADD COLUMN IF NOT EXISTS tenant_id bigint NOT NULL DEFAULT 0;
+
+CREATE UNIQUE INDEX IF NOT EXISTS users_tenant_id_email_key ON users (tenant_id, email);
+
+ALTER TABLE users DROP CONSTRAINT IF EXISTS users_email_key;
\ No newline at end of file
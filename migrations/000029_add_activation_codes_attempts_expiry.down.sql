@@ -0,0 +1 @@
+ALTER TABLE activation_codes DROP COLUMN IF EXISTS attempts_expiry;
\ No newline at end of file
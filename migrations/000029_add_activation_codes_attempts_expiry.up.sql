@@ -0,0 +1 @@
+ALTER TABLE activation_codes ADD COLUMN IF NOT EXISTS attempts_expiry timestamp(0) with time zone NOT NULL DEFAULT NOW();
\ No newline at end of file
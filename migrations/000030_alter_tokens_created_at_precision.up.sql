@@ -0,0 +1 @@
+ALTER TABLE tokens ALTER COLUMN created_at TYPE timestamp with time zone;
\ No newline at end of file
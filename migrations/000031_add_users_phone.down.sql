@@ -0,0 +1 @@
+ALTER TABLE users DROP COLUMN IF EXISTS phone;
\ No newline at end of file
@@ -0,0 +1 @@
+ALTER TABLE users ADD COLUMN IF NOT EXISTS phone text;
\ No newline at end of file
@@ -0,0 +1 @@
+ALTER TABLE scheduled_emails DROP COLUMN IF EXISTS claimed_at;
\ No newline at end of file
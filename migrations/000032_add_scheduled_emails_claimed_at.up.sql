@@ -0,0 +1 @@
+ALTER TABLE scheduled_emails ADD COLUMN IF NOT EXISTS claimed_at timestamp(0) with time zone;
\ No newline at end of file
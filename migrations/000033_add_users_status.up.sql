@@ -0,0 +1,3 @@
+ALTER TABLE users ADD COLUMN IF NOT EXISTS status text NOT NULL DEFAULT 'pending';
+
+UPDATE users SET status = 'active' WHERE activated;
\ No newline at end of file
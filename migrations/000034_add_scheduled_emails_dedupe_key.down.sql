@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS scheduled_emails_dedupe_key_idx;
+
+ALTER TABLE scheduled_emails DROP COLUMN IF EXISTS dedupe_key;
\ No newline at end of file
@@ -0,0 +1,3 @@
+ALTER TABLE scheduled_emails ADD COLUMN IF NOT EXISTS dedupe_key text;
+
+CREATE UNIQUE INDEX IF NOT EXISTS scheduled_emails_dedupe_key_idx ON scheduled_emails (dedupe_key);
\ No newline at end of file
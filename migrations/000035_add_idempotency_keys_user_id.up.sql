@@ -0,0 +1,3 @@
+ALTER TABLE idempotency_keys ADD COLUMN IF NOT EXISTS user_id bigint;
+
+CREATE INDEX IF NOT EXISTS idempotency_keys_user_id_idx ON idempotency_keys (user_id);
\ No newline at end of file
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS sms_codes_phone_idx;
+
+ALTER TABLE sms_codes DROP COLUMN IF EXISTS sent_at;
\ No newline at end of file
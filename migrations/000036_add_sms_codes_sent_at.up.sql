@@ -0,0 +1,3 @@
+ALTER TABLE sms_codes ADD COLUMN IF NOT EXISTS sent_at timestamp(0) with time zone NOT NULL DEFAULT NOW();
+
+CREATE INDEX IF NOT EXISTS sms_codes_phone_idx ON sms_codes (phone);
\ No newline at end of file